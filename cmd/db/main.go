@@ -1,48 +1,188 @@
 package main
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bndrchuk-artem/trenbolonchiki-lab5/datastore"
+	"github.com/bndrchuk-artem/trenbolonchiki-lab5/httptools"
+	"github.com/bndrchuk-artem/trenbolonchiki-lab5/logging"
+	"github.com/bndrchuk-artem/trenbolonchiki-lab5/signal"
 )
 
+var (
+	dataDir      = flag.String("dir", "", "data directory (overrides "+dataDirEnv+")")
+	segmentSize  = flag.Int64("segment-size", 0, "maximum segment size in bytes (overrides "+segmentSizeEnv+")")
+	keysEndpoint = flag.Bool("keys-endpoint", false, "whether to serve the key listing on /db-keys (for debugging)")
+	logLevel     = flag.String("log-level", "info", "minimum level of log entries: debug, info, warn or error")
+	shutdownSec  = flag.Int("shutdown-grace-sec", 10, "how long in-flight requests may take to finish on shutdown")
+	syncOnWrite  = flag.Bool("sync-on-write", false, "whether every write is fsynced before it is acknowledged")
+	maxKeys      = flag.Int("max-keys", 0, "maximum number of stored keys, 0 for no limit")
+	maxDiskBytes = flag.Int64("max-disk-bytes", 0, "size of the segment files beyond which writes are rejected, 0 for no limit")
+	writeBuffer  = flag.Int("write-buffer", 100, "number of writes that may queue for the write handler before writers block")
+	maxOpenFiles = flag.Int("max-open-files", 64, "number of segment files kept open for reads, 0 to open them on every read")
+)
+
+const (
+	dataDirEnv         = "DB_DIR"
+	segmentSizeEnv     = "DB_SEGMENT_SIZE"
+	defaultDataDir     = "/opt/practice-4/out"
+	defaultSegmentSize = datastore.DefaultMaxSegmentSize
+)
+
+// storageConfig resolves the data directory and segment size from the flags,
+// then the environment, then the defaults.
+func storageConfig() (string, int64, error) {
+	dir := *dataDir
+	if dir == "" {
+		dir = os.Getenv(dataDirEnv)
+	}
+	if dir == "" {
+		dir = defaultDataDir
+	}
+
+	size := *segmentSize
+	if size == 0 {
+		if spec := os.Getenv(segmentSizeEnv); spec != "" {
+			var err error
+			if size, err = strconv.ParseInt(spec, 10, 64); err != nil {
+				return "", 0, fmt.Errorf("invalid %s %q: %w", segmentSizeEnv, spec, err)
+			}
+		}
+	}
+	if size == 0 {
+		size = defaultSegmentSize
+	}
+	if size < 0 {
+		return "", 0, fmt.Errorf("invalid segment size %d", size)
+	}
+	return dir, size, nil
+}
+
+// checkWritable creates the directory if needed and makes sure files can be
+// created in it, so a misconfigured directory fails at startup rather than on
+// the first write.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".write-check-")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// jsonValuePrefix marks stored values that hold raw JSON rather than a plain
+// string. Strings are stored as is, so values written before typed values
+// were supported read back unchanged.
+const jsonValuePrefix = "\x00json:"
+
+// encodeValue converts the JSON value of a request into its stored form.
+func encodeValue(raw json.RawMessage) string {
+	var s string
+	if raw[0] == '"' && json.Unmarshal(raw, &s) == nil && !strings.HasPrefix(s, jsonValuePrefix) {
+		return s
+	}
+	return jsonValuePrefix + string(raw)
+}
+
+// decodeValue converts a stored value back into the JSON value it was set
+// with.
+func decodeValue(stored string) interface{} {
+	if raw, ok := strings.CutPrefix(stored, jsonValuePrefix); ok {
+		return json.RawMessage(raw)
+	}
+	return stored
+}
+
 type dbHandler struct {
 	db *datastore.Db
 }
 
 func (h *dbHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Path[len("/db/"):]
+	id := r.Header.Get(httptools.RequestIDHeader)
+	slog.Debug("db request", "method", r.Method, "key", key, "request_id", id)
 
 	switch r.Method {
 	case http.MethodGet:
-		value, err := h.db.Get(key)
+		meta, err := h.db.GetMeta(key)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if !meta.StoredAt.IsZero() {
+			w.Header().Set("Last-Modified", meta.StoredAt.UTC().Format(http.TimeFormat))
+		}
+		if etagMatches(r.Header.Get("If-None-Match"), etag(meta.Checksum)) {
+			w.Header().Set("ETag", etag(meta.Checksum))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		value, err := h.db.GetContext(r.Context(), key)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// The value may have been overwritten since GetMeta, so the ETag is
+		// computed from the value actually sent.
+		w.Header().Set("ETag", etag(sha1.Sum([]byte(value))))
 
 		response := map[string]interface{}{
 			"key":   key,
-			"value": value,
+			"value": decodeValue(value),
 		}
 		json.NewEncoder(w).Encode(response)
 
 	case http.MethodPost:
 		var request struct {
-			Value interface{} `json:"value"`
+			Value json.RawMessage `json:"value"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Value) == 0 {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		stringValue := fmt.Sprintf("%v", request.Value)
-		if err := h.db.Put(key, stringValue); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if err := h.db.PutContext(r.Context(), key, encodeValue(request.Value)); err != nil {
+			if errors.Is(err, datastore.ErrInvalidKey) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else if errors.Is(err, datastore.ErrStoreFull) {
+				slog.Warn("put rejected", "key", key, "error", err, "request_id", id)
+				w.WriteHeader(http.StatusInsufficientStorage)
+			} else {
+				slog.Error("put failed", "key", key, "error", err, "request_id", id)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodDelete:
+		if err := h.db.Delete(key); err != nil {
+			if errors.Is(err, datastore.ErrInvalidKey) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else if errors.Is(err, datastore.ErrKeyNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				slog.Error("delete failed", "key", key, "error", err, "request_id", id)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
 			return
 		}
 
@@ -52,28 +192,234 @@ func (h *dbHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// etag formats the checksum of a value as a strong entity tag.
+func etag(checksum [20]byte) string {
+	return `"` + hex.EncodeToString(checksum[:]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches the entity tag.
+// Weak tags compare equal to strong ones, as If-None-Match calls for.
+func etagMatches(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type batchResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleBatchPut stores all pairs of {"pairs": {...}} in one batch and reports
+// a status per key, so that keys rejected by validation are visible while the
+// valid ones are still written.
+func (h *dbHandler) handleBatchPut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Pairs map[string]json.RawMessage `json:"pairs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results := make(map[string]batchResult, len(request.Pairs))
+	pairs := make(map[string]string, len(request.Pairs))
+	for key, value := range request.Pairs {
+		if err := datastore.ValidateKey(key); err != nil {
+			results[key] = batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		if len(value) == 0 {
+			results[key] = batchResult{Status: http.StatusBadRequest, Error: "missing value"}
+			continue
+		}
+		pairs[key] = encodeValue(value)
+	}
+
+	status := batchResult{Status: http.StatusOK}
+	if err := h.db.PutBatch(pairs); errors.Is(err, datastore.ErrStoreFull) {
+		slog.Warn("batch put rejected", "keys", len(pairs), "error", err)
+		status = batchResult{Status: http.StatusInsufficientStorage, Error: err.Error()}
+	} else if err != nil {
+		slog.Error("batch put failed", "keys", len(pairs), "error", err)
+		status = batchResult{Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+	for key := range pairs {
+		results[key] = status
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// handleBatchGet returns the values of the keys in {"keys": [...]} as one
+// object. Missing keys are left out.
+func (h *dbHandler) handleBatchGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	values, err := h.db.GetMany(request.Keys)
+	if err != nil {
+		slog.Error("batch get failed", "keys", len(request.Keys), "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		response[key] = decodeValue(value)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleKeys lists the stored keys, optionally only those starting with the
+// prefix query parameter, as a JSON array. Keys are written one by one so the
+// response does not have to be built in memory.
+func (h *dbHandler) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	written := 0
+	_, _ = w.Write([]byte("["))
+	for _, key := range h.db.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if written > 0 {
+			_, _ = w.Write([]byte(","))
+		}
+		if err := encoder.Encode(key); err != nil {
+			return
+		}
+		written++
+		if flusher != nil && written%1000 == 0 {
+			flusher.Flush()
+		}
+	}
+	_, _ = w.Write([]byte("]\n"))
+}
+
+// handleHealth reports whether the datastore still takes writes, so that a DB
+// whose write handler is stuck is taken out of rotation.
+func (h *dbHandler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.Ping(); err != nil {
+		slog.Error("datastore unhealthy", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("datastore unhealthy"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handleReady reports whether the datastore is usable, i.e. it was opened and
+// its segment files are still accessible. Unlike /health it fails when the
+// data directory has gone away under the running process.
+func (h *dbHandler) handleReady(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.db.SegmentInfo(); err != nil {
+		slog.Error("datastore not ready", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("datastore unavailable"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
 func main() {
-	dataDir := "/opt/practice-4/out"
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		log.Fatalf("Failed to create data directory: %v", err)
+	flag.Parse()
+	if err := logging.Setup(*logLevel); err != nil {
+		log.Fatal(err)
 	}
 
-	db, err := datastore.CreateDb(dataDir, 10*1024*1024)
+	dir, size, err := storageConfig()
 	if err != nil {
-		log.Fatalf("DB initialization failed: %v", err)
+		logging.Fatal("invalid configuration", "error", err)
+	}
+	if err := checkWritable(dir); err != nil {
+		logging.Fatal("data directory is not writable", "dir", dir, "error", err)
+	}
+	slog.Info("data directory", "dir", dir, "segment_size", size)
+
+	opts := []datastore.Option{
+		datastore.WithMaxSegmentSize(size),
+		datastore.WithWriteBufferSize(*writeBuffer),
+		datastore.WithMaxOpenFiles(*maxOpenFiles),
+	}
+	if *syncOnWrite {
+		opts = append(opts, datastore.WithSyncOnWrite())
+	}
+	if *maxKeys > 0 {
+		opts = append(opts, datastore.WithMaxKeys(*maxKeys))
+	}
+	if *maxDiskBytes > 0 {
+		opts = append(opts, datastore.WithMaxDiskBytes(*maxDiskBytes))
+	}
+	db, err := datastore.CreateDb(dir, opts...)
+	if err != nil {
+		logging.Fatal("DB initialization failed", "error", err)
 	}
-	defer db.Close()
 
 	handler := &dbHandler{db: db}
-	http.Handle("/db/", handler)
+	mux := new(http.ServeMux)
+	mux.Handle("/db/", handler)
+	mux.HandleFunc("/db-batch", handler.handleBatchPut)
+	mux.HandleFunc("/db-batch-get", handler.handleBatchGet)
+	if *keysEndpoint {
+		mux.HandleFunc("/db-keys", handler.handleKeys)
+	}
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	mux.HandleFunc("/health", handler.handleHealth)
+	mux.HandleFunc("/ready", handler.handleReady)
+
+	slog.Info("starting DB server", "port", 8082)
+	server := httptools.CreateServer(8082, mux)
+	server.Start()
+	signal.WaitForTerminationSignal()
+
+	// Writes still in flight are finished before the datastore is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownSec)*time.Second)
+	defer cancel()
+	if err := server.Stop(ctx); err != nil {
+		slog.Warn("in-flight requests did not finish in time", "error", err)
+	}
 
-	log.Println("Starting DB server on :8082")
-	if err := http.ListenAndServe(":8082", nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	// A write stuck on the disk must not keep the process from exiting.
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), time.Duration(*shutdownSec)*time.Second)
+	defer cancelClose()
+	if err := db.CloseContext(closeCtx); err != nil {
+		slog.Error("closing the datastore failed", "error", err)
 	}
 }
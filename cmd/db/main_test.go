@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bndrchuk-artem/trenbolonchiki-lab5/datastore"
+)
+
+func createTestHandler(t *testing.T) *dbHandler {
+	t.Helper()
+	db, err := datastore.CreateDb(t.TempDir(), datastore.WithMaxSegmentSize(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &dbHandler{db: db}
+}
+
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func TestValueRoundTrip(t *testing.T) {
+	h := createTestHandler(t)
+
+	values := []string{
+		`"plain string"`,
+		`42`,
+		`3.5`,
+		`true`,
+		`null`,
+		`{"nested":[1,"two"]}`,
+		`"\u0000json:looks like a marker"`,
+	}
+
+	for _, value := range values {
+		rec := serve(h, http.MethodPost, "/db/key", `{"value":`+value+`}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s: expected 200, got %d", value, rec.Code)
+		}
+
+		rec = serve(h, http.MethodGet, "/db/key", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET after %s: expected 200, got %d", value, rec.Code)
+		}
+		var response struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if string(response.Value) != value {
+			t.Errorf("Expected value %s to round-trip, got %s", value, response.Value)
+		}
+	}
+}
+
+func TestStringValuesStoredAsPlainStrings(t *testing.T) {
+	h := createTestHandler(t)
+
+	serve(h, http.MethodPost, "/db/key", `{"value":"2025-01-01"}`)
+	value, err := h.db.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "2025-01-01" {
+		t.Errorf("Expected the string to be stored as is, got %q", value)
+	}
+}
+
+func TestGetLastModified(t *testing.T) {
+	h := createTestHandler(t)
+
+	before := time.Now().Truncate(time.Second)
+	if rec := serve(h, http.MethodPost, "/db/key", `{"value":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+
+	rec := serve(h, http.MethodGet, "/db/key", "")
+	modified, err := http.ParseTime(rec.Header().Get("Last-Modified"))
+	if err != nil {
+		t.Fatalf("Expected a Last-Modified header: %v", err)
+	}
+	if modified.Before(before) || modified.After(time.Now()) {
+		t.Errorf("Unexpected Last-Modified %v", modified)
+	}
+}
+
+func TestGetETag(t *testing.T) {
+	h := createTestHandler(t)
+	serve(h, http.MethodPost, "/db/key", `{"value":1}`)
+
+	rec := serve(h, http.MethodGet, "/db/key", "")
+	tag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || tag == "" {
+		t.Fatalf("Expected 200 with an ETag, got %d %q", rec.Code, tag)
+	}
+
+	conditional := func(match string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/db/key", nil)
+		req.Header.Set("If-None-Match", match)
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, match := range []string{tag, `"other", W/` + tag, "*"} {
+		if rec := conditional(match); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: expected an empty 304, got %d", match, rec.Code)
+		}
+	}
+
+	serve(h, http.MethodPost, "/db/key", `{"value":2}`)
+	rec = conditional(tag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == tag {
+		t.Errorf("Expected 200 with a new ETag after a write, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestPostWithoutValue(t *testing.T) {
+	h := createTestHandler(t)
+
+	for _, body := range []string{`{}`, `not json`} {
+		if rec := serve(h, http.MethodPost, "/db/key", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	h := createTestHandler(t)
+	invalid := []string{"", "bad%00key", strings.Repeat("k", datastore.MaxKeySize+1)}
+
+	for _, key := range invalid {
+		if rec := serve(h, http.MethodPost, "/db/"+key, `{"value":"x"}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 from POST of %.20q, got %d", key, rec.Code)
+		}
+		if rec := serve(h, http.MethodDelete, "/db/"+key, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 from DELETE of %.20q, got %d", key, rec.Code)
+		}
+	}
+
+	// The batch endpoint applies the same rules.
+	pairs := make(map[string]string)
+	for _, key := range invalid {
+		key = strings.ReplaceAll(key, "%00", "\x00")
+		pairs[key] = "x"
+	}
+	body, err := json.Marshal(map[string]interface{}{"pairs": pairs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := serve(http.HandlerFunc(h.handleBatchPut), http.MethodPost, "/db-batch", string(body))
+	var response struct {
+		Results map[string]batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	for key := range pairs {
+		if status := response.Results[key].Status; status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for batch key %.20q, got %d", key, status)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	h := createTestHandler(t)
+
+	serve(h, http.MethodPost, "/db/key", `{"value":"value"}`)
+
+	if rec := serve(h, http.MethodDelete, "/db/key", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from delete, got %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodGet, "/db/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after delete, got %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodDelete, "/db/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when deleting a missing key, got %d", rec.Code)
+	}
+}
+
+func TestPutStoreFull(t *testing.T) {
+	db, err := datastore.CreateDb(t.TempDir(), datastore.WithMaxKeys(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := &dbHandler{db: db}
+
+	if rec := serve(h, http.MethodPost, "/db/first", `{"value":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for the first key, got %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodPost, "/db/second", `{"value":2}`); rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 once the store is full, got %d", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	h.handleBatchPut(rec, httptest.NewRequest(http.MethodPost, "/db-batch", strings.NewReader(`{"pairs":{"second":2}}`)))
+	var response struct {
+		Results map[string]batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if status := response.Results["second"].Status; status != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 for a batch key, got %d", status)
+	}
+}
+
+func TestBatchPutAndGet(t *testing.T) {
+	h := createTestHandler(t)
+
+	rec := httptest.NewRecorder()
+	h.handleBatchPut(rec, httptest.NewRequest(http.MethodPost, "/db-batch",
+		strings.NewReader(`{"pairs":{"a":"one","b":2,"bad\u0000key":"x"}}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from batch put, got %d", rec.Code)
+	}
+
+	var putResponse struct {
+		Results map[string]batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&putResponse); err != nil {
+		t.Fatal(err)
+	}
+	if putResponse.Results["a"].Status != http.StatusOK || putResponse.Results["b"].Status != http.StatusOK {
+		t.Errorf("Expected valid keys to be stored, got %+v", putResponse.Results)
+	}
+	if putResponse.Results["bad\x00key"].Status != http.StatusBadRequest {
+		t.Errorf("Expected the invalid key to be rejected, got %+v", putResponse.Results)
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleBatchGet(rec, httptest.NewRequest(http.MethodPost, "/db-batch-get",
+		strings.NewReader(`{"keys":["a","b","missing"]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from batch get, got %d", rec.Code)
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.NewDecoder(rec.Body).Decode(&values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || string(values["a"]) != `"one"` || string(values["b"]) != `2` {
+		t.Errorf("Unexpected batch values %v", values)
+	}
+}
+
+func TestKeysListing(t *testing.T) {
+	h := createTestHandler(t)
+
+	for _, key := range []string{"user:2", "user:1", "order:1"} {
+		serve(h, http.MethodPost, "/db/"+key, `{"value":"x"}`)
+	}
+	// Keys within a bucket are not part of the listing.
+	if err := h.db.PutInBucket("user", "3", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"order:1", "user:1", "user:2"}},
+		{"?prefix=user:", []string{"user:1", "user:2"}},
+		{"?prefix=none", []string{}},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		h.handleKeys(rec, httptest.NewRequest(http.MethodGet, "/db-keys"+tc.query, nil))
+
+		var keys []string
+		if err := json.NewDecoder(rec.Body).Decode(&keys); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", tc.query, err)
+		}
+		if strings.Join(keys, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", tc.query, tc.expected, keys)
+		}
+	}
+}
+
+func TestStorageConfig(t *testing.T) {
+	t.Setenv(dataDirEnv, "")
+	t.Setenv(segmentSizeEnv, "")
+
+	dir, size, err := storageConfig()
+	if err != nil || dir != defaultDataDir || size != defaultSegmentSize {
+		t.Errorf("Expected defaults, got %q, %d, %v", dir, size, err)
+	}
+
+	t.Setenv(dataDirEnv, "/tmp/env-dir")
+	t.Setenv(segmentSizeEnv, "4096")
+	dir, size, err = storageConfig()
+	if err != nil || dir != "/tmp/env-dir" || size != 4096 {
+		t.Errorf("Expected environment values, got %q, %d, %v", dir, size, err)
+	}
+
+	*dataDir, *segmentSize = "/tmp/flag-dir", 8192
+	defer func() { *dataDir, *segmentSize = "", 0 }()
+	dir, size, err = storageConfig()
+	if err != nil || dir != "/tmp/flag-dir" || size != 8192 {
+		t.Errorf("Expected flags to override the environment, got %q, %d, %v", dir, size, err)
+	}
+
+	*segmentSize = 0
+	t.Setenv(segmentSizeEnv, "ten")
+	if _, _, err := storageConfig(); err == nil {
+		t.Error("Expected error for an invalid segment size")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkWritable(dir + "/nested"); err != nil {
+		t.Errorf("Expected a new directory to be writable: %v", err)
+	}
+
+	file := dir + "/file"
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritable(file); err == nil {
+		t.Error("Expected error for a path that is not a directory")
+	}
+}
+
+func TestReady(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.CreateDb(dir, datastore.WithMaxSegmentSize(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := &dbHandler{db: db}
+
+	if rec := serve(http.HandlerFunc(h.handleReady), http.MethodGet, "/ready", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for an open datastore, got %d", rec.Code)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(http.HandlerFunc(h.handleReady), http.MethodGet, "/ready", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the data directory is gone, got %d", rec.Code)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	db, err := datastore.CreateDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &dbHandler{db: db}
+
+	if rec := serve(http.HandlerFunc(h.handleHealth), http.MethodGet, "/health", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for an open datastore, got %d", rec.Code)
+	}
+	db.Close()
+	if rec := serve(http.HandlerFunc(h.handleHealth), http.MethodGet, "/health", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the datastore is closed, got %d", rec.Code)
+	}
+}
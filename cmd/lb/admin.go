@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	drainingMutex   sync.RWMutex
+	drainingServers = make(map[string]bool)
+)
+
+// setDraining marks a server as draining: it gets no new requests while the
+// requests already forwarded to it complete. Draining is independent of
+// health checks, so a draining server stays out of rotation until undrained.
+func setDraining(server string, draining bool) {
+	drainingMutex.Lock()
+	defer drainingMutex.Unlock()
+
+	if draining {
+		drainingServers[server] = true
+	} else {
+		delete(drainingServers, server)
+	}
+}
+
+func isDraining(server string) bool {
+	drainingMutex.RLock()
+	defer drainingMutex.RUnlock()
+	return drainingServers[server]
+}
+
+type serverStatus struct {
+	Server      string `json:"server"`
+	Healthy     bool   `json:"healthy"`
+	Degraded    bool   `json:"degraded"`
+	Draining    bool   `json:"draining"`
+	CircuitOpen bool   `json:"circuitOpen"`
+	InFlight    int64  `json:"inFlight"`
+}
+
+func getServerStatus(server string) serverStatus {
+	healthy := false
+	healthyServersMutex.RLock()
+	for _, s := range healthyServers {
+		if s == server {
+			healthy = true
+			break
+		}
+	}
+	healthyServersMutex.RUnlock()
+
+	return serverStatus{
+		Server:      server,
+		Healthy:     healthy,
+		Degraded:    isDegraded(server),
+		Draining:    isDraining(server),
+		CircuitOpen: breakers.isOpen(server),
+		InFlight:    activeConnections.get(server),
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(value)
+}
+
+// handleDrain serves /admin/drain: POST starts draining the server given in
+// the server query parameter, DELETE puts it back into rotation and GET
+// reports its state, including the number of in-flight requests, so an
+// operator can wait for it to reach zero before shutting the server down.
+func handleDrain(rw http.ResponseWriter, r *http.Request) {
+	server := r.URL.Query().Get("server")
+	if server == "" && r.Method == http.MethodGet {
+		var statuses []serverStatus
+		for _, s := range getServersPool() {
+			statuses = append(statuses, getServerStatus(s))
+		}
+		writeJSON(rw, http.StatusOK, statuses)
+		return
+	}
+	if !inServersPool(server) {
+		http.Error(rw, "unknown server", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		setDraining(server, true)
+	case http.MethodDelete:
+		setDraining(server, false)
+	case http.MethodGet:
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, http.StatusOK, getServerStatus(server))
+}
+
+// handleServers serves /admin/servers: GET lists the pool, POST adds the
+// server given in the addr query parameter (with an optional weight) and
+// DELETE removes it. Every change triggers an immediate health check.
+func handleServers(rw http.ResponseWriter, r *http.Request) {
+	server := r.URL.Query().Get("addr")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		weight := 1
+		if weightSpec := r.URL.Query().Get("weight"); weightSpec != "" {
+			var err error
+			if weight, err = strconv.Atoi(weightSpec); err != nil {
+				http.Error(rw, "invalid weight", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := addServer(server, weight); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("added server", "server", server, "weight", weight)
+		updateHealthyServers()
+	case http.MethodDelete:
+		if !removeServer(server) {
+			http.Error(rw, "unknown server", http.StatusNotFound)
+			return
+		}
+		setDraining(server, false)
+		slog.Info("removed server", "server", server)
+		updateHealthyServers()
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var statuses []serverStatus
+	for _, s := range getServersPool() {
+		statuses = append(statuses, getServerStatus(s))
+	}
+	writeJSON(rw, http.StatusOK, statuses)
+}
+
+type probeResult struct {
+	CheckedAt time.Time      `json:"checkedAt"`
+	Servers   []serverStatus `json:"servers"`
+}
+
+// handleProbe serves /admin/probe: POST health checks every server at once
+// instead of at the next interval, e.g. to put a just restarted backend back
+// into rotation, and reports the new results. GET reports the cached results
+// and when they were taken.
+func handleProbe(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		updateHealthyServers()
+		slog.Info("forced a health check of all servers")
+	case http.MethodGet:
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := probeResult{CheckedAt: healthCheckedAt()}
+	for _, s := range getServersPool() {
+		result.Servers = append(result.Servers, getServerStatus(s))
+	}
+	writeJSON(rw, http.StatusOK, result)
+}
+
+// requireAdminToken rejects requests that do not carry the token as a bearer
+// token in the Authorization header. An empty token lets every request
+// through, which is only safe while the admin API listens on loopback.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// isLoopbackHost reports whether host only accepts local connections.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/drain", handleDrain)
+	mux.HandleFunc("/admin/servers", handleServers)
+	mux.HandleFunc("/admin/probe", handleProbe)
+	return mux
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDrainServer(t *testing.T) {
+	setHealthyServers(t, "server1:8080", "server2:8080", "server3:8080")
+	defer setDraining("server2:8080", false)
+
+	handler := adminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/drain?server=server2:8080", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from drain, got %d", rec.Code)
+	}
+
+	var status serverStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Draining || !status.Healthy {
+		t.Errorf("Unexpected status after drain: %+v", status)
+	}
+
+	for i := 0; i < 20; i++ {
+		if server := strategy.Choose("client", applyWeights(getHealthyServers())); server == "server2:8080" {
+			t.Fatal("Draining server should not be chosen for new requests")
+		}
+	}
+
+	updateHealthyServersTo(t, "server1:8080", "server2:8080", "server3:8080")
+	for _, server := range getHealthyServers() {
+		if server == "server2:8080" {
+			t.Error("Drain state should survive health updates")
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/drain?server=server2:8080", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from undrain, got %d", rec.Code)
+	}
+	if len(getHealthyServers()) != 3 {
+		t.Errorf("Expected undrained server back in rotation, got %v", getHealthyServers())
+	}
+}
+
+func TestDrainUnknownServer(t *testing.T) {
+	rec := httptest.NewRecorder()
+	adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/drain?server=unknown:1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown server, got %d", rec.Code)
+	}
+}
+
+func updateHealthyServersTo(t *testing.T, servers ...string) {
+	t.Helper()
+	healthyServersMutex.Lock()
+	healthyServers = servers
+	healthyServersMutex.Unlock()
+}
+
+func TestAddAndRemoveServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	server := strings.TrimPrefix(backend.URL, "http://")
+
+	setHealthyServers(t)
+	serversPoolMutex.RLock()
+	previousPool, previousWeights := serversPool, serverWeights
+	serversPoolMutex.RUnlock()
+	t.Cleanup(func() { setServersPool(previousPool, previousWeights) })
+	setServersPool([]string{"server1:8080"}, nil)
+
+	handler := adminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/servers?addr="+server+"&weight=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from add, got %d: %s", rec.Code, rec.Body)
+	}
+	if pool := getServersPool(); len(pool) != 2 || pool[1] != server {
+		t.Fatalf("Expected %s appended to the pool, got %v", server, pool)
+	}
+	if serverWeight(server) != 2 {
+		t.Errorf("Expected weight 2, got %d", serverWeight(server))
+	}
+	if healthy := getHealthyServers(); len(healthy) != 1 || healthy[0] != server {
+		t.Errorf("Expected added server to be health checked at once, got %v", healthy)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/servers?addr="+server, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for duplicate server, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/servers?addr="+server, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from remove, got %d", rec.Code)
+	}
+	if pool := getServersPool(); len(pool) != 1 || pool[0] != "server1:8080" {
+		t.Errorf("Expected server removed from the pool, got %v", pool)
+	}
+	if healthy := getHealthyServers(); len(healthy) != 0 {
+		t.Errorf("Expected removed server out of rotation, got %v", healthy)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/servers?addr="+server, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown server, got %d", rec.Code)
+	}
+}
+
+func TestAddServerRejectsInvalidInput(t *testing.T) {
+	for _, query := range []string{"addr=", "addr=nohost", "addr=host:1&weight=0", "addr=host:1&weight=x"} {
+		rec := httptest.NewRecorder()
+		adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/servers?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, rec.Code)
+		}
+	}
+	if inServersPool("host:1") {
+		t.Error("Invalid server should not be added")
+	}
+}
+
+func TestProbeServers(t *testing.T) {
+	var up atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	server := strings.TrimPrefix(backend.URL, "http://")
+
+	setHealthyServers(t)
+	serversPoolMutex.RLock()
+	previousPool, previousWeights := serversPool, serverWeights
+	serversPoolMutex.RUnlock()
+	t.Cleanup(func() { setServersPool(previousPool, previousWeights) })
+	setServersPool([]string{server}, nil)
+
+	updateHealthyServers()
+	if len(getHealthyServers()) != 0 {
+		t.Fatal("Expected the backend to start out unhealthy")
+	}
+
+	// The cached results stand until the next probe.
+	up.Store(true)
+	if len(getHealthyServers()) != 0 {
+		t.Fatal("Expected the cached results without a probe")
+	}
+
+	handler := adminHandler()
+	before := healthCheckedAt()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/probe", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from probe, got %d", rec.Code)
+	}
+	var result probeResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Servers) != 1 || !result.Servers[0].Healthy || !result.CheckedAt.After(before) {
+		t.Errorf("Expected a fresh probe to find the backend healthy, got %+v", result)
+	}
+	if healthy := getHealthyServers(); len(healthy) != 1 || healthy[0] != server {
+		t.Errorf("Expected the backend back in rotation, got %v", healthy)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/probe", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
+
+func TestAdminTokenRequired(t *testing.T) {
+	handler := requireAdminToken("secret", adminHandler())
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/servers?addr=attacker:80", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", auth, rec.Code)
+		}
+	}
+	if inServersPool("attacker:80") {
+		t.Fatal("Unauthorized request should not change the pool")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/servers", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with the token, got %d", rec.Code)
+	}
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	for host, expected := range map[string]bool{
+		"127.0.0.1": true,
+		"::1":       true,
+		"localhost": true,
+		"":          false,
+		"0.0.0.0":   false,
+		"10.0.0.5":  false,
+	} {
+		if got := isLoopbackHost(host); got != expected {
+			t.Errorf("isLoopbackHost(%q) = %t, expected %t", host, got, expected)
+		}
+	}
+}
+
+func TestAdminLogsAreLeveled(t *testing.T) {
+	serversPoolMutex.RLock()
+	previousPool, previousWeights := serversPool, serverWeights
+	serversPoolMutex.RUnlock()
+	t.Cleanup(func() { setServersPool(previousPool, previousWeights) })
+	setServersPool(nil, nil)
+	setHealthyServers(t)
+
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	for level, expectLine := range map[slog.Level]bool{slog.LevelWarn: false, slog.LevelInfo: true} {
+		var logs bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: level})))
+
+		rec := httptest.NewRecorder()
+		adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/probe", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 from probe, got %d", rec.Code)
+		}
+		if logged := strings.Contains(logs.String(), `msg="forced a health check of all servers"`); logged != expectLine {
+			t.Errorf("At level %s expected the probe logged: %t, got %q", level, expectLine, logs.String())
+		}
+	}
+}
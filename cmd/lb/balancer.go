@@ -1,77 +1,446 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/bndrchuk-artem/trenbolonchiki-lab5/httptools"
+	"github.com/bndrchuk-artem/trenbolonchiki-lab5/logging"
 	"github.com/bndrchuk-artem/trenbolonchiki-lab5/signal"
 )
 
 var (
-	port       = flag.Int("port", 8090, "load balancer port")
-	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
-	https      = flag.Bool("https", false, "whether backends support HTTPs")
+	port         = flag.Int("port", 8090, "load balancer port")
+	adminPort    = flag.Int("admin-port", 8091, "admin API port")
+	adminHost    = flag.String("admin-host", "127.0.0.1", "interface the admin API listens on (empty for all; other than loopback requires -admin-token)")
+	adminToken   = flag.String("admin-token", "", "bearer token the admin API requires (overrides "+adminTokenEnv+")")
+	timeoutSec   = flag.Int("timeout-sec", 3, "request timeout time in seconds")
+	https        = flag.Bool("https", false, "whether backends support HTTPs")
+	healthHTTPS  = flag.Bool("health-https", false, "whether health endpoints of backends use HTTPS (defaults to -https)")
+	skipVerify   = flag.Bool("tls-skip-verify", false, "whether to accept any TLS certificate of backends, e.g. self-signed ones")
+	strategyName = flag.String("strategy", strategyHash, "balancing strategy: "+strategyHash+", "+strategyConsistentHash+", "+strategyRoundRobin+", "+strategyLeastConnections+" or "+strategyLeastTime)
+	virtualNodes = flag.Int("virtual-nodes", 100, "points per server on the "+strategyConsistentHash+" ring")
+	servers      = flag.String("servers", "", "comma-separated list of backend host:port[=weight] addresses (overrides "+serversEnv+")")
+
+	maxRetries  = flag.Int("max-retries", 2, "how many other servers to try when a backend fails; requests other than GET, HEAD and OPTIONS without an Idempotency-Key header are only retried if they could not be sent")
+	maxInflight = flag.Int("max-inflight", 0, "maximum concurrent requests per backend; busier backends are skipped (0 means unlimited)")
+
+	breakerThreshold   = flag.Int("breaker-threshold", 5, "consecutive failures after which a server is taken out of rotation (0 disables the circuit breaker)")
+	breakerCooldownSec = flag.Int("breaker-cooldown-sec", 30, "how long a server stays out of rotation before a probe request is sent to it")
+
+	degradedLatencyMs = flag.Int("health-degraded-ms", 1000, "health check latency above which a server counts as degraded and gets requests only when no healthy server can take them (0 disables)")
+
+	simulateClients = flag.Int("simulate-clients", 0, "print how -strategy would distribute this many made-up clients among the servers pool and exit, without serving requests")
+
+	backendHeaders = flag.Bool("backend-headers", false, "whether to tell clients the backend and strategy that served them in lb-from and lb-strategy headers, even without -trace (leave off in production)")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	shutdownSec  = flag.Int("shutdown-grace-sec", 10, "how long in-flight requests may take to finish on shutdown")
+	logLevel     = flag.String("log-level", "info", "minimum level of log entries: debug, info, warn or error")
+)
+
+const (
+	serversEnv       = "LB_SERVERS"
+	adminTokenEnv    = "LB_ADMIN_TOKEN"
+	maxRetryBodySize = 1 << 20
+	// healthCheckInterval is also the delay clients are asked to wait when
+	// no server is available, since the next health check may bring one
+	// back.
+	healthCheckInterval = 10 * time.Second
+	// latencySmoothing is the weight of the newest response time in the
+	// averages of the least-time strategy.
+	latencySmoothing = 0.3
+	// latencyHalfLife is how long it takes a response time average of the
+	// least-time strategy to halve without new responses.
+	latencyHalfLife = 30 * time.Second
 )
 
 var (
-	timeout     = time.Duration(*timeoutSec) * time.Second
-	serversPool = []string{
+	errRetriableStatus = errors.New("backend responded with a server error")
+	errRelayedStatus   = errors.New("relayed a server error of the backend")
+)
+
+// backendClient is shared by all requests to backends, so that keep-alive
+// connections are pooled per backend instead of being set up per request.
+// Compression is left to the backends so that responses pass through as is.
+var backendClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  true,
+	},
+}
+
+var (
+	defaultServersPool = []string{
 		"server1:8080",
 		"server2:8080",
 		"server3:8080",
 	}
+	serversPoolMutex    sync.RWMutex
+	serversPool         = defaultServersPool
+	serverWeights       map[string]int
 	healthyServersMutex sync.RWMutex
 	healthyServers      []string
+	degradedServers     map[string]bool
+	lastHealthCheck     time.Time
+	healthCheckMutex    sync.Mutex
+	strategy            Strategy = hashStrategy{}
+	activeConnections            = newConnectionCounter()
+	responseTimes                = newLatencyTracker(latencySmoothing, latencyHalfLife)
 )
 
+// parseServers parses a comma-separated list of host:port addresses, each
+// optionally followed by =weight. Servers without a weight get weight 1.
+func parseServers(spec string) ([]string, map[string]int, error) {
+	var result []string
+	weights := make(map[string]int)
+	for _, server := range strings.Split(spec, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+
+		weight := 1
+		if address, weightSpec, found := strings.Cut(server, "="); found {
+			var err error
+			weight, err = strconv.Atoi(weightSpec)
+			if err != nil || weight < 1 {
+				return nil, nil, fmt.Errorf("invalid weight %q for server %s", weightSpec, address)
+			}
+			server = address
+		}
+
+		if err := validateServerAddress(server); err != nil {
+			return nil, nil, err
+		}
+		if _, duplicate := weights[server]; duplicate {
+			return nil, nil, fmt.Errorf("server %s is listed more than once", server)
+		}
+		result = append(result, server)
+		weights[server] = weight
+	}
+	if len(result) == 0 {
+		return nil, nil, fmt.Errorf("no servers in %q", spec)
+	}
+	return result, weights, nil
+}
+
+func validateServerAddress(server string) error {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return fmt.Errorf("invalid server address %q: %w", server, err)
+	}
+	if host == "" || port == "" {
+		return fmt.Errorf("invalid server address %q: host and port are required", server)
+	}
+	return nil
+}
+
+// configureServersPool sets serversPool from the -servers flag, falling back
+// to the LB_SERVERS environment variable and then to the default pool.
+func configureServersPool() error {
+	spec := *servers
+	if spec == "" {
+		spec = os.Getenv(serversEnv)
+	}
+	if spec == "" {
+		setServersPool(defaultServersPool, nil)
+		return nil
+	}
+
+	pool, weights, err := parseServers(spec)
+	if err != nil {
+		return err
+	}
+	setServersPool(pool, weights)
+	return nil
+}
+
+func setServersPool(pool []string, weights map[string]int) {
+	serversPoolMutex.Lock()
+	defer serversPoolMutex.Unlock()
+	serversPool = pool
+	serverWeights = weights
+}
+
+func getServersPool() []string {
+	serversPoolMutex.RLock()
+	defer serversPoolMutex.RUnlock()
+
+	result := make([]string, len(serversPool))
+	copy(result, serversPool)
+	return result
+}
+
+func inServersPool(server string) bool {
+	serversPoolMutex.RLock()
+	defer serversPoolMutex.RUnlock()
+
+	for _, s := range serversPool {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+// addServer appends a server to the pool at runtime. Existing servers keep
+// their positions, so only the new server changes the selection order.
+func addServer(server string, weight int) error {
+	if err := validateServerAddress(server); err != nil {
+		return err
+	}
+	if weight < 1 {
+		return fmt.Errorf("invalid weight %d for server %s", weight, server)
+	}
+
+	serversPoolMutex.Lock()
+	defer serversPoolMutex.Unlock()
+
+	for _, s := range serversPool {
+		if s == server {
+			return fmt.Errorf("server %s is already in the pool", server)
+		}
+	}
+	pool := make([]string, len(serversPool), len(serversPool)+1)
+	copy(pool, serversPool)
+	serversPool = append(pool, server)
+
+	weights := make(map[string]int, len(serverWeights)+1)
+	for s, w := range serverWeights {
+		weights[s] = w
+	}
+	weights[server] = weight
+	serverWeights = weights
+	return nil
+}
+
+// removeServer drops a server from the pool and from the healthy servers at
+// once, so no new request is sent to it. It reports whether the server was in
+// the pool.
+func removeServer(server string) bool {
+	serversPoolMutex.Lock()
+	var pool []string
+	for _, s := range serversPool {
+		if s != server {
+			pool = append(pool, s)
+		}
+	}
+	removed := len(pool) != len(serversPool)
+	serversPool = pool
+	serversPoolMutex.Unlock()
+
+	if removed {
+		healthyServersMutex.Lock()
+		healthyServers = excludeServers(healthyServers, map[string]bool{server: true})
+		delete(degradedServers, server)
+		healthyServersMutex.Unlock()
+	}
+	return removed
+}
+
+func serverWeight(server string) int {
+	serversPoolMutex.RLock()
+	defer serversPoolMutex.RUnlock()
+
+	if weight, ok := serverWeights[server]; ok {
+		return weight
+	}
+	return 1
+}
+
+// applyWeights repeats every server as many times as its weight, so that
+// strategies choosing uniformly among the result send each server a share of
+// requests proportional to its weight.
+func applyWeights(servers []string) []string {
+	var result []string
+	for _, server := range servers {
+		for i := 0; i < serverWeight(server); i++ {
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
 func hash(s string) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(s))
 	return h.Sum32()
 }
 
-func chooseServer(clientAddr string, servers []string) string {
-	if len(servers) == 0 {
-		return ""
+// chooseServer picks a server by rendezvous hashing: every server gets a score
+// from the key and its own address and the highest score wins. When a server
+// leaves the pool only the keys it won move elsewhere. A server listed several
+// times, as applyWeights does for weights, scores once per entry and so wins
+// proportionally more keys.
+func chooseServer(key string, servers []string) string {
+	var best string
+	var bestScore uint32
+	entries := make(map[string]int, len(servers))
+	for _, server := range servers {
+		score := rendezvousScore(key, server, entries[server])
+		entries[server]++
+		if best == "" || score > bestScore || (score == bestScore && server < best) {
+			best, bestScore = server, score
+		}
 	}
+	return best
+}
+
+func rendezvousScore(key, server string, entry int) uint32 {
+	return mixedHash(key + "\x00" + server + "\x00" + strconv.Itoa(entry))
+}
 
-	serverIndex := int(hash(clientAddr)) % len(servers)
-	return servers[serverIndex]
+// mixedHash is hash finalized like MurmurHash3. FNV barely mixes its last
+// bytes, which would leave similar server addresses close together.
+func mixedHash(s string) uint32 {
+	h := hash(s)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
 }
 
+// getHealthyServers returns the healthy servers that are not draining. It
+// reads the results of the last health check, so requests never wait for a
+// probe; runHealthChecks refreshes them every healthCheckInterval and
+// /admin/probe on demand.
 func getHealthyServers() []string {
 	healthyServersMutex.RLock()
 	defer healthyServersMutex.RUnlock()
 
-	result := make([]string, len(healthyServers))
-	copy(result, healthyServers)
+	result := make([]string, 0, len(healthyServers))
+	for _, server := range healthyServers {
+		if !isDraining(server) {
+			result = append(result, server)
+		}
+	}
 	return result
 }
 
+// isDegraded reports whether the server is among the healthy servers whose
+// last health check took longer than -health-degraded-ms.
+func isDegraded(server string) bool {
+	healthyServersMutex.RLock()
+	defer healthyServersMutex.RUnlock()
+	return degradedServers[server]
+}
+
+// preferHealthy leaves out degraded servers unless all servers are degraded,
+// so that degraded servers only get requests nobody else can take.
+func preferHealthy(servers []string) []string {
+	healthyServersMutex.RLock()
+	defer healthyServersMutex.RUnlock()
+
+	var result []string
+	for _, server := range servers {
+		if !degradedServers[server] {
+			result = append(result, server)
+		}
+	}
+	if len(result) == 0 {
+		return servers
+	}
+	return result
+}
+
+// healthCheckTargets returns the servers pool followed by the servers only
+// routes refer to.
+func healthCheckTargets() []string {
+	targets := getServersPool()
+	inPool := make(map[string]bool, len(targets))
+	for _, server := range targets {
+		inPool[server] = true
+	}
+	routed := routedServers()
+	extra := make([]string, 0, len(routed))
+	for server := range routed {
+		if !inPool[server] {
+			extra = append(extra, server)
+		}
+	}
+	sort.Strings(extra)
+	return append(targets, extra...)
+}
+
+// healthCheckedAt returns when the results getHealthyServers serves were
+// taken, or the zero time before the first health check.
+func healthCheckedAt() time.Time {
+	healthyServersMutex.RLock()
+	defer healthyServersMutex.RUnlock()
+	return lastHealthCheck
+}
+
+// updateHealthyServers probes every server and replaces the cached health
+// results. Updates run one at a time, so a forced probe and the periodic one
+// cannot overwrite newer results with older ones.
 func updateHealthyServers() {
+	healthCheckMutex.Lock()
+	defer healthCheckMutex.Unlock()
+
 	var healthy []string
+	degraded := make(map[string]bool)
 
-	for _, server := range serversPool {
-		if health(server) {
+	for _, server := range healthCheckTargets() {
+		state := health(server)
+		level := slog.LevelDebug
+		if state != healthHealthy {
+			level = slog.LevelWarn
+		}
+		slog.Log(context.Background(), level, "health check", "server", server, "state", state.String())
+		if state != healthDown {
 			healthy = append(healthy, server)
 		}
+		if state == healthDegraded {
+			degraded[server] = true
+		}
 	}
 
 	healthyServersMutex.Lock()
-	healthyServers = healthy
+	// Servers removed from the pool while being probed must not come back.
+	healthyServers = healthy[:0:0]
+	routed := routedServers()
+	for _, server := range healthy {
+		if inServersPool(server) || routed[server] {
+			healthyServers = append(healthyServers, server)
+		}
+	}
+	degradedServers = degraded
+	lastHealthCheck = time.Now()
 	healthyServersMutex.Unlock()
 }
 
+// requestTimeout reads the flag on every call: package variables are
+// initialized before flag.Parse, so a value computed there ignores the flag.
+func requestTimeout() time.Duration {
+	return time.Duration(*timeoutSec) * time.Second
+}
+
 func scheme() string {
 	if *https {
 		return "https"
@@ -79,93 +448,460 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+func healthScheme() string {
+	if *healthHTTPS {
+		return "https"
+	}
+	return "http"
+}
+
+// defaultHealthHTTPS makes health checks follow -https unless -health-https
+// was given explicitly.
+func defaultHealthHTTPS() {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "health-https"
+	})
+	if !set {
+		*healthHTTPS = *https
+	}
+}
+
+// configureTLS sets whether backend certificates are verified, for requests
+// and health checks alike.
+func configureTLS(skipVerify bool) {
+	transport := backendClient.Transport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: skipVerify}
+}
+
+// healthState is the outcome of a health check. A degraded server is up but
+// answered its health check slowly, so it is only used when no healthy server
+// is left.
+type healthState int
+
+const (
+	healthDown healthState = iota
+	healthDegraded
+	healthHealthy
+)
+
+func (s healthState) String() string {
+	switch s {
+	case healthHealthy:
+		return "healthy"
+	case healthDegraded:
+		return "degraded"
+	default:
+		return "down"
+	}
+}
+
+// degradedLatency reads the flag on every call, like requestTimeout.
+func degradedLatency() time.Duration {
+	return time.Duration(*degradedLatencyMs) * time.Millisecond
+}
+
+// health checks dst and rates it by the status and latency of its /health
+// endpoint. The latency includes reading the body.
+func health(dst string) healthState {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout())
+	defer cancel()
 	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
+		fmt.Sprintf("%s://%s/health", healthScheme(), dst), nil)
+	start := time.Now()
+	resp, err := backendClient.Do(req)
 	if err != nil {
-		return false
+		return healthDown
 	}
+	// Drain the body so the connection goes back to the pool.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
 	if resp.StatusCode != http.StatusOK {
-		return false
+		return healthDown
 	}
-	return true
+	if threshold := degradedLatency(); threshold > 0 && latency > threshold {
+		return healthDegraded
+	}
+	return healthHealthy
+}
+
+// hopHeaders only apply to a single connection, so a proxy must not pass them
+// on. See RFC 9110, section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
 }
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
+// removeHopHeaders deletes the hop-by-hop headers from header, including those
+// the Connection header names.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// retryMode tells forward which failures the caller retries on another server.
+type retryMode int
+
+const (
+	noRetry retryMode = iota
+	// retryUnsent retries only when the connection to the server could not
+	// be set up, so the request was never sent. It is used for requests that
+	// must not reach a backend twice, since a server that failed later may
+	// already have applied them.
+	retryUnsent
+	// retryFailed retries on connection errors and 5xx responses.
+	retryFailed
+)
+
+// retries reports whether a request that failed with err is retried.
+func (m retryMode) retries(err error) bool {
+	switch m {
+	case retryFailed:
+		return true
+	case retryUnsent:
+		return isDialError(err)
+	}
+	return false
+}
+
+// isDialError reports whether err happened while connecting to a server.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// idempotentMethods may be sent to several servers in turn, since repeating
+// them does not change the result.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// idempotencyKeyHeader marks a request the backends deduplicate, so that it
+// may be retried whatever its method.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// requestRetryMode returns how the request may be retried once its attempts
+// are not used up.
+func requestRetryMode(r *http.Request) retryMode {
+	if idempotentMethods[r.Method] || r.Header.Get(idempotencyKeyHeader) != "" {
+		return retryFailed
+	}
+	return retryUnsent
+}
+
+// forward sends the request to dst and copies the response to rw. A failure
+// that mode retries writes nothing to rw so that the caller can retry on
+// another server: connection errors are returned as is and 5xx responses as
+// errRetriableStatus. Otherwise a 5xx response is copied to rw and
+// errRelayedStatus returned, so that it still counts as a failure of dst. The
+// body is read through GetBody when the caller has buffered it for retries,
+// otherwise the original body is streamed to the backend once.
+func forward(dst string, rw http.ResponseWriter, r *http.Request, mode retryMode) error {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
 	fwdRequest := r.Clone(ctx)
 	fwdRequest.RequestURI = ""
 	fwdRequest.URL.Host = dst
 	fwdRequest.URL.Scheme = scheme()
 	fwdRequest.Host = dst
+	removeHopHeaders(fwdRequest.Header)
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return err
+		}
+		fwdRequest.Body = body
+	}
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
+	// The latency covers the backend until the response headers arrive, not
+	// the copying of the body to the client.
+	start := time.Now()
+	resp, err := backendClient.Do(fwdRequest)
+	latency := time.Since(start)
+	id := r.Header.Get(httptools.RequestIDHeader)
 	if err == nil {
-		for k, values := range resp.Header {
+		// Failed connections return quickly and must not make a server look
+		// fast, so only responses are measured.
+		responseTimes.observe(dst, latency)
+		defer resp.Body.Close()
+		if mode == retryFailed && resp.StatusCode >= http.StatusInternalServerError {
+			slog.Warn("backend server error", "server", dst, "status", resp.StatusCode, "latency", latency, "request_id", id)
+			return errRetriableStatus
+		}
+		responseHeader := resp.Header.Clone()
+		removeHopHeaders(responseHeader)
+		for k, values := range responseHeader {
 			for _, value := range values {
 				rw.Header().Add(k, value)
 			}
 		}
-		if *traceEnabled {
+		if *traceEnabled || *backendHeaders {
 			rw.Header().Set("lb-from", dst)
+			rw.Header().Set("lb-strategy", *strategyName)
+		}
+		if *traceEnabled {
+			rw.Header().Set("lb-latency", latency.String())
+			// Replaces the ID if the backend echoed it as well.
+			rw.Header().Set(httptools.RequestIDHeader, id)
+		}
+		slog.Debug("forwarded", "server", dst, "status", resp.StatusCode, "url", resp.Request.URL.String(), "latency", latency, "request_id", id)
+		compressed := shouldCompress(r, resp)
+		if compressed {
+			writeGzipHeaders(rw.Header())
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
 		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
+		if compressed {
+			err = copyGzip(rw, resp.Body)
+		} else {
+			_, err = io.Copy(rw, resp.Body)
+		}
 		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+			slog.Warn("failed to write response", "server", dst, "error", err, "request_id", id)
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return errRelayedStatus
 		}
 		return nil
 	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
+		slog.Warn("backend request failed", "server", dst, "error", err, "latency", latency, "request_id", id)
+		if !mode.retries(err) {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
 		return err
 	}
 }
 
-func main() {
-	flag.Parse()
+// bufferRequestBody reads the request body into memory and sets GetBody, so
+// the request can be sent more than once. It reports false, leaving the body
+// readable once, if the body is larger than maxRetryBodySize.
+func bufferRequestBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
 
-	updateHealthyServers()
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBodySize+1))
+	if err != nil || len(data) > maxRetryBodySize {
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+		return false
+	}
 
-	for _, server := range serversPool {
-		server := server
-		go func() {
-			for range time.Tick(10 * time.Second) {
-				isHealthy := health(server)
-				log.Println(server, "healthy:", isHealthy)
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true
+}
 
-				updateHealthyServers()
-			}
-		}()
+// writeUnavailable responds with 503, a Retry-After header and a JSON error.
+func writeUnavailable(rw http.ResponseWriter, message string) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(healthCheckInterval/time.Second)))
+	writeJSON(rw, http.StatusServiceUnavailable, map[string]string{"error": message})
+}
+
+func excludeServers(servers []string, excluded map[string]bool) []string {
+	var result []string
+	for _, server := range servers {
+		if !excluded[server] {
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+func handleRequest(rw http.ResponseWriter, r *http.Request) {
+	id := requestID(r)
+	if *traceEnabled {
+		rw.Header().Set(httptools.RequestIDHeader, id)
 	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		currentHealthyServers := getHealthyServers()
+	currentHealthyServers := serversForPath(r.URL.Path, getHealthyServers())
 
-		if len(currentHealthyServers) == 0 {
-			log.Println("No healthy servers available")
-			rw.WriteHeader(http.StatusServiceUnavailable)
+	if len(currentHealthyServers) == 0 {
+		slog.Error("no healthy servers available", "request_id", id)
+		writeUnavailable(rw, "no healthy servers available")
+		return
+	}
+
+	retries := *maxRetries
+	if retries > 0 && !bufferRequestBody(r) {
+		slog.Info("request body too large to retry", "client", r.RemoteAddr, "request_id", id)
+		retries = 0
+	}
+
+	key := routingKey(rw, r)
+	tried := make(map[string]bool)
+	for attempt := 0; ; attempt++ {
+		candidates := breakers.filter(excludeServers(currentHealthyServers, tried))
+		// Degraded servers stay candidates for retries, but are only chosen
+		// once no healthy server is left.
+		targetServer := strategy.Choose(key, applyWeights(preferHealthy(candidates)))
+
+		if targetServer == "" {
+			slog.Error("failed to choose target server", "client", r.RemoteAddr, "request_id", id)
+			writeUnavailable(rw, "no server available to take the request")
 			return
 		}
+		if !activeConnections.tryAcquire(targetServer, *maxInflight) {
+			// Skipping a busy server is not a failed attempt.
+			slog.Debug("server at capacity", "server", targetServer, "request_id", id)
+			tried[targetServer] = true
+			attempt--
+			continue
+		}
+		if !breakers.allow(targetServer) {
+			// Another request has just taken the probe slot of this server.
+			activeConnections.release(targetServer)
+			tried[targetServer] = true
+			attempt--
+			continue
+		}
 
-		targetServer := chooseServer(r.RemoteAddr, currentHealthyServers)
+		mode := noRetry
+		if attempt < retries && len(candidates) > 1 {
+			mode = requestRetryMode(r)
+		}
 
-		if targetServer == "" {
-			log.Println("Failed to choose target server")
-			rw.WriteHeader(http.StatusServiceUnavailable)
+		slog.Debug("forwarding request", "client", r.RemoteAddr, "server", targetServer, "request_id", id)
+		err := forward(targetServer, rw, r, mode)
+		activeConnections.release(targetServer)
+
+		switch {
+		case err == nil:
+			breakers.success(targetServer)
+		case r.Context().Err() != nil:
+			// Requests cancelled by the client say nothing about the server,
+			// but may hold its probe slot.
+			breakers.abandon(targetServer)
+		default:
+			breakers.failure(targetServer)
+			if breakers.isOpen(targetServer) {
+				slog.Warn("circuit opened", "server", targetServer)
+			}
+		}
+
+		if err == nil || !mode.retries(err) {
 			return
 		}
+		tried[targetServer] = true
+		slog.Info("retrying request", "client", r.RemoteAddr, "failed_server", targetServer, "request_id", id)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := logging.Setup(*logLevel); err != nil {
+		log.Fatal(err)
+	}
+	defaultHealthHTTPS()
+	configureTLS(*skipVerify)
+	if *skipVerify {
+		slog.Warn("TLS certificates of backends are not verified")
+	}
+
+	if err := configureServersPool(); err != nil {
+		logging.Fatal("invalid servers pool", "error", err)
+	}
+	slog.Info("servers pool", "servers", strings.Join(getServersPool(), ","))
+
+	var err error
+	if trustedProxies, err = parseTrustedProxies(*trustedProxiesSpec); err != nil {
+		logging.Fatal("invalid trusted proxies", "error", err)
+	}
+
+	table, err := parseRoutes(*routesSpec)
+	if err != nil {
+		logging.Fatal("invalid routes", "error", err)
+	}
+	setRoutes(table)
+	for _, r := range table {
+		slog.Info("route", "prefix", r.prefix, "servers", strings.Join(r.servers, ","))
+	}
+
+	if strategy, err = newStrategy(*strategyName); err != nil {
+		logging.Fatal("invalid strategy", "error", err)
+	}
+	slog.Info("balancing strategy", "strategy", *strategyName)
+	if *simulateClients > 0 {
+		pool := getServersPool()
+		distribution := SimulateDistribution(simulatedClients(*simulateClients), applyWeights(pool), strategy)
+		for _, server := range pool {
+			fmt.Printf("%s\t%d\n", server, distribution[server])
+		}
+		return
+	}
+	if *stickyCookie != "" {
+		slog.Info("sticky sessions by cookie", "cookie", *stickyCookie)
+	}
 
-		log.Printf("Forwarding request from %s to %s", r.RemoteAddr, targetServer)
-		forward(targetServer, rw, r)
-	}))
+	breakers = newCircuitBreaker(*breakerThreshold, time.Duration(*breakerCooldownSec)*time.Second)
 
-	log.Println("Starting load balancer...")
-	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	updateHealthyServers()
+
+	healthCtx, stopHealthChecks := context.WithCancel(context.Background())
+	healthDone := make(chan struct{})
+	go func() {
+		defer close(healthDone)
+		runHealthChecks(healthCtx, healthCheckInterval)
+	}()
+
+	frontend := httptools.CreateServer(*port, http.HandlerFunc(handleRequest))
+	token := *adminToken
+	if token == "" {
+		token = os.Getenv(adminTokenEnv)
+	}
+	if token == "" && !isLoopbackHost(*adminHost) {
+		logging.Fatal("the admin API needs a token outside of loopback: set -admin-token or "+adminTokenEnv, "host", *adminHost)
+	}
+	admin := httptools.CreateServerOn(*adminHost, *adminPort, requireAdminToken(token, adminHandler()))
+
+	slog.Info("starting load balancer", "port", *port, "admin_host", *adminHost, "admin_port", *adminPort, "trace", *traceEnabled)
 	frontend.Start()
+	admin.Start()
 	signal.WaitForTerminationSignal()
+
+	stopHealthChecks()
+	<-healthDone
+
+	// Shutdown waits for the handlers, so active forwards get to finish.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownSec)*time.Second)
+	defer cancel()
+	if err := frontend.Stop(ctx); err != nil {
+		slog.Warn("in-flight requests did not finish in time", "error", err)
+	}
+	if err := admin.Stop(ctx); err != nil {
+		slog.Warn("admin API did not stop in time", "error", err)
+	}
+}
+
+// runHealthChecks updates the healthy servers every interval until ctx is
+// cancelled.
+func runHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			updateHealthyServers()
+		}
+	}
 }
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHash(t *testing.T) {
@@ -58,13 +68,7 @@ func TestChooseServer(t *testing.T) {
 
 func TestChooseServerDistribution(t *testing.T) {
 	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
-	distribution := make(map[string]int)
-
-	for i := 0; i < 300; i++ {
-		clientAddr := fmt.Sprintf("192.168.1.%d:%d", (i%254)+1, 10000+i)
-		server := chooseServer(clientAddr, servers)
-		distribution[server]++
-	}
+	distribution := SimulateDistribution(simulatedClients(300), servers, hashStrategy{})
 
 	for _, server := range servers {
 		if distribution[server] == 0 {
@@ -152,6 +156,42 @@ func TestChooseServerWithDifferentPoolSizes(t *testing.T) {
 }
 
 
+func TestChooseServerKeepsClientsWhenServerIsRemoved(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080", "server3:8080", "server4:8080", "server5:8080"}
+	reduced := []string{"server1:8080", "server2:8080", "server4:8080", "server5:8080"}
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		clientAddr := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		before := chooseServer(clientAddr, servers)
+		after := chooseServer(clientAddr, reduced)
+		if before != "server3:8080" && before != after {
+			t.Fatalf("Client %s moved from %s to %s although its server stayed", clientAddr, before, after)
+		}
+		if before != after {
+			moved++
+		}
+	}
+
+	if moved < 100 || moved > 300 {
+		t.Errorf("Expected about a fifth of the clients to move, %d of 1000 did", moved)
+	}
+}
+
+
+func TestChooseServerIgnoresPoolOrder(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
+	reversed := []string{"server3:8080", "server2:8080", "server1:8080"}
+
+	for i := 0; i < 100; i++ {
+		clientAddr := fmt.Sprintf("192.168.1.%d", i)
+		if a, b := chooseServer(clientAddr, servers), chooseServer(clientAddr, reversed); a != b {
+			t.Errorf("Client %s got %s and %s depending on the pool order", clientAddr, a, b)
+		}
+	}
+}
+
+
 func BenchmarkChooseServer(b *testing.B) {
 	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
 	clientAddr := "192.168.1.1:12345"
@@ -171,3 +211,623 @@ func BenchmarkHash(b *testing.B) {
 		hash(addr)
 	}
 }
+
+func TestParseServers(t *testing.T) {
+	pool, _, err := parseServers("server1:8080, server2:8081,,10.0.0.1:80")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"server1:8080", "server2:8081", "10.0.0.1:80"}
+	if len(pool) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, pool)
+	}
+	for i := range expected {
+		if pool[i] != expected[i] {
+			t.Errorf("Expected %s at position %d, got %s", expected[i], i, pool[i])
+		}
+	}
+
+	for _, spec := range []string{"", "server1", "server1:8080,:8080", "server1:", "server1:8080=0", "server1:8080=x", "server1:8080,server1:8080=2"} {
+		if _, _, err := parseServers(spec); err == nil {
+			t.Errorf("Expected error for servers spec %q", spec)
+		}
+	}
+}
+
+func TestConfigureServersPool(t *testing.T) {
+	defer func() {
+		*servers = ""
+		serversPool = defaultServersPool
+	}()
+
+	t.Setenv(serversEnv, "env1:8080,env2:8080")
+	if err := configureServersPool(); err != nil {
+		t.Fatal(err)
+	}
+	if len(serversPool) != 2 || serversPool[0] != "env1:8080" {
+		t.Errorf("Expected pool from %s, got %v", serversEnv, serversPool)
+	}
+
+	*servers = "flag1:8080"
+	if err := configureServersPool(); err != nil {
+		t.Fatal(err)
+	}
+	if len(serversPool) != 1 || serversPool[0] != "flag1:8080" {
+		t.Errorf("Expected flag to take precedence, got %v", serversPool)
+	}
+}
+
+func setHealthyServers(t *testing.T, servers ...string) {
+	t.Helper()
+	healthyServersMutex.Lock()
+	previous := healthyServers
+	healthyServers = servers
+	healthyServersMutex.Unlock()
+
+	t.Cleanup(func() {
+		healthyServersMutex.Lock()
+		healthyServers = previous
+		healthyServersMutex.Unlock()
+	})
+}
+
+func TestHandleRequestRetriesOnServerError(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(body)
+	}))
+	defer healthy.Close()
+
+	setHealthyServers(t, failing.Listener.Addr().String(), healthy.Listener.Addr().String())
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		for i := 0; i < 5; i++ {
+			req := httptest.NewRequest(method, "/api/v1/some-data", strings.NewReader("payload"))
+			req.RemoteAddr = fmt.Sprintf("192.168.1.%d:12345", i)
+			if method == http.MethodPost {
+				req.Header.Set(idempotencyKeyHeader, fmt.Sprintf("request-%d", i))
+			}
+			rec := httptest.NewRecorder()
+
+			handleRequest(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("%s from %s: expected 200 after retry, got %d", method, req.RemoteAddr, rec.Code)
+			}
+			if method == http.MethodPost && rec.Body.String() != "payload" {
+				t.Errorf("Expected request body to survive the retry, got %q", rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestHandleRequestDoesNotRetryWritesOnServerError(t *testing.T) {
+	var attempts atomic.Int64
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	setHealthyServers(t, failing.Listener.Addr().String(), healthy.Listener.Addr().String())
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		for i := 0; i < 5; i++ {
+			attempts.Store(0)
+			req := httptest.NewRequest(method, "/api/v1/some-data", strings.NewReader("payload"))
+			req.RemoteAddr = fmt.Sprintf("192.168.1.%d:12345", i)
+			rec := httptest.NewRecorder()
+
+			handleRequest(rec, req)
+
+			if n := attempts.Load(); n != 1 {
+				t.Errorf("%s from %s: expected the write to reach one backend once, got %d attempts", method, req.RemoteAddr, n)
+			}
+			if rec.Code != http.StatusOK && rec.Code != http.StatusInternalServerError {
+				t.Errorf("%s from %s: expected the backend's response, got %d", method, req.RemoteAddr, rec.Code)
+			}
+		}
+	}
+}
+
+func TestHandleRequestRetriesOnConnectionError(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachableAddr := unreachable.Listener.Addr().String()
+	unreachable.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	setHealthyServers(t, unreachableAddr, healthy.Listener.Addr().String())
+
+	// A server that cannot be connected to never got the request, so even
+	// writes are retried.
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		for i := 0; i < 5; i++ {
+			req := httptest.NewRequest(method, "/api/v1/some-data", nil)
+			req.RemoteAddr = fmt.Sprintf("192.168.1.%d:12345", i)
+			rec := httptest.NewRecorder()
+
+			handleRequest(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("%s: expected 200 after retry, got %d", method, rec.Code)
+			}
+		}
+	}
+}
+
+func TestHandleRequestWithoutRetries(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	setHealthyServers(t, failing.Listener.Addr().String())
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the backend error to be passed through, got %d", rec.Code)
+	}
+}
+
+func TestParseServersWithWeights(t *testing.T) {
+	pool, weights, err := parseServers("server1:8080=3,server2:8080")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(pool) != 2 || pool[0] != "server1:8080" || pool[1] != "server2:8080" {
+		t.Errorf("Unexpected pool %v", pool)
+	}
+	if weights["server1:8080"] != 3 || weights["server2:8080"] != 1 {
+		t.Errorf("Unexpected weights %v", weights)
+	}
+}
+
+func TestWeightedSelection(t *testing.T) {
+	previous := serverWeights
+	defer func() { serverWeights = previous }()
+	serverWeights = map[string]int{"server1:8080": 3, "server2:8080": 1}
+
+	servers := []string{"server1:8080", "server2:8080"}
+	strategies := map[string]Strategy{
+		strategyHash:       hashStrategy{},
+		strategyRoundRobin: &roundRobinStrategy{},
+	}
+
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			distribution := make(map[string]int)
+			for i := 0; i < 4000; i++ {
+				clientAddr := fmt.Sprintf("10.0.%d.%d:%d", i/250, i%250, 10000+i)
+				distribution[strategy.Choose(clientAddr, applyWeights(servers))]++
+			}
+
+			ratio := float64(distribution["server1:8080"]) / float64(distribution["server2:8080"])
+			if ratio < 2 || ratio > 4 {
+				t.Errorf("Expected ~3:1 split, got %v (ratio %.2f)", distribution, ratio)
+			}
+		})
+	}
+
+	if weighted := applyWeights([]string{"server2:8080"}); len(weighted) != 1 {
+		t.Errorf("Expected a downed server's weight to leave the rotation, got %v", weighted)
+	}
+}
+
+func BenchmarkForwardParallel(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"key":"trenbolonchiki","value":"2024-01-01"}`))
+	}))
+	defer backend.Close()
+	dst := backend.Listener.Addr().String()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec := httptest.NewRecorder()
+			forward(dst, rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil), noRetry)
+		}
+	})
+}
+
+func TestForwardRespectsTimeoutFlag(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+
+	previous := *timeoutSec
+	*timeoutSec = 1
+	defer func() { *timeoutSec = previous }()
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	err := forward(slow.Listener.Addr().String(), rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil), noRetry)
+	if err == nil {
+		t.Fatal("Expected forward to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the 1s timeout to apply, forward took %s", elapsed)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after timeout, got %d", rec.Code)
+	}
+}
+
+func TestHandleRequestForwardsPostBody(t *testing.T) {
+	payload := `{"value":"` + strings.Repeat("x", 64*1024) + `"}`
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("content-type") != "application/json" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(body)
+	}))
+	defer backend.Close()
+
+	setHealthyServers(t, backend.Listener.Addr().String())
+	frontend := httptest.NewServer(http.HandlerFunc(handleRequest))
+	defer frontend.Close()
+
+	previous := *maxRetries
+	defer func() { *maxRetries = previous }()
+
+	for _, retries := range []int{0, 2} {
+		*maxRetries = retries
+		for _, chunked := range []bool{false, true} {
+			var body io.Reader = strings.NewReader(payload)
+			if chunked {
+				// Hide the length so the request is sent chunked.
+				body = io.MultiReader(body)
+			}
+			resp, err := http.Post(frontend.URL+"/db/key", "application/json", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("retries=%d chunked=%t: expected 201, got %d", retries, chunked, resp.StatusCode)
+			}
+			if string(got) != payload {
+				t.Errorf("retries=%d chunked=%t: body of %d bytes did not survive forwarding, got %d bytes", retries, chunked, len(payload), len(got))
+			}
+		}
+	}
+}
+
+func TestForwardReportsLatencyWhenTracing(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	previous := *traceEnabled
+	*traceEnabled = true
+	defer func() { *traceEnabled = previous }()
+
+	rec := httptest.NewRecorder()
+	if err := forward(backend.Listener.Addr().String(), rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil), noRetry); err != nil {
+		t.Fatal(err)
+	}
+
+	latency, err := time.ParseDuration(rec.Header().Get("lb-latency"))
+	if err != nil {
+		t.Fatalf("Expected a duration in lb-latency, got %q", rec.Header().Get("lb-latency"))
+	}
+	if latency < 50*time.Millisecond {
+		t.Errorf("Expected at least the 50ms backend delay, got %s", latency)
+	}
+}
+
+func TestHealthOverHTTPSWithSelfSignedCertificate(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+
+	previous := *healthHTTPS
+	*healthHTTPS = true
+	defer func() {
+		*healthHTTPS = previous
+		configureTLS(false)
+	}()
+
+	if health(addr) != healthDown {
+		t.Error("Expected the self-signed certificate to be rejected by default")
+	}
+
+	configureTLS(true)
+	if health(addr) != healthHealthy {
+		t.Error("Expected the backend to be healthy with verification disabled")
+	}
+
+	*healthHTTPS = false
+	if health(addr) != healthDown {
+		t.Error("Expected a plain HTTP health check of an HTTPS backend to fail")
+	}
+}
+
+func TestHandleRequestSkipsServersAtCapacity(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan string, 2)
+	newBackend := func() *httptest.Server {
+		var backend *httptest.Server
+		backend = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			arrived <- backend.Listener.Addr().String()
+			<-release
+			rw.WriteHeader(http.StatusOK)
+		}))
+		return backend
+	}
+	first, second := newBackend(), newBackend()
+	defer first.Close()
+	defer second.Close()
+	setHealthyServers(t, first.Listener.Addr().String(), second.Listener.Addr().String())
+
+	previous := *maxInflight
+	*maxInflight = 1
+	defer func() { *maxInflight = previous }()
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rec := httptest.NewRecorder()
+			handleRequest(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+			codes <- rec.Code
+		}()
+		<-arrived
+	}
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with every server at capacity, got %d", rec.Code)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Expected both servers to take one request, got %d", code)
+		}
+	}
+}
+
+func TestHandleRequestWithoutHealthyServers(t *testing.T) {
+	setHealthyServers(t)
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", rec.Code)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("Expected Retry-After of the health check interval, got %q", retryAfter)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body["error"] == "" {
+		t.Errorf("Expected a JSON error body, got %q (%v)", rec.Body.String(), err)
+	}
+}
+
+func TestRunHealthChecksStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runHealthChecks(ctx, time.Hour)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Health checks kept running after cancel")
+	}
+}
+
+func TestHealthMarksSlowServersDegraded(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+
+	previous := *degradedLatencyMs
+	defer func() { *degradedLatencyMs = previous }()
+
+	*degradedLatencyMs = 20
+	if state := health(addr); state != healthDegraded {
+		t.Errorf("Expected a slow server to be degraded, got %s", state)
+	}
+	*degradedLatencyMs = 0
+	if state := health(addr); state != healthHealthy {
+		t.Errorf("Expected a slow server to be healthy with the threshold disabled, got %s", state)
+	}
+
+	*degradedLatencyMs = 20
+	setServersPool([]string{addr}, nil)
+	defer setServersPool(defaultServersPool, nil)
+	setHealthyServers(t)
+	updateHealthyServers()
+	if servers := getHealthyServers(); len(servers) != 1 || !isDegraded(addr) {
+		t.Errorf("Expected the degraded server to stay in rotation marked degraded, got %v", servers)
+	}
+}
+
+func TestHandleRequestPrefersHealthyServers(t *testing.T) {
+	var degradedHits, healthyHits atomic.Int32
+	var healthyFails atomic.Bool
+	degraded := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		degradedHits.Add(1)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer degraded.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		healthyHits.Add(1)
+		if healthyFails.Load() {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	degradedAddr := degraded.Listener.Addr().String()
+	setHealthyServers(t, degradedAddr, healthy.Listener.Addr().String())
+	healthyServersMutex.Lock()
+	degradedServers = map[string]bool{degradedAddr: true}
+	healthyServersMutex.Unlock()
+	defer func() {
+		healthyServersMutex.Lock()
+		degradedServers = nil
+		healthyServersMutex.Unlock()
+	}()
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil)
+		req.RemoteAddr = fmt.Sprintf("192.168.1.%d:12345", i)
+		handleRequest(httptest.NewRecorder(), req)
+	}
+	if degradedHits.Load() != 0 || healthyHits.Load() != 10 {
+		t.Errorf("Expected every request on the healthy server, got %d healthy and %d degraded", healthyHits.Load(), degradedHits.Load())
+	}
+
+	// Degraded servers still take retries once the healthy ones fail.
+	healthyFails.Store(true)
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+	if rec.Code != http.StatusOK || degradedHits.Load() != 1 {
+		t.Errorf("Expected a retry on the degraded server, got %d with %d degraded hits", rec.Code, degradedHits.Load())
+	}
+}
+
+func TestForwardRemovesHopByHopHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		rw.Header().Set("Connection", "X-Backend-Hop")
+		rw.Header().Set("X-Backend-Hop", "1")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("Proxy-Authenticate", "Basic")
+		rw.Header().Set("X-Kept", "1")
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil)
+	req.Header.Set("Connection", "X-Client-Hop, Upgrade")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("X-Forwarded-Kept", "1")
+	rec := httptest.NewRecorder()
+	if err := forward(backend.Listener.Addr().String(), rec, req, noRetry); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"X-Client-Hop", "Upgrade", "Proxy-Authorization"} {
+		if received.Get(name) != "" {
+			t.Errorf("Expected request header %s to be removed, got %q", name, received.Get(name))
+		}
+	}
+	if received.Get("X-Forwarded-Kept") != "1" {
+		t.Error("Expected end-to-end request headers to be forwarded")
+	}
+	for _, name := range []string{"Connection", "X-Backend-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		if rec.Header().Get(name) != "" {
+			t.Errorf("Expected response header %s to be removed, got %q", name, rec.Header().Get(name))
+		}
+	}
+	if rec.Header().Get("X-Kept") != "1" {
+		t.Error("Expected end-to-end response headers to be copied")
+	}
+	if req.Header.Get("X-Client-Hop") != "1" {
+		t.Error("Expected the client request to be left as is")
+	}
+}
+
+func TestForwardLogsRequestsOnlyAtDebugLevel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	for level, expectLine := range map[slog.Level]bool{slog.LevelInfo: false, slog.LevelDebug: true} {
+		var logs bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: level})))
+
+		rec := httptest.NewRecorder()
+		if err := forward(backend.Listener.Addr().String(), rec, httptest.NewRequest(http.MethodGet, "/", nil), noRetry); err != nil {
+			t.Fatal(err)
+		}
+		if logged := strings.Contains(logs.String(), "msg=forwarded"); logged != expectLine {
+			t.Errorf("At level %s expected the per-request line logged: %t, got %q", level, expectLine, logs.String())
+		}
+	}
+}
+
+func TestForwardBackendHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	dst := backend.Listener.Addr().String()
+
+	request := func() http.Header {
+		rec := httptest.NewRecorder()
+		if err := forward(dst, rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil), noRetry); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Header()
+	}
+
+	if header := request(); header.Get("lb-from") != "" || header.Get("lb-strategy") != "" {
+		t.Errorf("Expected no backend headers by default, got %v", header)
+	}
+
+	previous := *backendHeaders
+	*backendHeaders = true
+	defer func() { *backendHeaders = previous }()
+
+	header := request()
+	if header.Get("lb-from") != dst || header.Get("lb-strategy") != *strategyName {
+		t.Errorf("Expected lb-from %s and lb-strategy %s, got %v", dst, *strategyName, header)
+	}
+	if header.Get("lb-latency") != "" {
+		t.Errorf("Expected tracing headers to stay off without -trace, got %v", header)
+	}
+}
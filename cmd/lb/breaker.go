@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// breakers is disabled until main configures it from the flags.
+var breakers = newCircuitBreaker(0, 0)
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// circuitBreaker takes servers that fail several times in a row out of
+// rotation for a cooldown, even if their health checks still pass. Once the
+// cooldown is over a single probe request is let through: its success closes
+// the circuit, its failure opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	states    map[string]*breakerState
+	now       func() time.Time
+}
+
+// newCircuitBreaker creates a breaker that opens after threshold consecutive
+// failures. A threshold of zero disables it.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		states:    make(map[string]*breakerState),
+		now:       time.Now,
+	}
+}
+
+// available reports whether the server may be selected: its circuit is
+// closed, or the cooldown is over and no probe is in flight yet.
+func (b *circuitBreaker) available(server string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.states[server]
+	if state == nil || state.openUntil.IsZero() {
+		return true
+	}
+	return !state.probing && !b.now().Before(state.openUntil)
+}
+
+// allow is called before sending a request to the server. For a half-open
+// circuit it lets exactly one probe request through.
+func (b *circuitBreaker) allow(server string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.states[server]
+	if state == nil || state.openUntil.IsZero() {
+		return true
+	}
+	if state.probing || b.now().Before(state.openUntil) {
+		return false
+	}
+	state.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.states, server)
+}
+
+// abandon gives back the probe slot allow may have taken for the server,
+// without counting a failure, for requests that ended without telling whether
+// the server works.
+func (b *circuitBreaker) abandon(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if state := b.states[server]; state != nil {
+		state.probing = false
+	}
+}
+
+func (b *circuitBreaker) failure(server string) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.states[server]
+	if state == nil {
+		state = &breakerState{}
+		b.states[server] = state
+	}
+	state.failures++
+	if state.probing || state.failures >= b.threshold {
+		state.openUntil = b.now().Add(b.cooldown)
+		state.probing = false
+	}
+}
+
+func (b *circuitBreaker) isOpen(server string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.states[server]
+	return state != nil && !state.openUntil.IsZero()
+}
+
+func (b *circuitBreaker) filter(servers []string) []string {
+	var result []string
+	for _, server := range servers {
+		if b.available(server) {
+			result = append(result, server)
+		}
+	}
+	return result
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(3, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		b.failure("server1:8080")
+	}
+	if !b.available("server1:8080") {
+		t.Fatal("Circuit should stay closed below the threshold")
+	}
+
+	b.failure("server1:8080")
+	if b.available("server1:8080") || b.allow("server1:8080") {
+		t.Fatal("Circuit should open at the threshold")
+	}
+	if !b.available("server2:8080") {
+		t.Error("Other servers should not be affected")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !b.allow("server1:8080") {
+		t.Fatal("Expected a probe after the cooldown")
+	}
+	if b.available("server1:8080") || b.allow("server1:8080") {
+		t.Error("Only one probe should be let through")
+	}
+
+	b.failure("server1:8080")
+	if b.available("server1:8080") {
+		t.Fatal("Failed probe should open the circuit again")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !b.allow("server1:8080") {
+		t.Fatal("Expected another probe after the cooldown")
+	}
+	b.success("server1:8080")
+	if !b.available("server1:8080") || b.isOpen("server1:8080") {
+		t.Error("Successful probe should close the circuit")
+	}
+}
+
+func TestCircuitBreakerAbandonedProbe(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(1, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	b.failure("server1:8080")
+	now = now.Add(10 * time.Second)
+	if !b.allow("server1:8080") {
+		t.Fatal("Expected a probe after the cooldown")
+	}
+
+	b.abandon("server1:8080")
+	if !b.isOpen("server1:8080") {
+		t.Error("Abandoned probe should leave the circuit open")
+	}
+	if !b.available("server1:8080") || !b.allow("server1:8080") {
+		t.Error("Abandoned probe should give back its slot")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.failure("server1:8080")
+	}
+	if !b.available("server1:8080") {
+		t.Error("Disabled breaker should never open")
+	}
+}
+
+func TestHandleRequestSkipsOpenCircuit(t *testing.T) {
+	var failingHits atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	previousBreakers, previousStrategy := breakers, strategy
+	breakers = newCircuitBreaker(2, time.Minute)
+	// Round robin makes sure the failing server keeps being selected.
+	strategy = &roundRobinStrategy{}
+	t.Cleanup(func() { breakers, strategy = previousBreakers, previousStrategy })
+
+	failingAddr := failing.Listener.Addr().String()
+	setHealthyServers(t, failingAddr, healthy.Listener.Addr().String())
+
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rec.Code)
+		}
+	}
+
+	if hits := failingHits.Load(); hits != 2 {
+		t.Errorf("Expected the failing server to be hit until the circuit opened, got %d hits", hits)
+	}
+	if !getServerStatus(failingAddr).CircuitOpen {
+		t.Error("Expected the open circuit to be reported")
+	}
+}
+
+func TestHandleRequestReleasesCancelledProbe(t *testing.T) {
+	started := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+
+	now := time.Now()
+	previousBreakers := breakers
+	breakers = newCircuitBreaker(1, time.Minute)
+	breakers.now = func() time.Time { return now }
+	t.Cleanup(func() { breakers = previousBreakers })
+	setHealthyServers(t, addr)
+
+	breakers.failure(addr)
+	now = now.Add(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil).WithContext(ctx))
+	}()
+	<-started
+	cancel()
+	<-done
+
+	if !breakers.available(addr) {
+		t.Error("Expected the cancelled probe to give back the probe slot")
+	}
+	if !breakers.isOpen(addr) {
+		t.Error("Expected the cancelled probe not to close the circuit")
+	}
+}
+
+func TestHandleRequestCountsRelayedServerErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+
+	previousBreakers, previousRetries := breakers, *maxRetries
+	breakers = newCircuitBreaker(1, time.Minute)
+	*maxRetries = 0
+	t.Cleanup(func() { breakers, *maxRetries = previousBreakers, previousRetries })
+	setHealthyServers(t, addr)
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the server error to be relayed, got %d", rec.Code)
+	}
+	if !breakers.isOpen(addr) {
+		t.Error("Expected a relayed server error to count as a failure")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var compress = flag.Bool("compress", false, "whether to gzip JSON and text responses the backend did not compress for clients that accept gzip")
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip,
+// either by name or through *, with a non-zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				if quality, err := strconv.ParseFloat(q, 64); err == nil && quality == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether a body of the given content type is worth
+// compressing: JSON and text are, while images and archives usually already
+// are compressed.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || strings.HasPrefix(mediaType, "text/")
+}
+
+// shouldCompress reports whether the balancer gzips the response to r itself.
+// Responses the backend already encoded in any way are passed through as is,
+// so nothing is compressed twice.
+func shouldCompress(r *http.Request, resp *http.Response) bool {
+	if !*compress || r.Method == http.MethodHead || !acceptsGzip(r) {
+		return false
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	return compressible(resp.Header.Get("Content-Type"))
+}
+
+// writeGzipHeaders turns the headers copied from the backend into those of a
+// gzipped response. The length of the compressed body is not known upfront,
+// and a strong ETag becomes weak since the bytes sent differ from the
+// backend's.
+func writeGzipHeaders(header http.Header) {
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// copyGzip compresses body into w.
+func copyGzip(w io.Writer, body io.Reader) error {
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, body); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, GZIP;q=0.5":  true,
+		"gzip;q=0":             false,
+		"*":                    true,
+		"br, identity":         false,
+		"gzip;q=0, deflate":    false,
+		"deflate;q=1, *;q=0.1": true,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set("Accept-Encoding", header)
+		}
+		if got := acceptsGzip(req); got != expected {
+			t.Errorf("acceptsGzip(%q) = %t, expected %t", header, got, expected)
+		}
+	}
+}
+
+func TestForwardCompressesResponses(t *testing.T) {
+	payload := `{"key":"team","value":"` + strings.Repeat("x", 1000) + `"}`
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/encoded":
+			rw.Header().Set("Content-Encoding", "br")
+			rw.Header().Set("Content-Type", "application/json")
+		case "/image":
+			rw.Header().Set("Content-Type", "image/png")
+		default:
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Header().Set("ETag", `"tag"`)
+		}
+		rw.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		io.WriteString(rw, payload)
+	}))
+	defer backend.Close()
+	dst := backend.Listener.Addr().String()
+
+	previous := *compress
+	*compress = true
+	defer func() { *compress = previous }()
+
+	request := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		if err := forward(dst, rec, req, noRetry); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := request("/api/v1/some-data", "gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Content-Length") != "" {
+		t.Fatalf("Expected a gzipped response without Content-Length, got %v", rec.Header())
+	}
+	if rec.Header().Get("ETag") != `W/"tag"` || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected a weak ETag and Vary, got %v", rec.Header())
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(reader); err != nil || string(body) != payload {
+		t.Errorf("Expected the payload after decompression, got %d bytes (%v)", len(body), err)
+	}
+
+	for _, c := range []struct{ path, acceptEncoding string }{
+		{"/api/v1/some-data", ""},
+		{"/encoded", "gzip"},
+		{"/image", "gzip"},
+	} {
+		rec := request(c.path, c.acceptEncoding)
+		if rec.Header().Get("Content-Encoding") == "gzip" || rec.Body.String() != payload {
+			t.Errorf("Expected %s with Accept-Encoding %q to pass through as is, got %v", c.path, c.acceptEncoding, rec.Header())
+		}
+	}
+
+	*compress = false
+	if rec := request("/api/v1/some-data", "gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected no compression without -compress, got %v", rec.Header())
+	}
+}
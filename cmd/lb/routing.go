@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bndrchuk-artem/trenbolonchiki-lab5/httptools"
+)
+
+var (
+	stickyCookie       = flag.String("sticky-cookie", "", "name of the session cookie used as the routing key instead of the client address (empty disables sticky sessions)")
+	trustedProxiesSpec = flag.String("trusted-proxies", "", "comma-separated IPs or CIDRs of proxies whose X-Forwarded-For and X-Real-IP headers are trusted")
+	routesSpec         = flag.String("routes", "", "semicolon-separated routes of the form /path/prefix=host:port,host:port sending matching paths to their own servers; other paths go to the servers pool")
+)
+
+// route sends requests whose path starts with prefix to its own servers
+// instead of the servers pool.
+type route struct {
+	prefix  string
+	servers []string
+}
+
+var (
+	routesMutex sync.RWMutex
+	// routes are sorted by descending prefix length, so the first match is
+	// the longest one.
+	routes []route
+)
+
+// parseRoutes parses a semicolon-separated list of prefix=servers routes,
+// where servers is a comma-separated list of host:port addresses.
+func parseRoutes(spec string) ([]route, error) {
+	var result []route
+	prefixes := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, serversSpec, found := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid route %q: expected /path/prefix=host:port,...", entry)
+		}
+		if prefixes[prefix] {
+			return nil, fmt.Errorf("route %s is listed more than once", prefix)
+		}
+		prefixes[prefix] = true
+
+		var servers []string
+		for _, server := range strings.Split(serversSpec, ",") {
+			server = strings.TrimSpace(server)
+			if server == "" {
+				continue
+			}
+			if err := validateServerAddress(server); err != nil {
+				return nil, fmt.Errorf("route %s: %w", prefix, err)
+			}
+			servers = append(servers, server)
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("route %s has no servers", prefix)
+		}
+		result = append(result, route{prefix: prefix, servers: servers})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return len(result[i].prefix) > len(result[j].prefix)
+	})
+	return result, nil
+}
+
+func setRoutes(table []route) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	routes = table
+}
+
+// matchRoute returns the route with the longest prefix of path.
+func matchRoute(path string) (route, bool) {
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+
+	for _, r := range routes {
+		if strings.HasPrefix(path, r.prefix) {
+			return r, true
+		}
+	}
+	return route{}, false
+}
+
+// routedServers returns the servers of every route, which are health checked
+// along with the servers pool.
+func routedServers() map[string]bool {
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+
+	result := make(map[string]bool)
+	for _, r := range routes {
+		for _, server := range r.servers {
+			result[server] = true
+		}
+	}
+	return result
+}
+
+// serversForPath narrows the healthy servers down to those of the route
+// matching path. Paths without a route go to every healthy server that no
+// route claims, which is the whole servers pool when no routes are set.
+func serversForPath(path string, healthy []string) []string {
+	if r, ok := matchRoute(path); ok {
+		allowed := make(map[string]bool, len(r.servers))
+		for _, server := range r.servers {
+			allowed[server] = true
+		}
+		var result []string
+		for _, server := range healthy {
+			if allowed[server] {
+				result = append(result, server)
+			}
+		}
+		return result
+	}
+
+	routed := routedServers()
+	if len(routed) == 0 {
+		return healthy
+	}
+	var result []string
+	for _, server := range healthy {
+		if !routed[server] || inServersPool(server) {
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges. Plain addresses are treated as single-host ranges.
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress returns the address of the client that sent the request.
+// Forwarding headers are only honoured when the request comes from a trusted
+// proxy, since anyone else can set them. X-Forwarded-For is walked from the
+// right, skipping trusted hops: entries left of the first untrusted hop were
+// supplied by the client itself and could be spoofed.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return r.RemoteAddr
+	}
+
+	if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if !isTrustedProxy(hop) {
+				return hop
+			}
+			host = hop
+		}
+		// Every hop is trusted: the left-most one is the closest to the client.
+		return host
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	return r.RemoteAddr
+}
+
+// routingKey returns the key the strategy uses to pick a server. With sticky
+// sessions enabled it is the session cookie, which is issued on the response
+// when the client has none yet; otherwise it is the client address.
+func routingKey(rw http.ResponseWriter, r *http.Request) string {
+	if *stickyCookie == "" {
+		return clientAddress(r)
+	}
+
+	if cookie, err := r.Cookie(*stickyCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	session, err := newSessionID()
+	if err != nil {
+		return clientAddress(r)
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     *stickyCookie,
+		Value:    session,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session
+}
+
+// maxRequestIDLength bounds the request IDs accepted from clients, which end
+// up in the logs of every service.
+const maxRequestIDLength = 128
+
+// requestID returns the ID of the request, setting a new one on the request
+// if the client did not send a usable one, so it is forwarded to the backend.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(httptools.RequestIDHeader)
+	if id != "" && len(id) <= maxRequestIDLength {
+		return id
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return ""
+	}
+	r.Header.Set(httptools.RequestIDHeader, id)
+	return id
+}
+
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bndrchuk-artem/trenbolonchiki-lab5/httptools"
+)
+
+func TestRoutingKeyWithoutStickySessions(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	rec := httptest.NewRecorder()
+
+	if key := routingKey(rec, req); key != req.RemoteAddr {
+		t.Errorf("Expected the client address as the key, got %q", key)
+	}
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Error("No cookie should be set when sticky sessions are disabled")
+	}
+}
+
+func TestRoutingKeyWithStickySessions(t *testing.T) {
+	previous := *stickyCookie
+	*stickyCookie = "lb-session"
+	defer func() { *stickyCookie = previous }()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	rec := httptest.NewRecorder()
+
+	key := routingKey(rec, req)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "lb-session" || cookies[0].Value != key {
+		t.Fatalf("Expected a session cookie with the routing key, got %v", cookies)
+	}
+
+	for _, addr := range []string{"10.0.0.1:1111", "10.0.0.2:2222"} {
+		next := httptest.NewRequest(http.MethodGet, "/", nil)
+		next.RemoteAddr = addr
+		next.AddCookie(cookies[0])
+		nextRec := httptest.NewRecorder()
+
+		if got := routingKey(nextRec, next); got != key {
+			t.Errorf("Expected the session to keep key %q from %s, got %q", key, addr, got)
+		}
+		if nextRec.Header().Get("Set-Cookie") != "" {
+			t.Error("Existing session cookie should not be replaced")
+		}
+	}
+
+	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
+	if chooseServer(key, servers) != chooseServer(key, servers) {
+		t.Error("Same session should map to the same server")
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.1, 192.168.0.0/16,::1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(proxies) != 3 {
+		t.Fatalf("Expected 3 trusted ranges, got %v", proxies)
+	}
+
+	for _, spec := range []string{"not-an-ip", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	previous := trustedProxies
+	defer func() { trustedProxies = previous }()
+	trustedProxies, _ = parseTrustedProxies("10.0.0.0/8")
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"no headers", "10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"untrusted proxy", "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.5:1234"},
+		{"forwarded for", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"trusted hops skipped", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"spoofed entry ignored", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"real ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			if got := clientAddress(req); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHandleRequestPropagatesRequestID(t *testing.T) {
+	var received []string
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get(httptools.RequestIDHeader))
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	setHealthyServers(t, backend.Listener.Addr().String())
+
+	previous := *traceEnabled
+	*traceEnabled = true
+	defer func() { *traceEnabled = previous }()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil)
+	req.Header.Set(httptools.RequestIDHeader, "client-id")
+	rec := httptest.NewRecorder()
+	handleRequest(rec, req)
+	if got := rec.Header().Values(httptools.RequestIDHeader); len(got) != 1 || got[0] != "client-id" {
+		t.Errorf("Expected the client's ID to be echoed once, got %v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+	generated := rec.Header().Get(httptools.RequestIDHeader)
+	if generated == "" {
+		t.Fatal("Expected an ID to be generated")
+	}
+
+	if len(received) != 2 || received[0] != "client-id" || received[1] != generated {
+		t.Errorf("Expected the backend to receive [client-id %s], got %v", generated, received)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	table, err := parseRoutes("/db/=db:8082; /api/=server1:8080, server2:8080;/api/v1/admin=admin:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 3 || table[0].prefix != "/api/v1/admin" {
+		t.Fatalf("Expected three routes, the longest prefix first, got %v", table)
+	}
+	if servers := table[1].servers; table[1].prefix != "/api/" || len(servers) != 2 || servers[1] != "server2:8080" {
+		t.Errorf("Unexpected /api/ route %v", table[1])
+	}
+
+	if table, err := parseRoutes(""); err != nil || len(table) != 0 {
+		t.Errorf("Expected no routes for an empty spec, got %v, %v", table, err)
+	}
+	for _, spec := range []string{"db=db:8082", "/db/", "/db/=", "/db/=db", "/db/=db:1;/db/=db:2"} {
+		if _, err := parseRoutes(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestHandleRequestRoutesByPathPrefix(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte(name))
+		}))
+	}
+	app, db := newBackend("app"), newBackend("db")
+	defer app.Close()
+	defer db.Close()
+	appAddr, dbAddr := app.Listener.Addr().String(), db.Listener.Addr().String()
+
+	setHealthyServers(t, appAddr, dbAddr)
+	setRoutes([]route{{prefix: "/db/", servers: []string{dbAddr}}})
+	defer setRoutes(nil)
+
+	for path, expected := range map[string]string{
+		"/db/key":           "db",
+		"/api/v1/some-data": "app",
+		"/dbx":              "app",
+	} {
+		for i := 0; i < 5; i++ {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.RemoteAddr = fmt.Sprintf("192.168.1.%d:12345", i)
+			rec := httptest.NewRecorder()
+			handleRequest(rec, req)
+			if rec.Body.String() != expected {
+				t.Errorf("Expected %s from %s, got %q", path, expected, rec.Body.String())
+			}
+		}
+	}
+
+	if targets := healthCheckTargets(); targets[len(targets)-1] != dbAddr {
+		t.Errorf("Expected the routed server to be health checked, got %v", targets)
+	}
+
+	setHealthyServers(t, appAddr)
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(http.MethodGet, "/db/key", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a healthy server on the route, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy picks the backend to forward a request to among the healthy
+// servers. The key identifies the client for strategies that keep clients
+// sticky to a backend.
+type Strategy interface {
+	Choose(key string, servers []string) string
+}
+
+const (
+	strategyHash             = "hash"
+	strategyConsistentHash   = "consistent-hash"
+	strategyRoundRobin       = "round-robin"
+	strategyLeastConnections = "least-connections"
+	strategyLeastTime        = "least-time"
+)
+
+func newStrategy(name string) (Strategy, error) {
+	switch name {
+	case strategyHash:
+		return hashStrategy{}, nil
+	case strategyConsistentHash:
+		return newConsistentHashStrategy(*virtualNodes), nil
+	case strategyRoundRobin:
+		return &roundRobinStrategy{}, nil
+	case strategyLeastConnections:
+		return &leastConnectionsStrategy{connections: activeConnections}, nil
+	case strategyLeastTime:
+		return &leastTimeStrategy{latencies: responseTimes}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q", name)
+	}
+}
+
+// SimulateDistribution reports how many of the clients the strategy would
+// send to each of the servers, without forwarding anything, so strategies can
+// be compared offline. Every server is in the result, with zero if it gets no
+// client; servers passed through applyWeights simulate their weights. The
+// strategy keeps any state it changes, like the position of round-robin, and
+// strategies driven by live load see the balancer's current counters.
+func SimulateDistribution(clients []string, servers []string, s Strategy) map[string]int {
+	distribution := make(map[string]int, len(servers))
+	for _, server := range servers {
+		distribution[server] = 0
+	}
+	for _, client := range clients {
+		if server := s.Choose(client, servers); server != "" {
+			distribution[server]++
+		}
+	}
+	return distribution
+}
+
+// simulatedClients returns n client addresses for SimulateDistribution.
+func simulatedClients(n int) []string {
+	clients := make([]string, n)
+	for i := range clients {
+		clients[i] = fmt.Sprintf("192.0.2.%d:%d", i%254+1, 10000+i)
+	}
+	return clients
+}
+
+// hashStrategy sends every client to the same backend as long as that backend
+// stays healthy. Changes to the rest of the pool do not move the client.
+type hashStrategy struct{}
+
+func (hashStrategy) Choose(key string, servers []string) string {
+	return chooseServer(key, servers)
+}
+
+// consistentHashStrategy places every server on a hash ring at several
+// virtual nodes and sends a client to the first node after the client's hash.
+// Adding or removing one of N servers only moves about 1/N of the clients.
+// The ring is built once for the servers seen so far and only rebuilt when a
+// server or weight shows up that it does not hold yet. Servers missing from
+// the list passed to Choose, e.g. those a retry excludes or the breaker
+// filters, are skipped by walking on clockwise, which picks what a ring
+// without them would.
+type consistentHashStrategy struct {
+	virtualNodes int
+
+	mu   sync.Mutex // serializes rebuilds
+	ring atomic.Pointer[hashRing]
+}
+
+func newConsistentHashStrategy(virtualNodes int) *consistentHashStrategy {
+	return &consistentHashStrategy{virtualNodes: max(virtualNodes, 1)}
+}
+
+func (s *consistentHashStrategy) Choose(key string, servers []string) string {
+	if len(servers) == 0 {
+		return ""
+	}
+	entries := countEntries(servers)
+	ring := s.ring.Load()
+	if ring == nil || !ring.holds(entries) {
+		ring = s.extendRing(entries)
+	}
+	return ring.lookup(key, entries)
+}
+
+// extendRing rebuilds the ring with the servers it holds and those of
+// entries, with the weights of entries.
+func (s *consistentHashStrategy) extendRing(entries map[string]int) *hashRing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring := s.ring.Load()
+	if ring != nil && ring.holds(entries) {
+		return ring
+	}
+	merged := make(map[string]int, len(entries))
+	if ring != nil {
+		maps.Copy(merged, ring.entries)
+	}
+	maps.Copy(merged, entries)
+	ring = newHashRing(merged, s.virtualNodes)
+	s.ring.Store(ring)
+	return ring
+}
+
+// countEntries counts how often every server is listed, which applyWeights
+// makes its weight.
+func countEntries(servers []string) map[string]int {
+	entries := make(map[string]int, len(servers))
+	for _, server := range servers {
+		entries[server]++
+	}
+	return entries
+}
+
+// hashRing is sorted by point. A server with several entries, as applyWeights
+// lists servers for weights, gets virtual nodes for every entry.
+type hashRing struct {
+	points  []uint32
+	servers []string
+	entries map[string]int
+}
+
+func newHashRing(entries map[string]int, virtualNodes int) *hashRing {
+	type node struct {
+		point  uint32
+		server string
+	}
+	nodes := make([]node, 0, len(entries)*virtualNodes)
+	for server, n := range entries {
+		for entry := 0; entry < n; entry++ {
+			for i := 0; i < virtualNodes; i++ {
+				name := fmt.Sprintf("%s#%d#%d", server, entry, i)
+				nodes = append(nodes, node{mixedHash(name), server})
+			}
+		}
+	}
+	// Ties are broken by server so the ring does not depend on pool order.
+	slices.SortFunc(nodes, func(a, b node) int {
+		if a.point != b.point {
+			return cmp.Compare(a.point, b.point)
+		}
+		return strings.Compare(a.server, b.server)
+	})
+
+	ring := &hashRing{
+		points:  make([]uint32, len(nodes)),
+		servers: make([]string, len(nodes)),
+		entries: entries,
+	}
+	for i, n := range nodes {
+		ring.points[i], ring.servers[i] = n.point, n.server
+	}
+	return ring
+}
+
+// holds reports whether the ring has every server of entries with the same
+// number of entries.
+func (r *hashRing) holds(entries map[string]int) bool {
+	for server, n := range entries {
+		if r.entries[server] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the first server of candidates at or after the key's hash.
+func (r *hashRing) lookup(key string, candidates map[string]int) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	start, _ := slices.BinarySearch(r.points, mixedHash(key))
+	for i := 0; i < len(r.points); i++ {
+		if server := r.servers[(start+i)%len(r.points)]; candidates[server] > 0 {
+			return server
+		}
+	}
+	return ""
+}
+
+// roundRobinStrategy cycles through the healthy servers regardless of the
+// client.
+type roundRobinStrategy struct {
+	counter atomic.Uint64
+}
+
+func (s *roundRobinStrategy) Choose(_ string, servers []string) string {
+	if len(servers) == 0 {
+		return ""
+	}
+	next := s.counter.Add(1) - 1
+	return servers[next%uint64(len(servers))]
+}
+
+// connectionCounter tracks the number of in-flight requests per server.
+type connectionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newConnectionCounter() *connectionCounter {
+	return &connectionCounter{counts: make(map[string]int64)}
+}
+
+func (c *connectionCounter) acquire(server string) {
+	c.mu.Lock()
+	c.counts[server]++
+	c.mu.Unlock()
+}
+
+// tryAcquire counts a request to the server unless limit requests are already
+// in flight. A limit of zero means no limit.
+func (c *connectionCounter) tryAcquire(server string, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if limit > 0 && c.counts[server] >= int64(limit) {
+		return false
+	}
+	c.counts[server]++
+	return true
+}
+
+func (c *connectionCounter) release(server string) {
+	c.mu.Lock()
+	c.counts[server]--
+	if c.counts[server] <= 0 {
+		delete(c.counts, server)
+	}
+	c.mu.Unlock()
+}
+
+func (c *connectionCounter) get(server string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[server]
+}
+
+// leastConnectionsStrategy picks the server with the fewest in-flight
+// requests, preferring servers earlier in the list on ties.
+type leastConnectionsStrategy struct {
+	connections *connectionCounter
+}
+
+func (s *leastConnectionsStrategy) Choose(_ string, servers []string) string {
+	if len(servers) == 0 {
+		return ""
+	}
+
+	s.connections.mu.Lock()
+	defer s.connections.mu.Unlock()
+
+	best := servers[0]
+	for _, server := range servers[1:] {
+		if s.connections.counts[server] < s.connections.counts[best] {
+			best = server
+		}
+	}
+	return best
+}
+
+// latencyTracker keeps an exponentially weighted moving average of the
+// response time of every server. An average loses half its value every
+// halfLife without a new sample, so that a server which was slow once looks
+// fast enough to get a request again after a while and, if it has recovered,
+// gets its traffic back. A halfLife of zero keeps averages as they are.
+type latencyTracker struct {
+	mu       sync.Mutex
+	alpha    float64
+	averages map[string]float64
+
+	halfLife time.Duration
+	measured map[string]time.Time
+	now      func() time.Time
+}
+
+// newLatencyTracker creates a tracker that weighs each new sample with alpha
+// and the previous, decayed average with 1-alpha.
+func newLatencyTracker(alpha float64, halfLife time.Duration) *latencyTracker {
+	return &latencyTracker{
+		alpha:    alpha,
+		averages: make(map[string]float64),
+		halfLife: halfLife,
+		measured: make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+func (l *latencyTracker) observe(server string, latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	average, ok := l.averageLocked(server, now)
+	if ok {
+		average = l.alpha*float64(latency) + (1-l.alpha)*average
+	} else {
+		average = float64(latency)
+	}
+	l.averages[server] = average
+	l.measured[server] = now
+}
+
+// averageLocked returns the decayed average of the server as of now, and
+// whether it was measured at all. The caller holds mu.
+func (l *latencyTracker) averageLocked(server string, now time.Time) (float64, bool) {
+	average, ok := l.averages[server]
+	if !ok || l.halfLife <= 0 {
+		return average, ok
+	}
+	age := now.Sub(l.measured[server])
+	return average * math.Exp2(-float64(age)/float64(l.halfLife)), true
+}
+
+func (l *latencyTracker) get(server string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	average, _ := l.averageLocked(server, l.now())
+	return time.Duration(average)
+}
+
+// leastTimeStrategy picks the server with the lowest average response time,
+// preferring servers earlier in the list on ties. Servers without a measured
+// response yet count as fastest, so every server gets tried.
+type leastTimeStrategy struct {
+	latencies *latencyTracker
+}
+
+func (s *leastTimeStrategy) Choose(_ string, servers []string) string {
+	if len(servers) == 0 {
+		return ""
+	}
+
+	s.latencies.mu.Lock()
+	defer s.latencies.mu.Unlock()
+
+	now := s.latencies.now()
+	best := servers[0]
+	bestAverage, _ := s.latencies.averageLocked(best, now)
+	for _, server := range servers[1:] {
+		if average, _ := s.latencies.averageLocked(server, now); average < bestAverage {
+			best, bestAverage = server, average
+		}
+	}
+	return best
+}
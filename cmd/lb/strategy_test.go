@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{strategyHash, strategyConsistentHash, strategyRoundRobin, strategyLeastConnections, strategyLeastTime} {
+		if _, err := newStrategy(name); err != nil {
+			t.Errorf("Expected strategy %s to be supported: %v", name, err)
+		}
+	}
+	if _, err := newStrategy("random"); err == nil {
+		t.Error("Expected error for unknown strategy")
+	}
+}
+
+func TestConsistentHashStrategyChurn(t *testing.T) {
+	var servers []string
+	for i := 1; i <= 10; i++ {
+		servers = append(servers, fmt.Sprintf("server%d:8080", i))
+	}
+	reduced := append(append([]string{}, servers[:4]...), servers[5:]...)
+
+	strategy := newConsistentHashStrategy(100)
+	const clients = 10000
+	before := make([]string, clients)
+	for i := range before {
+		before[i] = strategy.Choose(fmt.Sprintf("10.0.%d.%d", i/256, i%256), servers)
+	}
+
+	moved, movedModulo := 0, 0
+	for i := range before {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		after := strategy.Choose(key, reduced)
+		if before[i] != servers[4] && after != before[i] {
+			t.Fatalf("Client %s moved from %s to %s although its server stayed", key, before[i], after)
+		}
+		if after != before[i] {
+			moved++
+		}
+		if servers[hash(key)%uint32(len(servers))] != reduced[hash(key)%uint32(len(reduced))] {
+			movedModulo++
+		}
+	}
+
+	if moved > clients/5 {
+		t.Errorf("Removing one of %d servers moved %d of %d clients", len(servers), moved, clients)
+	}
+	if moved*4 > movedModulo {
+		t.Errorf("Expected far less churn than modulo hashing: %d moved vs %d", moved, movedModulo)
+	}
+	t.Logf("Moved clients: ring %d, modulo %d", moved, movedModulo)
+}
+
+func TestConsistentHashStrategyDistribution(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
+	strategy := newConsistentHashStrategy(100)
+	distribution := make(map[string]int)
+
+	for i := 0; i < 3000; i++ {
+		distribution[strategy.Choose(fmt.Sprintf("client-%d", i), servers)]++
+	}
+
+	for _, server := range servers {
+		if distribution[server] < 500 {
+			t.Errorf("Server %s received only %d of 3000 clients", server, distribution[server])
+		}
+	}
+
+	if server := strategy.Choose("client", nil); server != "" {
+		t.Errorf("Expected empty string for empty server pool, got %s", server)
+	}
+}
+
+func TestConsistentHashStrategySkipsExcludedServers(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080", "server3:8080", "server4:8080"}
+	strategy := newConsistentHashStrategy(100)
+	strategy.Choose("client", servers)
+	ring := strategy.ring.Load()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		first := strategy.Choose(key, servers)
+		remaining := slices.DeleteFunc(slices.Clone(servers), func(s string) bool { return s == first })
+
+		// Walking past the excluded server picks what a ring built
+		// without it would.
+		expected := newConsistentHashStrategy(100).Choose(key, remaining)
+		if got := strategy.Choose(key, remaining); got != expected {
+			t.Fatalf("Client %s without %s: expected %s, got %s", key, first, expected, got)
+		}
+	}
+	if strategy.ring.Load() != ring {
+		t.Error("Expected subsets of the servers to reuse the ring")
+	}
+
+	strategy.Choose("client", append(slices.Clone(servers), "server5:8080"))
+	if strategy.ring.Load() == ring {
+		t.Error("Expected a new server to rebuild the ring")
+	}
+	if server := strategy.Choose("client", []string{"server5:8080"}); server != "server5:8080" {
+		t.Errorf("Expected the only candidate, got %s", server)
+	}
+}
+
+func TestRoundRobinStrategyDistribution(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
+	strategy := &roundRobinStrategy{}
+	distribution := make(map[string]int)
+
+	for i := 0; i < 300; i++ {
+		server := strategy.Choose("192.168.1.1:12345", servers)
+		distribution[server]++
+	}
+
+	for _, server := range servers {
+		if distribution[server] != 100 {
+			t.Errorf("Server %s received %d requests, expected exactly 100", server, distribution[server])
+		}
+	}
+
+	if server := strategy.Choose("192.168.1.1:12345", nil); server != "" {
+		t.Errorf("Expected empty string for empty server pool, got %s", server)
+	}
+}
+
+func TestRoundRobinStrategyCycles(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080"}
+	strategy := &roundRobinStrategy{}
+
+	for i := 0; i < 6; i++ {
+		expected := servers[i%len(servers)]
+		if server := strategy.Choose(fmt.Sprintf("client-%d", i), servers); server != expected {
+			t.Errorf("Request %d: expected %s, got %s", i, expected, server)
+		}
+	}
+}
+
+func TestSimulateDistribution(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
+	clients := simulatedClients(300)
+
+	for _, name := range []string{strategyHash, strategyConsistentHash, strategyRoundRobin} {
+		strategy, err := newStrategy(name)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", name, err)
+		}
+		distribution := SimulateDistribution(clients, servers, strategy)
+
+		total := 0
+		for _, server := range servers {
+			total += distribution[server]
+			if distribution[server] < 50 {
+				t.Errorf("%s: server %s received %d clients, expected at least 50", name, server, distribution[server])
+			}
+		}
+		if total != len(clients) || len(distribution) != len(servers) {
+			t.Errorf("%s: expected %d clients over %d servers, got %v", name, len(clients), len(servers), distribution)
+		}
+	}
+
+	distribution := SimulateDistribution(clients, servers, &roundRobinStrategy{})
+	for _, server := range servers {
+		if distribution[server] != 100 {
+			t.Errorf("Round-robin sent %d clients to %s, expected exactly 100", distribution[server], server)
+		}
+	}
+
+	distribution = SimulateDistribution(nil, servers, hashStrategy{})
+	for _, server := range servers {
+		if count, ok := distribution[server]; !ok || count != 0 {
+			t.Errorf("Expected %s to be reported with 0 clients, got %d (present: %v)", server, count, ok)
+		}
+	}
+}
+
+func TestLeastConnectionsStrategy(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
+	connections := newConnectionCounter()
+	strategy := &leastConnectionsStrategy{connections: connections}
+
+	connections.acquire("server1:8080")
+	connections.acquire("server1:8080")
+	connections.acquire("server2:8080")
+
+	if server := strategy.Choose("client", servers); server != "server3:8080" {
+		t.Errorf("Expected idle server3:8080, got %s", server)
+	}
+
+	connections.acquire("server3:8080")
+	connections.acquire("server3:8080")
+	if server := strategy.Choose("client", servers); server != "server2:8080" {
+		t.Errorf("Expected least loaded server2:8080, got %s", server)
+	}
+
+	connections.release("server1:8080")
+	connections.release("server1:8080")
+	if server := strategy.Choose("client", servers); server != "server1:8080" {
+		t.Errorf("Expected released server1:8080, got %s", server)
+	}
+	if count := connections.get("server1:8080"); count != 0 {
+		t.Errorf("Expected 0 connections to server1:8080, got %d", count)
+	}
+}
+
+func TestLeastConnectionsStrategyConcurrentCounting(t *testing.T) {
+	connections := newConnectionCounter()
+	done := make(chan struct{})
+
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				connections.acquire("server1:8080")
+				connections.release("server1:8080")
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	if count := connections.get("server1:8080"); count != 0 {
+		t.Errorf("Expected balanced counter, got %d", count)
+	}
+}
+
+func TestLatencyTrackerAverages(t *testing.T) {
+	latencies := newLatencyTracker(0.5, 0)
+
+	latencies.observe("server1:8080", 100*time.Millisecond)
+	if average := latencies.get("server1:8080"); average != 100*time.Millisecond {
+		t.Errorf("Expected the first sample as average, got %s", average)
+	}
+
+	latencies.observe("server1:8080", 200*time.Millisecond)
+	if average := latencies.get("server1:8080"); average != 150*time.Millisecond {
+		t.Errorf("Expected average 150ms, got %s", average)
+	}
+}
+
+func TestLeastTimeStrategy(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080", "server3:8080"}
+	latencies := newLatencyTracker(0.5, 0)
+	strategy := &leastTimeStrategy{latencies: latencies}
+
+	latencies.observe("server1:8080", 30*time.Millisecond)
+	latencies.observe("server2:8080", 10*time.Millisecond)
+	if server := strategy.Choose("client", servers); server != "server3:8080" {
+		t.Errorf("Expected unmeasured server3:8080 to be tried, got %s", server)
+	}
+
+	latencies.observe("server3:8080", 20*time.Millisecond)
+	if server := strategy.Choose("client", servers); server != "server2:8080" {
+		t.Errorf("Expected fastest server2:8080, got %s", server)
+	}
+
+	// A delay on the fastest server shifts traffic away within a few
+	// responses.
+	for i := 0; i < 3; i++ {
+		latencies.observe("server2:8080", time.Second)
+	}
+	if server := strategy.Choose("client", servers); server != "server3:8080" {
+		t.Errorf("Expected server3:8080 after server2:8080 slowed down, got %s", server)
+	}
+}
+
+func TestLeastTimeStrategyRetriesSlowServer(t *testing.T) {
+	servers := []string{"server1:8080", "server2:8080"}
+	latencies := newLatencyTracker(0.5, 10*time.Second)
+	now := time.Now()
+	latencies.now = func() time.Time { return now }
+	strategy := &leastTimeStrategy{latencies: latencies}
+
+	latencies.observe("server1:8080", time.Second)
+	latencies.observe("server2:8080", 100*time.Millisecond)
+	if server := strategy.Choose("client", servers); server != "server2:8080" {
+		t.Fatalf("Expected fastest server2:8080, got %s", server)
+	}
+
+	// server2 keeps getting fresh samples while server1 gets none, until
+	// its average has decayed below server2's.
+	for i := 0; i < 40 && strategy.Choose("client", servers) == "server2:8080"; i++ {
+		now = now.Add(time.Second)
+		latencies.observe("server2:8080", 100*time.Millisecond)
+	}
+	if server := strategy.Choose("client", servers); server != "server1:8080" {
+		t.Fatalf("Expected slow server1:8080 to be tried again, got %s", server)
+	}
+
+	// Once it has recovered, it keeps its share.
+	latencies.observe("server1:8080", 50*time.Millisecond)
+	if server := strategy.Choose("client", servers); server != "server1:8080" {
+		t.Errorf("Expected recovered server1:8080 to be chosen, got %s", server)
+	}
+}
+
+func TestConnectionCounterTryAcquire(t *testing.T) {
+	connections := newConnectionCounter()
+
+	if !connections.tryAcquire("server1:8080", 2) || !connections.tryAcquire("server1:8080", 2) {
+		t.Fatal("Expected two requests to fit under the limit")
+	}
+	if connections.tryAcquire("server1:8080", 2) {
+		t.Error("Expected the third request to be rejected")
+	}
+	connections.release("server1:8080")
+	if !connections.tryAcquire("server1:8080", 2) {
+		t.Error("Expected a released slot to be available again")
+	}
+	if !connections.tryAcquire("server1:8080", 0) {
+		t.Error("Expected no limit for zero")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds the cache, since keys come from the query.
+const maxCacheEntries = 10000
+
+// dataCache is disabled until main configures it from the flags.
+var dataCache = newSomeDataCache(0, fetchSomeData)
+
+type fetchFunc func(ctx context.Context, key, requestID string) (Response, bool, error)
+
+type cachedData struct {
+	data       Response
+	found      bool
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+// someDataCache keeps DB responses for ttl. A value older than that is still
+// served for another ttl while it is refreshed in the background; keys the DB
+// did not have are fetched again as soon as they expire. DB errors are never
+// cached. Concurrent fetches of a key are coalesced into one DB request.
+type someDataCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	fetch   fetchFunc
+	flights fetchGroup
+	entries map[string]*cachedData
+	// versions counts the invalidations of every key, so that a fetch that
+	// started before a write neither stores the old value afterwards nor
+	// shares it with callers that came after the write.
+	versions map[string]uint64
+	now      func() time.Time
+}
+
+// newSomeDataCache creates a cache in front of fetch. A ttl of zero disables
+// caching.
+func newSomeDataCache(ttl time.Duration, fetch fetchFunc) *someDataCache {
+	return &someDataCache{
+		ttl:      ttl,
+		fetch:    fetch,
+		entries:  make(map[string]*cachedData),
+		versions: make(map[string]uint64),
+		now:      time.Now,
+	}
+}
+
+// get returns the data of the key and whether the DB has it.
+func (c *someDataCache) get(ctx context.Context, key, requestID string) (Response, bool, error) {
+	c.mu.Lock()
+	version := c.versions[key]
+	if c.ttl <= 0 {
+		c.mu.Unlock()
+		return c.flights.do(ctx, key, version, requestID, c.fetch)
+	}
+
+	if entry := c.entries[key]; entry != nil {
+		age := c.now().Sub(entry.fetchedAt)
+		if age < c.ttl {
+			c.mu.Unlock()
+			return entry.data, entry.found, nil
+		}
+		if entry.found && age < 2*c.ttl {
+			if !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(key, version)
+			}
+			c.mu.Unlock()
+			return entry.data, entry.found, nil
+		}
+	}
+	c.mu.Unlock()
+
+	data, found, err := c.flights.do(ctx, key, version, requestID, c.fetch)
+	if err == nil {
+		c.store(key, version, data, found)
+	}
+	return data, found, err
+}
+
+func (c *someDataCache) refresh(key string, version uint64) {
+	data, found, err := c.flights.do(context.Background(), key, version, "", c.fetch)
+	if err != nil {
+		log.Printf("Failed to refresh cached %q: %v", key, err)
+		c.mu.Lock()
+		if entry := c.entries[key]; entry != nil {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.store(key, version, data, found)
+}
+
+func (c *someDataCache) store(key string, version uint64, data Response, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.versions[key] != version {
+		return
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		c.evictExpired()
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = &cachedData{data: data, found: found, fetchedAt: c.now()}
+}
+
+// evictExpired drops the entries that get would no longer serve.
+func (c *someDataCache) evictExpired() {
+	for key, entry := range c.entries {
+		if c.now().Sub(entry.fetchedAt) >= 2*c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// invalidate drops the key after it was written, so the next get fetches the
+// new value.
+func (c *someDataCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+	c.versions[key]++
+}
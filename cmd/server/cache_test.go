@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeDb struct {
+	mu      sync.Mutex
+	values  map[string]string
+	fetches int
+	err     error
+	fetched chan string
+}
+
+func (f *fakeDb) fetch(_ context.Context, key, _ string) (Response, bool, error) {
+	f.mu.Lock()
+	defer func() {
+		f.mu.Unlock()
+		if f.fetched != nil {
+			f.fetched <- key
+		}
+	}()
+	f.fetches++
+	if f.err != nil {
+		return Response{}, false, f.err
+	}
+	value, ok := f.values[key]
+	return Response{Key: key, Value: json.RawMessage(value)}, ok, nil
+}
+
+func (f *fakeDb) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[key] = value
+}
+
+func (f *fakeDb) fetchCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches
+}
+
+func newTestCache(db *fakeDb) (*someDataCache, *time.Time) {
+	now := time.Unix(0, 0)
+	cache := newSomeDataCache(time.Minute, db.fetch)
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+func expectValue(t *testing.T, cache *someDataCache, key, expected string) {
+	t.Helper()
+	data, found, err := cache.get(context.Background(), key, "")
+	if err != nil || !found || string(data.Value) != expected {
+		t.Errorf("Expected %s=%s, got %q found=%t (%v)", key, expected, data.Value, found, err)
+	}
+}
+
+func TestCacheServesFreshValues(t *testing.T) {
+	db := &fakeDb{values: map[string]string{"key": "v1"}}
+	cache, now := newTestCache(db)
+
+	expectValue(t, cache, "key", "v1")
+	db.set("key", "v2")
+	*now = now.Add(30 * time.Second)
+	expectValue(t, cache, "key", "v1")
+
+	if db.fetchCount() != 1 {
+		t.Errorf("Expected a single DB fetch, got %d", db.fetchCount())
+	}
+}
+
+func TestCacheRefreshesStaleValuesInBackground(t *testing.T) {
+	db := &fakeDb{values: map[string]string{"key": "v1"}, fetched: make(chan string, 10)}
+	cache, now := newTestCache(db)
+
+	expectValue(t, cache, "key", "v1")
+	<-db.fetched
+	db.set("key", "v2")
+
+	*now = now.Add(90 * time.Second)
+	expectValue(t, cache, "key", "v1")
+	select {
+	case <-db.fetched:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a background refresh")
+	}
+
+	// The refresh stores its result right after fetching.
+	for i := 0; i < 100; i++ {
+		if data, _, _ := cache.get(context.Background(), "key", ""); string(data.Value) == "v2" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expectValue(t, cache, "key", "v2")
+	if db.fetchCount() != 2 {
+		t.Errorf("Expected one refresh, got %d fetches", db.fetchCount())
+	}
+
+	*now = now.Add(3 * time.Minute)
+	db.set("key", "v3")
+	expectValue(t, cache, "key", "v3")
+}
+
+func TestCacheRefetchesMissingKeys(t *testing.T) {
+	db := &fakeDb{values: map[string]string{}}
+	cache, now := newTestCache(db)
+
+	if _, found, err := cache.get(context.Background(), "key", ""); found || err != nil {
+		t.Fatalf("Expected a missing key, got found=%t (%v)", found, err)
+	}
+	db.set("key", "v1")
+	*now = now.Add(61 * time.Second)
+	expectValue(t, cache, "key", "v1")
+}
+
+func TestCacheDoesNotKeepErrors(t *testing.T) {
+	db := &fakeDb{values: map[string]string{"key": "v1"}, err: errors.New("DB down")}
+	cache, _ := newTestCache(db)
+
+	if _, _, err := cache.get(context.Background(), "key", ""); err == nil {
+		t.Fatal("Expected the DB error")
+	}
+	db.mu.Lock()
+	db.err = nil
+	db.mu.Unlock()
+	expectValue(t, cache, "key", "v1")
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	db := &fakeDb{values: map[string]string{"key": "v1"}}
+	cache, _ := newTestCache(db)
+
+	expectValue(t, cache, "key", "v1")
+	db.set("key", "v2")
+	cache.invalidate("key")
+	expectValue(t, cache, "key", "v2")
+
+	// A fetch that started before the write must not be stored after it.
+	version := cache.versions["key"]
+	cache.invalidate("key")
+	cache.store("key", version, Response{Key: "key", Value: json.RawMessage("old")}, true)
+	expectValue(t, cache, "key", "v2")
+}
+
+func TestFetchGroupCoalescesConcurrentFetches(t *testing.T) {
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	fetch := func(ctx context.Context, key, _ string) (Response, bool, error) {
+		fetches.Add(1)
+		<-release
+		return Response{Key: key, Value: json.RawMessage("value")}, true, nil
+	}
+
+	var group fetchGroup
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, found, err := group.do(context.Background(), "key", 0, "", fetch)
+			if err != nil || !found || string(data.Value) != "value" {
+				t.Errorf("Expected the shared value, got %q found=%t (%v)", data.Value, found, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches.Load() != 1 {
+		t.Errorf("Expected a single DB fetch, got %d", fetches.Load())
+	}
+}
+
+func TestFetchGroupCancelsOnlyWhenAllWaitersLeave(t *testing.T) {
+	cancelled := make(chan struct{})
+	fetch := func(ctx context.Context, key, _ string) (Response, bool, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return Response{}, false, ctx.Err()
+	}
+
+	var group fetchGroup
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	results := make(chan error, 2)
+	for _, ctx := range []context.Context{first, second} {
+		go func() {
+			_, _, err := group.do(ctx, "key", 0, "", fetch)
+			results <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	cancelFirst()
+	<-results
+	select {
+	case <-cancelled:
+		t.Fatal("The fetch was cancelled while a caller still waited for it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	<-results
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the fetch to be cancelled once every caller left")
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/bndrchuk-artem/trenbolonchiki-lab5/httptools"
@@ -17,22 +21,54 @@ import (
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
-const teamName = "trenbolonchiki"
+const defaultTeamName = "trenbolonchiki"
 
 var port = flag.Int("port", 8080, "server port")
 var dbHost = flag.String("db-host", "db:8082", "database host:port")
+var teamName = flag.String("team", defaultTeamName, "team name used as the seeded key and the default key of some-data")
+var seedValue = flag.String("value", "", "value seeded for the team (defaults to the current date)")
+var dateFormat = flag.String("date-format", "2006-01-02", "Go time layout of the seeded date when -value is not set")
+var dbTimeoutSec = flag.Int("db-timeout-sec", 3, "timeout of DB requests in seconds")
+var dbInitAttempts = flag.Int("db-init-attempts", 10, "how many times to try seeding the team data before giving up")
+var dbInitIntervalSec = flag.Int("db-init-interval-sec", 1, "delay before the second seeding attempt in seconds, doubled after each failure")
+var cacheTTL = flag.Duration("cache-ttl", 0, "how long DB responses of some-data are cached, e.g. 30s (0 disables the cache)")
+var shutdownSec = flag.Int("shutdown-grace-sec", 10, "how long in-flight requests may take to finish on shutdown")
 
+const maxDbInitInterval = 30 * time.Second
+
+// errDbRejected marks DB responses that retrying will not fix.
+var errDbRejected = errors.New("request rejected by DB")
+
+var errInvalidKey = errors.New("invalid key")
+
+// teamDataSeeded is set once the team data is in the DB.
+var teamDataSeeded atomic.Bool
+
+// dbClient is used for all DB requests. Its timeout is set from the flag in
+// main, so a slow DB cannot hold server goroutines indefinitely.
+var dbClient = &http.Client{}
+
+// Response is a key with its value as read from the DB. The value is kept as
+// the raw JSON the DB returned, so numbers, objects and booleans are passed
+// through as such rather than only strings.
 type Response struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
 }
 
 func main() {
 	flag.Parse()
+	dbClient.Timeout = time.Duration(*dbTimeoutSec) * time.Second
+	dataCache = newSomeDataCache(*cacheTTL, fetchSomeData)
 
-	if err := initializeTeamData(); err != nil {
-		log.Printf("Failed to initialize team data: %v", err)
-	}
+	// The team data is seeded in the background, so the server is live while
+	// the DB comes up; /ready tells when it can take requests.
+	interval := time.Duration(*dbInitIntervalSec) * time.Second
+	go func() {
+		if err := initializeTeamDataWithRetry(*dbInitAttempts, interval); err != nil {
+			log.Printf("Failed to initialize team data: %v", err)
+		}
+	}()
 
 	h := new(http.ServeMux)
 
@@ -47,34 +83,94 @@ func main() {
 		}
 	})
 
+	h.HandleFunc("/ready", handleReady)
+
 	report := make(Report)
 
-	h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
+	h.HandleFunc("/api/v1/some-data", handleSomeData(report))
+
+	h.Handle("/report", report)
+
+	server := httptools.CreateServer(*port, h)
+	server.Start()
+	signal.WaitForTerminationSignal()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownSec)*time.Second)
+	defer cancel()
+	if err := server.Stop(ctx); err != nil {
+		log.Printf("In-flight requests did not finish in time: %v", err)
+	}
+}
+
+// handleReady responds with 200 once the team data is seeded and while the DB
+// answers its health check, so traffic is only routed to a server that can
+// serve it. /health stays a pure liveness probe.
+func handleReady(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("content-type", "text/plain")
+	if !teamDataSeeded.Load() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("team data not seeded"))
+		return
+	}
+	if err := checkDb(r.Context()); err != nil {
+		log.Printf("DB is not ready: %v", err)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("DB unavailable"))
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte("OK"))
+}
+
+func checkDb(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/health", *dbHost), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dbClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DB health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleSomeData serves the value of the key query parameter, or of the team
+// key by default, as read from the DB. POST requests are written through to
+// the DB instead.
+func handleSomeData(report Report) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			writeSomeData(rw, r)
+			return
+		}
+
 		key := r.URL.Query().Get("key")
 		if key == "" {
-			key = teamName
+			key = *teamName
 		}
+		id := r.Header.Get(httptools.RequestIDHeader)
+		log.Printf("GET some-data %q, request ID [%s]", key, id)
 
-		dbResp, err := http.Get(fmt.Sprintf("http://%s/db/%s", *dbHost, key))
+		// The client context aborts the DB request when the client goes away.
+		dbData, found, err := dataCache.get(r.Context(), key, id)
+		if errors.Is(err, errInvalidKey) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to fetch from DB: %v", err)
+			log.Printf("Failed to fetch from DB, request ID [%s]: %v", id, err)
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		defer dbResp.Body.Close()
-
-		if dbResp.StatusCode == http.StatusNotFound {
+		if !found {
 			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		var dbData Response
-		if err := json.NewDecoder(dbResp.Body).Decode(&dbData); err != nil {
-			log.Printf("Failed to decode DB response: %v", err)
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
 		respDelayString := os.Getenv(confResponseDelaySec)
 		if delaySec, parseErr := time.ParseDuration(respDelayString + "s"); parseErr == nil && delaySec > 0 {
 			time.Sleep(delaySec)
@@ -84,24 +180,105 @@ func main() {
 
 		rw.Header().Set("content-type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(rw).Encode(map[string]string{
-			"key":   dbData.Key,
-			"value": dbData.Value,
-		})
-	})
+		_ = json.NewEncoder(rw).Encode(dbData)
+	}
+}
 
-	h.Handle("/report", report)
+// fetchSomeData reads the key from the DB and reports whether the DB has it.
+func fetchSomeData(ctx context.Context, key, requestID string) (Response, bool, error) {
+	var dbData Response
+	dbReq, err := http.NewRequestWithContext(ctx, http.MethodGet, dbURL(key), nil)
+	if err != nil {
+		return dbData, false, fmt.Errorf("%w: %w", errInvalidKey, err)
+	}
+	setRequestID(dbReq, requestID)
+	dbResp, err := dbClient.Do(dbReq)
+	if err != nil {
+		return dbData, false, err
+	}
+	defer dbResp.Body.Close()
 
-	server := httptools.CreateServer(*port, h)
-	server.Start()
-	signal.WaitForTerminationSignal()
+	if dbResp.StatusCode == http.StatusNotFound {
+		return dbData, false, nil
+	}
+	if err := json.NewDecoder(dbResp.Body).Decode(&dbData); err != nil {
+		return dbData, false, fmt.Errorf("failed to decode DB response: %w", err)
+	}
+	return dbData, true, nil
+}
+
+// writeSomeData forwards the JSON body to the DB under the key query parameter
+// and responds with the status code of the DB.
+func writeSomeData(rw http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id := r.Header.Get(httptools.RequestIDHeader)
+	log.Printf("POST some-data %q, request ID [%s]", key, id)
+
+	dbReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, dbURL(key), r.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dbReq.Header.Set("content-type", "application/json")
+	setRequestID(dbReq, id)
+	dbResp, err := dbClient.Do(dbReq)
+	if err != nil {
+		log.Printf("Failed to write to DB, request ID [%s]: %v", id, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer dbResp.Body.Close()
+
+	if dbResp.StatusCode < http.StatusMultipleChoices {
+		dataCache.invalidate(key)
+	}
+	rw.WriteHeader(dbResp.StatusCode)
+	_, _ = io.Copy(rw, dbResp.Body)
+}
+
+// dbURL is the DB URL of the key. The key is escaped, so that characters like
+// '/', '?' or '%' end up in the key rather than changing the request.
+func dbURL(key string) string {
+	return fmt.Sprintf("http://%s/db/%s", *dbHost, url.PathEscape(key))
+}
+
+// setRequestID passes the ID of the incoming request on to the DB.
+func setRequestID(dbReq *http.Request, id string) {
+	if id != "" {
+		dbReq.Header.Set(httptools.RequestIDHeader, id)
+	}
+}
+
+// initializeTeamDataWithRetry seeds the team data, waiting for the DB to come
+// up with exponential backoff between attempts.
+func initializeTeamDataWithRetry(attempts int, interval time.Duration) error {
+	var err error
+	attempts = max(attempts, 1)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+			interval = min(2*interval, maxDbInitInterval)
+		}
+		if err = initializeTeamData(); err == nil || errors.Is(err, errDbRejected) {
+			return err
+		}
+		log.Printf("Attempt %d to initialize team data: %v", i+1, err)
+	}
+	return fmt.Errorf("DB is not reachable after %d attempts: %w", attempts, err)
 }
 
 func initializeTeamData() error {
-	currentDate := time.Now().Format("2006-01-02")
+	value := *seedValue
+	if value == "" {
+		value = time.Now().Format(*dateFormat)
+	}
 
 	payload := map[string]interface{}{
-		"value": currentDate,
+		"value": value,
 	}
 
 	jsonData, err := json.Marshal(payload)
@@ -109,8 +286,7 @@ func initializeTeamData() error {
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	dbURL := fmt.Sprintf("http://%s/db/%s", *dbHost, teamName)
-	resp, err := http.Post(dbURL, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := dbClient.Post(dbURL(*teamName), "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to post to DB: %w", err)
 	}
@@ -118,9 +294,14 @@ func initializeTeamData() error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("DB returned status %d: %s", resp.StatusCode, string(body))
+		err := fmt.Errorf("DB returned status %d: %s", resp.StatusCode, string(body))
+		if resp.StatusCode < http.StatusInternalServerError {
+			err = fmt.Errorf("%w: %w", errDbRejected, err)
+		}
+		return err
 	}
 
-	log.Printf("Successfully initialized team data for '%s' with date: %s", teamName, currentDate)
+	log.Printf("Successfully initialized team data for '%s' with value: %s", *teamName, value)
+	teamDataSeeded.Store(true)
 	return nil
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bndrchuk-artem/trenbolonchiki-lab5/httptools"
+)
+
+func setDbHost(t *testing.T, host string) {
+	t.Helper()
+	previous := *dbHost
+	*dbHost = host
+	t.Cleanup(func() { *dbHost = previous })
+}
+
+func TestInitializeTeamDataRetries(t *testing.T) {
+	var attempts atomic.Int32
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer db.Close()
+	setDbHost(t, strings.TrimPrefix(db.URL, "http://"))
+
+	if err := initializeTeamDataWithRetry(5, time.Millisecond); err != nil {
+		t.Fatalf("Expected seeding to succeed after retries: %v", err)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestInitializeTeamDataGivesUp(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	setDbHost(t, strings.TrimPrefix(unreachable.URL, "http://"))
+	unreachable.Close()
+
+	if err := initializeTeamDataWithRetry(3, time.Millisecond); err == nil {
+		t.Error("Expected error when the DB is unreachable")
+	}
+}
+
+func TestInitializeTeamDataDoesNotRetryRejection(t *testing.T) {
+	var attempts atomic.Int32
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer db.Close()
+	setDbHost(t, strings.TrimPrefix(db.URL, "http://"))
+
+	err := initializeTeamDataWithRetry(5, time.Millisecond)
+	if !errors.Is(err, errDbRejected) {
+		t.Errorf("Expected rejection error, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts.Load())
+	}
+}
+
+func TestInitializeTeamDataUsesFlags(t *testing.T) {
+	var path, body string
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		path, body = r.URL.Path, string(data)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer db.Close()
+	setDbHost(t, strings.TrimPrefix(db.URL, "http://"))
+
+	previousTeam, previousValue := *teamName, *seedValue
+	*teamName, *seedValue = "other-team", "custom"
+	defer func() { *teamName, *seedValue = previousTeam, previousValue }()
+
+	if err := initializeTeamData(); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/db/other-team" || body != `{"value":"custom"}` {
+		t.Errorf("Unexpected seed request %s %s", path, body)
+	}
+}
+
+func TestSomeDataAbortsDbFetchOnCancel(t *testing.T) {
+	aborted := make(chan struct{})
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer db.Close()
+	setDbHost(t, strings.TrimPrefix(db.URL, "http://"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=key", nil).WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	rec := httptest.NewRecorder()
+	handleSomeData(make(Report))(rec, req)
+
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the DB request to be aborted with the client request")
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for an aborted fetch, got %d", rec.Code)
+	}
+}
+
+func TestSomeDataPassesThroughTypedValues(t *testing.T) {
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		switch r.URL.Path {
+		case "/db/count":
+			_, _ = rw.Write([]byte(`{"key":"count","value":42}`))
+		case "/db/settings":
+			_, _ = rw.Write([]byte(`{"key":"settings","value":{"enabled":true}}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer db.Close()
+	setDbHost(t, strings.TrimPrefix(db.URL, "http://"))
+
+	handler := handleSomeData(make(Report))
+	for key, expected := range map[string]string{
+		"count":    `{"key":"count","value":42}`,
+		"settings": `{"key":"settings","value":{"enabled":true}}`,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key="+key, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected 200 for %s, got %d", key, rec.Code)
+		}
+		if body := strings.TrimSpace(rec.Body.String()); body != expected {
+			t.Errorf("Expected %s, got %s", expected, body)
+		}
+	}
+}
+
+func TestSomeDataWriteThrough(t *testing.T) {
+	var path, body, id string
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		path, body = r.URL.Path, string(data)
+		id = r.Header.Get(httptools.RequestIDHeader)
+		if strings.Contains(body, "bad") {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer db.Close()
+	setDbHost(t, strings.TrimPrefix(db.URL, "http://"))
+
+	handler := handleSomeData(make(Report))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/some-data?key=key", strings.NewReader(`{"value":42}`))
+	req.Header.Set(httptools.RequestIDHeader, "request-1")
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", rec.Code)
+	}
+	if path != "/db/key" || body != `{"value":42}` {
+		t.Errorf("Unexpected DB request %s %s", path, body)
+	}
+	if id != "request-1" {
+		t.Errorf("Expected the request ID to be passed to the DB, got %q", id)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/some-data?key=key", strings.NewReader(`bad`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the DB status to be passed through, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/some-data", strings.NewReader(`{"value":1}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a key, got %d", rec.Code)
+	}
+}
+
+func TestSomeDataEscapesKeys(t *testing.T) {
+	values := make(map[string]json.RawMessage)
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/db/")
+		if r.Method == http.MethodPost {
+			var body struct {
+				Value json.RawMessage `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			values[key] = body.Value
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+		value, ok := values[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(Response{Key: key, Value: value})
+	}))
+	defer db.Close()
+	setDbHost(t, strings.TrimPrefix(db.URL, "http://"))
+
+	handler := handleSomeData(make(Report))
+	key := "a/b?c#d%e"
+	target := "/api/v1/some-data?key=" + url.QueryEscape(key)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"value":{"count":1}}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if _, ok := values[key]; !ok {
+		t.Fatalf("Expected the DB to get the whole key %q, got %v", key, values)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	expected := `{"key":"a/b?c#d%e","value":{"count":1}}`
+	if body := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || body != expected {
+		t.Errorf("Expected 200 %s, got %d %s", expected, rec.Code, body)
+	}
+}
+
+func TestReady(t *testing.T) {
+	dbHealthy := true
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && !dbHealthy {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer db.Close()
+	setDbHost(t, strings.TrimPrefix(db.URL, "http://"))
+	teamDataSeeded.Store(false)
+	defer teamDataSeeded.Store(false)
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		handleReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return rec.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the team data is seeded, got %d", code)
+	}
+
+	if err := initializeTeamData(); err != nil {
+		t.Fatal(err)
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("Expected 200 once seeded, got %d", code)
+	}
+
+	dbHealthy = false
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while the DB is unhealthy, got %d", code)
+	}
+}
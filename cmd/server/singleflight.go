@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	data  Response
+	found bool
+	err   error
+}
+
+// fetchGroup coalesces concurrent fetches of the same key into one DB
+// request whose result every caller shares. The shared request is cancelled
+// only once every caller waiting for it has gone away.
+//
+// Only fetches of the same version of the key are coalesced, so a caller never
+// gets a value read before the key was last invalidated.
+type fetchGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+type flightKey struct {
+	key     string
+	version uint64
+}
+
+func (g *fetchGroup) do(ctx context.Context, key string, version uint64, requestID string, fetch fetchFunc) (Response, bool, error) {
+	id := flightKey{key, version}
+
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[flightKey]*flight)
+	}
+	f := g.flights[id]
+	if f == nil {
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[id] = f
+		go g.run(fetchCtx, f, id, requestID, fetch)
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.data, f.found, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Later callers must not join the cancelled fetch.
+			f.cancel()
+			g.forget(id, f)
+		}
+		g.mu.Unlock()
+		return Response{}, false, ctx.Err()
+	}
+}
+
+func (g *fetchGroup) run(ctx context.Context, f *flight, id flightKey, requestID string, fetch fetchFunc) {
+	f.data, f.found, f.err = fetch(ctx, id.key, requestID)
+	f.cancel()
+
+	g.mu.Lock()
+	g.forget(id, f)
+	g.mu.Unlock()
+	close(f.done)
+}
+
+func (g *fetchGroup) forget(id flightKey, f *flight) {
+	if g.flights[id] == f {
+		delete(g.flights, id)
+	}
+}
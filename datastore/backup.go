@@ -0,0 +1,134 @@
+package datastore
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backup writes a consistent snapshot of every segment to w as a tar stream
+// while the database keeps serving reads and writes. Segments other than the
+// active one are immutable and are copied whole; the active segment is copied
+// up to its size at the moment the snapshot was taken.
+func (db *Db) Backup(w io.Writer) error {
+	segments, sizes, err := db.acquireSegments()
+	if err != nil {
+		return err
+	}
+	defer releaseSegments(segments)
+
+	archive := tar.NewWriter(w)
+	for i, segment := range segments {
+		if err := writeSegmentToArchive(archive, db.storage, segment.path, sizes[i]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// acquireSegments acquires every segment, oldest first, while writes are held
+// off. It returns the size of the active segment at that moment, so that only
+// complete records are read from it, and -1 for the immutable segments. The
+// caller must release the segments.
+func (db *Db) acquireSegments() ([]*Segment, []int64, error) {
+	db.closeMutex.Lock()
+	defer db.closeMutex.Unlock()
+	if db.closed {
+		return nil, nil, fmt.Errorf("database is closed")
+	}
+
+	db.fileLock.Lock()
+	defer db.fileLock.Unlock()
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+
+	segments := make([]*Segment, len(db.segments))
+	sizes := make([]int64, len(db.segments))
+	copy(segments, db.segments)
+	for i, segment := range segments {
+		segment.acquire()
+		sizes[i] = -1
+	}
+	if len(segments) > 0 && !db.readOnly {
+		sizes[len(sizes)-1] = db.currentOffset
+	}
+	return segments, sizes, nil
+}
+
+func releaseSegments(segments []*Segment) {
+	for _, segment := range segments {
+		segment.release()
+	}
+}
+
+// writeSegmentToArchive adds the segment file to the archive, limited to size
+// bytes unless size is negative.
+func writeSegmentToArchive(archive *tar.Writer, store storage, path string, size int64) error {
+	file, err := store.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if size < 0 {
+		if size, err = file.Size(); err != nil {
+			return err
+		}
+	}
+
+	header := &tar.Header{
+		Name:    filepath.Base(path),
+		Mode:    defaultFileMode,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, io.LimitReader(file, size))
+	return err
+}
+
+// Restore extracts a backup written by Backup into directory, which can then
+// be opened with CreateDb. The directory must not already hold segments of the
+// same name.
+func Restore(r io.Reader, directory string) error {
+	if err := os.MkdirAll(directory, defaultDirMode); err != nil {
+		return err
+	}
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Base(header.Name)
+		if header.Typeflag != tar.TypeReg || name != header.Name {
+			return fmt.Errorf("unexpected entry %q in backup", header.Name)
+		}
+
+		file, err := os.OpenFile(filepath.Join(directory, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, defaultFileMode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, archive)
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return syncDirectory(directory)
+}
@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDb_BackupAndRestore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "backup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(filepath.Join(tempDir, "source"), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	pairs := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		pairs[key] = fmt.Sprintf("value_%d", i)
+		if err := database.Put(key, pairs[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			database.Put(fmt.Sprintf("concurrent_%d", i), "value")
+		}
+	}()
+
+	var archive bytes.Buffer
+	if err := database.Backup(&archive); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	wg.Wait()
+
+	restoreDir := filepath.Join(tempDir, "restored")
+	if err := Restore(&archive, restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	restored, err := createTestDatabase(restoreDir, 200)
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer restored.Close()
+
+	for key, expectedValue := range pairs {
+		value, err := restored.Get(key)
+		if err != nil {
+			t.Errorf("Failed to get key %s from restored database: %v", key, err)
+		} else if value != expectedValue {
+			t.Errorf("Value mismatch for key %s: expected %s, got %s", key, expectedValue, value)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// bucketSeparator joins a bucket name and a key into the stored key. Keys
+// outside of any bucket may not contain it, so the two never collide.
+const bucketSeparator = "\x00"
+
+// ValidateKey returns an error wrapping ErrInvalidKey if key cannot be stored
+// outside of a bucket.
+func ValidateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: key must not be empty", ErrInvalidKey)
+	}
+	if len(key) > MaxKeySize {
+		return fmt.Errorf("%w: key of %d bytes exceeds the maximum key size of %d bytes", ErrInvalidKey, len(key), MaxKeySize)
+	}
+	if strings.Contains(key, bucketSeparator) {
+		return fmt.Errorf("%w: key must not contain the bucket separator byte", ErrInvalidKey)
+	}
+	return nil
+}
+
+// isBucketKey reports whether a stored key belongs to a bucket.
+func isBucketKey(key string) bool {
+	return strings.Contains(key, bucketSeparator)
+}
+
+func bucketKey(bucket, key string) (string, error) {
+	if bucket == "" || strings.Contains(bucket, bucketSeparator) {
+		return "", fmt.Errorf("%w: invalid bucket name %q", ErrInvalidKey, bucket)
+	}
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+	storedKey := bucket + bucketSeparator + key
+	if len(storedKey) > MaxKeySize {
+		return "", fmt.Errorf("%w: bucket and key of %d bytes exceed the maximum key size of %d bytes", ErrInvalidKey, len(storedKey), MaxKeySize)
+	}
+	return storedKey, nil
+}
+
+// PutInBucket stores the value under key within the named bucket. Buckets
+// share segments and compaction with the default, unnamed bucket, but their
+// keys are left out of Keys, Count, GetRange and Stats, which cover the
+// default bucket only. WithMaxKeys limits the keys of all buckets together.
+func (db *Db) PutInBucket(bucket, key, value string) error {
+	storedKey, err := bucketKey(bucket, key)
+	if err != nil {
+		return err
+	}
+	return db.submitWrite(context.Background(), WriteOperation{
+		data: entry{
+			key:   storedKey,
+			value: value,
+		},
+	})
+}
+
+func (db *Db) GetFromBucket(bucket, key string) (string, error) {
+	storedKey, err := bucketKey(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	return db.Get(storedKey)
+}
+
+func (db *Db) DeleteFromBucket(bucket, key string) error {
+	storedKey, err := bucketKey(bucket, key)
+	if err != nil {
+		return err
+	}
+	return db.deleteKey(storedKey)
+}
+
+// Buckets returns the sorted names of buckets holding at least one key.
+func (db *Db) Buckets() []string {
+	seen := make(map[string]bool)
+	var buckets []string
+	for _, key := range db.liveKeys() {
+		bucket, _, found := strings.Cut(key, bucketSeparator)
+		if found && !seen[bucket] {
+			seen[bucket] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Buckets(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "bucket_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if err := database.Put("key", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutInBucket("team-a", "key", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutInBucket("team-b", "key", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"team-a": "a", "team-b": "b"}
+	for bucket, expectedValue := range expected {
+		value, err := database.GetFromBucket(bucket, "key")
+		if err != nil {
+			t.Errorf("Failed to get key from bucket %s: %v", bucket, err)
+		} else if value != expectedValue {
+			t.Errorf("Value mismatch in bucket %s: expected %s, got %s", bucket, expectedValue, value)
+		}
+	}
+
+	if value, err := database.Get("key"); err != nil || value != "default" {
+		t.Errorf("Default bucket should be unaffected, got %q, %v", value, err)
+	}
+
+	if buckets := database.Buckets(); !reflect.DeepEqual(buckets, []string{"team-a", "team-b"}) {
+		t.Errorf("Unexpected buckets: %v", buckets)
+	}
+
+	if err := database.DeleteFromBucket("team-a", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.GetFromBucket("team-a", "key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound after delete, got %v", err)
+	}
+	if buckets := database.Buckets(); !reflect.DeepEqual(buckets, []string{"team-b"}) {
+		t.Errorf("Emptied bucket should not be listed: %v", buckets)
+	}
+
+	if err := database.Put("bad\x00key", "value"); err == nil {
+		t.Error("Expected default-bucket key containing the separator to be rejected")
+	}
+	if err := database.Delete("team-b\x00key"); err == nil {
+		t.Error("Expected a delete of a bucket-internal key to be rejected")
+	}
+	if value, err := database.GetFromBucket("team-b", "key"); err != nil || value != "b" {
+		t.Errorf("Expected the bucket key to survive the rejected delete, got %q, %v", value, err)
+	}
+	if err := database.Put("", "value"); err == nil {
+		t.Error("Expected an empty key to be rejected")
+	}
+	if err := database.Delete(""); err == nil {
+		t.Error("Expected a delete of an empty key to be rejected")
+	}
+	if err := database.PutInBucket("", "key", "value"); err == nil {
+		t.Error("Expected empty bucket name to be rejected")
+	}
+}
+
+func TestDb_BucketKeysNotListed(t *testing.T) {
+	storage := NewMemoryStorage()
+	database, err := CreateDb("mem", WithMemoryStorage(storage), WithMaxKeys(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.Put("key", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutInBucket("team", "key", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutInBucket("team", "other", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		if keys := database.Keys(); !reflect.DeepEqual(keys, []string{"key"}) {
+			t.Errorf("%s: expected only the default bucket's keys, got %q", when, keys)
+		}
+		if count := database.Count(); count != 1 {
+			t.Errorf("%s: expected a count of 1, got %d", when, count)
+		}
+		if pairs, err := database.GetRange(0, 10); err != nil || !reflect.DeepEqual(pairs, []KV{{Key: "key", Value: "default"}}) {
+			t.Errorf("%s: expected only the default bucket's pairs, got %v, %v", when, pairs, err)
+		}
+		if stats, err := database.Stats(); err != nil || stats.Keys != 1 {
+			t.Errorf("%s: expected stats to count the keys Count does, got %d, %v", when, stats.Keys, err)
+		}
+	}
+	check("after writing")
+
+	if err := database.Put("another", "value"); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Expected bucket keys to count towards the key limit, got %v", err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err = CreateDb("mem", WithMemoryStorage(storage), WithMaxKeys(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	check("after reopening")
+
+	if err := database.DeleteFromBucket("team", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("another", "value"); err != nil {
+		t.Errorf("Expected a key to fit after deleting from a bucket, got %v", err)
+	}
+	if count := database.Count(); count != 2 {
+		t.Errorf("Expected a count of 2, got %d", count)
+	}
+}
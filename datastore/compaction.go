@@ -0,0 +1,522 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	compactionSuffix = ".compact"
+	manifestSuffix   = ".manifest"
+	partSeparator    = "_"
+)
+
+// segmentName is the parsed name of a segment file: the file prefix followed
+// by a number, and for all but the first compaction output of a merge, a part
+// number after partSeparator. Segments are ordered by number, then part.
+type segmentName struct {
+	number int
+	part   int
+}
+
+func (n segmentName) less(other segmentName) bool {
+	if n.number != other.number {
+		return n.number < other.number
+	}
+	return n.part < other.part
+}
+
+// parseSegmentName reports the segment name of a file named prefix followed
+// by decimal digits, optionally followed by partSeparator and more digits.
+func parseSegmentName(fileName, prefix string) (segmentName, bool) {
+	rest, found := strings.CutPrefix(fileName, prefix)
+	if !found {
+		return segmentName{}, false
+	}
+
+	numberDigits, partDigits, hasPart := strings.Cut(rest, partSeparator)
+	number, ok := parseDigits(numberDigits)
+	if !ok {
+		return segmentName{}, false
+	}
+	name := segmentName{number: number}
+	if hasPart {
+		if name.part, ok = parseDigits(partDigits); !ok {
+			return segmentName{}, false
+		}
+	}
+	return name, true
+}
+
+// validateFilePrefix rejects prefixes that would let a store with a shorter
+// prefix claim this store's files. Segment names only add digits and
+// partSeparator to the prefix, so a prefix ending in neither cannot be
+// mistaken for a shorter prefix followed by a segment number.
+func validateFilePrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("empty file prefix")
+	}
+	if last := prefix[len(prefix)-1]; (last >= '0' && last <= '9') || strings.HasSuffix(prefix, partSeparator) {
+		return fmt.Errorf("invalid file prefix %q: must not end in a digit or %q", prefix, partSeparator)
+	}
+	return nil
+}
+
+func parseDigits(digits string) (int, bool) {
+	if digits == "" {
+		return 0, false
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+	}
+	number, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+// compactionWriter writes merged records into output segments of at most
+// maxSize bytes. Outputs are named after the newest merged segment with
+// increasing part numbers, so they sort after every merged segment and before
+// the active one. Outputs hold distinct keys, so their relative order does not
+// matter. Each output is written to a temporary file, fsynced and only then
+// moved to its final name in finish.
+type compactionWriter struct {
+	prefix    string
+	directory string
+	fileMode  os.FileMode
+	storage   storage
+	handles   *handleCache
+	base      segmentName
+	maxSize   int64
+	file      segmentFile
+	offset    int64
+	segments  []*Segment
+	tempPaths []string
+}
+
+func (w *compactionWriter) write(record entry) error {
+	data := record.Encode()
+	if w.file == nil || (w.offset > 0 && w.offset+int64(len(data)) > w.maxSize) {
+		if err := w.rollover(); err != nil {
+			return err
+		}
+	}
+
+	bytesWritten, err := w.file.Write(data)
+	if err != nil {
+		return err
+	}
+	w.segments[len(w.segments)-1].setPositionLocked(record.key, w.offset, record.expiresAt)
+	w.offset += int64(bytesWritten)
+	return nil
+}
+
+func (w *compactionWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+}
+
+func (w *compactionWriter) rollover() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+
+	part := w.base.part + len(w.segments) + 1
+	finalPath := filepath.Join(w.directory, fmt.Sprintf("%s%d%s%d", w.prefix, w.base.number, partSeparator, part))
+	tempPath := finalPath + compactionSuffix
+
+	file, err := w.storage.Create(tempPath, w.fileMode)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.offset = 0
+	w.tempPaths = append(w.tempPaths, tempPath)
+	w.segments = append(w.segments, &Segment{
+		path:     finalPath,
+		storage:  w.storage,
+		handles:  w.handles,
+		keyIndex: make(keyIndex),
+	})
+	return nil
+}
+
+// finish syncs the last output and moves every output to its final name.
+func (w *compactionWriter) finish() ([]*Segment, error) {
+	if err := w.closeFile(); err != nil {
+		return nil, err
+	}
+	for i, segment := range w.segments {
+		if err := w.storage.Rename(w.tempPaths[i], segment.path); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.storage.SyncDir(w.directory); err != nil {
+		return nil, err
+	}
+	return w.segments, nil
+}
+
+// abort closes and removes every output of an unfinished compaction.
+func (w *compactionWriter) abort() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	for i, tempPath := range w.tempPaths {
+		_ = w.storage.Remove(tempPath)
+		_ = w.storage.Remove(w.segments[i].path)
+	}
+}
+
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// startCompaction runs compactOldSegments in the background. At most one
+// compaction goroutine runs at a time: triggers that arrive while it runs are
+// coalesced into a single further pass over the segments created meanwhile. A
+// failed compaction leaves the segments as they were, so its error is only
+// reported.
+func (db *Db) startCompaction() {
+	db.compactionStateLock.Lock()
+	defer db.compactionStateLock.Unlock()
+
+	if db.compactionRunning {
+		db.compactionRerun = true
+		return
+	}
+	db.compactionRunning = true
+
+	db.compactionWG.Add(1)
+	go func() {
+		defer db.compactionWG.Done()
+		for {
+			if err := db.compactOldSegments(); err != nil {
+				fmt.Printf("Warning: compaction failed: %v\n", err)
+			}
+
+			db.compactionStateLock.Lock()
+			if !db.compactionRerun {
+				db.compactionRunning = false
+				db.compactionStateLock.Unlock()
+				return
+			}
+			db.compactionRerun = false
+			db.compactionStateLock.Unlock()
+		}
+	}()
+}
+
+// indexedIn reports whether any of the segments that are not missing has an
+// index entry for the key, tombstones included.
+func indexedIn(segments []*Segment, key string) bool {
+	for _, segment := range segments {
+		if segment.missing.Load() {
+			continue
+		}
+		segment.mu.RLock()
+		_, found := segment.keyIndex[key]
+		segment.mu.RUnlock()
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForCompaction blocks until every compaction started so far is done.
+// Tests use it instead of sleeping while a compaction may be running.
+func (db *Db) waitForCompaction() {
+	db.compactionWG.Wait()
+}
+
+// compactOldSegments merges every segment but the newest compactTailKeep ones,
+// the active one among them, once there are enough segments to compact.
+func (db *Db) compactOldSegments() error {
+	return db.compactSegments(db.compactTailKeep, db.compactionThreshold())
+}
+
+// compactSegments merges every segment but the newest keep ones if there are at
+// least threshold segments. The merge runs without holding segmentLock, since
+// only the active segment is written to; the segment slice is swapped under the
+// lock once the outputs are durable, and the merged segments' files are removed
+// when their last reader is done. Outputs leave out tombstones, so a manifest
+// of the merged segments is written before any of them is removed, and
+// recovery removes what a crash left of them. On error the outputs are removed
+// and the merged segments stay in place.
+func (db *Db) compactSegments(keep, threshold int) error {
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+
+	db.compactionInProgress.Store(true)
+	defer db.compactionInProgress.Store(false)
+
+	segments := db.segmentList()
+	if len(segments) < threshold {
+		return nil
+	}
+	merged := segments[:len(segments)-keep]
+
+	newest := filepath.Base(merged[len(merged)-1].path)
+	base, ok := parseSegmentName(newest, db.filePrefix)
+	if !ok {
+		return fmt.Errorf("unexpected segment name %q", newest)
+	}
+	output := &compactionWriter{
+		prefix:    db.filePrefix,
+		directory: db.directory,
+		fileMode:  db.fileMode,
+		storage:   db.storage,
+		handles:   db.handles,
+		base:      base,
+		maxSize:   db.maxSegmentSize,
+	}
+
+	keysWritten := make(map[string]bool)
+	// expired are the keys dropped for having expired. Count still counts
+	// them, unless a newer segment shadows them.
+	var expired []string
+	now := time.Now().UnixNano()
+
+	for i := len(merged) - 1; i >= 0; i-- {
+		segment := merged[i]
+		file, err := db.storage.Open(segment.path)
+		if err != nil {
+			output.abort()
+			return fmt.Errorf("open %s: %w", segment.path, err)
+		}
+		segment.mu.RLock()
+
+		for key, position := range segment.keyIndex {
+			if position == tombstonePosition {
+				// Every older segment is merged too, so the tombstone
+				// itself can be dropped once it shadows older values.
+				keysWritten[key] = true
+				continue
+			}
+			if !keysWritten[key] {
+				// Skipping an unreadable value would let an older one
+				// take its place, so the whole compaction is abandoned.
+				record, err := readRecordAt(file, position)
+				if err != nil {
+					segment.mu.RUnlock()
+					file.Close()
+					output.abort()
+					return fmt.Errorf("read %q from %s: %w", key, segment.path, err)
+				}
+
+				record.key = key
+				if record.expired(now) {
+					// Like a tombstone, an expired value is dropped
+					// along with the older values it shadows.
+					keysWritten[key] = true
+					expired = append(expired, key)
+					continue
+				}
+
+				if err := output.write(record); err != nil {
+					segment.mu.RUnlock()
+					file.Close()
+					output.abort()
+					return fmt.Errorf("write compacted segment: %w", err)
+				}
+				keysWritten[key] = true
+			}
+		}
+		segment.mu.RUnlock()
+		file.Close()
+	}
+
+	compacted, err := output.finish()
+	if err != nil {
+		output.abort()
+		return fmt.Errorf("finish compacted segments: %w", err)
+	}
+	manifestPath := filepath.Join(db.directory, fmt.Sprintf("%s%d%s%d%s", db.filePrefix, base.number, partSeparator, base.part+1, manifestSuffix))
+	if err := db.writeManifest(manifestPath, merged); err != nil {
+		output.abort()
+		return fmt.Errorf("write compaction manifest: %w", err)
+	}
+
+	db.segmentLock.Lock()
+	remaining := db.segments[len(merged):]
+	newSegments := make([]*Segment, 0, len(compacted)+len(remaining))
+	newSegments = append(newSegments, compacted...)
+	newSegments = append(newSegments, remaining...)
+	db.segments = newSegments
+	for _, key := range expired {
+		if !indexedIn(remaining, key) {
+			db.countKeyLocked(key, -1)
+		}
+	}
+	db.segmentLock.Unlock()
+
+	db.retireMerged(merged, manifestPath)
+
+	db.lastCompaction.Store(time.Now().UnixNano())
+	db.compactions.Add(1)
+	return nil
+}
+
+// writeManifest records the names of the merged segments of a compaction whose
+// outputs are in place. The manifest is the commit point of the compaction:
+// until it exists, a crash leaves the merged segments next to outputs that only
+// repeat their newest values, and once it is durable, the merged segments may
+// be removed in any order. It is written to a temporary file and renamed, so
+// recovery never reads a partial list.
+func (db *Db) writeManifest(path string, merged []*Segment) error {
+	var names strings.Builder
+	for _, segment := range merged {
+		names.WriteString(filepath.Base(segment.path))
+		names.WriteByte('\n')
+	}
+
+	tempPath := path + compactionSuffix
+	file, err := db.storage.Create(tempPath, db.fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte(names.String()))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = db.storage.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = db.storage.Remove(tempPath)
+		return err
+	}
+	if err := db.storage.SyncDir(db.directory); err != nil {
+		// The outputs are removed again, so the manifest must not be left
+		// to remove the merged segments on the next start.
+		_ = db.storage.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// retireMerged retires the merged segments of a compaction and removes its
+// manifest once the last of their files is removed. If removing a file fails,
+// the manifest is kept, so that recovery removes the file on the next start.
+func (db *Db) retireMerged(merged []*Segment, manifestPath string) {
+	var pending atomic.Int32
+	var failed atomic.Bool
+	pending.Store(int32(len(merged)))
+	onRemove := func(err error) {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			failed.Store(true)
+		}
+		if pending.Add(-1) > 0 || failed.Load() {
+			return
+		}
+		if err := db.storage.SyncDir(db.directory); err == nil {
+			_ = db.storage.Remove(manifestPath)
+		}
+	}
+
+	for _, segment := range merged {
+		segment.onRemove = onRemove
+		segment.retire()
+	}
+}
+
+// ownsFile reports whether fileName is a segment name of the database followed
+// by suffix.
+func (db *Db) ownsFile(fileName, suffix string) bool {
+	name, found := strings.CutSuffix(fileName, suffix)
+	if !found {
+		return false
+	}
+	_, ok := parseSegmentName(name, db.filePrefix)
+	return ok
+}
+
+// recoverCompactions finishes what a crash interrupted: the merged segments
+// listed in manifests are removed, then the manifests, and temporary files of
+// unfinished compactions are removed. It returns the names of the files that
+// are not segments of the database. A read-only database leaves the files in
+// place and only skips them.
+func (db *Db) recoverCompactions(files []string) (map[string]bool, error) {
+	skipped := make(map[string]bool)
+	for _, fileName := range files {
+		if db.ownsFile(fileName, compactionSuffix) || db.ownsFile(fileName, manifestSuffix+compactionSuffix) {
+			skipped[fileName] = true
+			if !db.readOnly {
+				if err := db.storage.Remove(filepath.Join(db.directory, fileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if !db.ownsFile(fileName, manifestSuffix) {
+			continue
+		}
+
+		path := filepath.Join(db.directory, fileName)
+		merged, err := db.readManifest(path)
+		if err != nil {
+			return nil, fmt.Errorf("read compaction manifest %s: %w", path, err)
+		}
+		for _, name := range merged {
+			skipped[name] = true
+		}
+		if db.readOnly {
+			continue
+		}
+		for _, name := range merged {
+			if err := db.storage.Remove(filepath.Join(db.directory, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		if err := db.storage.SyncDir(db.directory); err != nil {
+			return nil, err
+		}
+		if err := db.storage.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return skipped, nil
+}
+
+func (db *Db) readManifest(path string) ([]string, error) {
+	file, err := db.storage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
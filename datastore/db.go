@@ -2,109 +2,343 @@ package datastore
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	dataFileName    = "current-data"
-	bufferSize      = 8192
-	defaultFileMode = 0644
-	minSegments     = 3
+	dataFileName      = "current-data"
+	lockFileSuffix    = ".lock"
+	defaultBufferSize = 8192
+	minBufferSize     = 64
+	defaultFileMode   = 0644
+	defaultDirMode    = 0755
+	minSegments       = 3
+
+	defaultCompactTailKeep = 1
+
+	defaultWriteBufferSize = 100
+
+	// getManyWorkers bounds the number of values GetMany reads at once.
+	getManyWorkers = 8
 )
 
-type keyIndex map[string]int64
+// DefaultMaxSegmentSize is the size a segment may grow to before the database
+// rolls over to a new one, unless WithMaxSegmentSize says otherwise.
+const DefaultMaxSegmentSize = 10 * 1024 * 1024
+
+// tombstonePosition marks a deleted key in a segment's keyIndex.
+const tombstonePosition = -1
+
+var (
+	ErrKeyNotFound      = errors.New("key not found in datastore")
+	ErrReadOnly         = errors.New("database is opened in read-only mode")
+	ErrInUse            = errors.New("database already in use")
+	ErrStoreFull        = errors.New("database is full")
+	ErrValueTooLarge    = errors.New("value too large")
+	ErrInvalidKey       = errors.New("invalid key")
+	errIncompleteRecord = errors.New("incomplete record at the end of segment")
+	errCorruptRecord    = errors.New("corrupt record")
+)
 
-type IndexOperation struct {
-	isWrite  bool
-	key      string
-	position int64
-	response chan *KeyLocation
-}
+// keyIndex maps every key of a segment to the offset of its last record in
+// that segment, or to tombstonePosition. Records are appended and recovered
+// in file order, so a later record always overwrites an earlier one and
+// compaction can rely on the index holding the newest value of each segment.
+type keyIndex map[string]int64
 
 type WriteOperation struct {
 	data     entry
+	batch    []entry
+	update   updateFunc
+	stream   *valueStream
+	sweep    []string
+	ping     bool
 	response chan error
 }
 
+// updateFunc computes the value to write from the value the key has right
+// before the write, for read-modify-write operations.
+type updateFunc func(current string, existed bool) (string, error)
+
 type KeyLocation struct {
 	segment  *Segment
 	position int64
 }
 
 type Db struct {
-	activeFile      *os.File
+	activeFile      segmentFile
 	activeFilePath  string
+	activeSegment   *Segment
+	lockFile        io.Closer
+	storage         storage
 	currentOffset   int64
 	directory       string
+	filePrefix      string
+	fileMode        os.FileMode
+	dirMode         os.FileMode
 	maxSegmentSize  int64
+	syncOnWrite     bool
+	maxKeys         int
+	maxDiskBytes    int64
+	bufferSize      int
+	compactTailKeep int
+	writeBufferSize int
+	maxOpenFiles    int
+	handles         *handleCache
 	segmentCounter  int
-	indexOperations chan IndexOperation
 	writeOperations chan WriteOperation
 	segments        []*Segment
 	fileLock        sync.Mutex
 	segmentLock     sync.RWMutex
+	compactionLock  sync.Mutex
 	closed          bool
-	closeMutex      sync.Mutex
-	indexWG         sync.WaitGroup
+	readOnly        bool
+	closeMutex      sync.RWMutex
 	writeWG         sync.WaitGroup
+	compactionWG    sync.WaitGroup
+	watchers        watchRegistry
+
+	// Compaction progress, read by Stats without taking compactionLock.
+	compactions          atomic.Int64
+	lastCompaction       atomic.Int64
+	compactionInProgress atomic.Bool
+
+	// writesBlocked counts writes that found writeOperations full and had to
+	// wait for the write handler.
+	writesBlocked atomic.Int64
+
+	// liveKeyCount is the number of stored keys, bucketKeyCount the number
+	// of them within a bucket. Both are guarded by segmentLock and kept up
+	// to date by every change to the indices.
+	liveKeyCount   int
+	bucketKeyCount int
+
+	sweepInterval time.Duration
+	sweepStop     chan struct{}
+	sweepOnce     sync.Once
+	sweepWG       sync.WaitGroup
+
+	// compactionRunning is set while a compaction goroutine runs, and
+	// compactionRerun when it was triggered again meanwhile. Both are guarded
+	// by compactionStateLock.
+	compactionStateLock sync.Mutex
+	compactionRunning   bool
+	compactionRerun     bool
 }
 
 type Segment struct {
 	startOffset int64
 	keyIndex    keyIndex
 	path        string
+	storage     storage
+	handles     *handleCache
 	mu          sync.RWMutex
+
+	// refs counts readers using the segment's file. A segment retired by
+	// compaction removes its file once the last reader releases it.
+	refs       atomic.Int32
+	retired    atomic.Bool
+	removeOnce sync.Once
+	// onRemove, if set before the segment is retired, is called with the
+	// result of removing its file.
+	onRemove func(error)
+
+	// missing is set once the segment's file turns out to have been removed
+	// from under the database. Lookups then skip the segment.
+	missing atomic.Bool
+
+	// outdated is set by recovery if the segment holds records of a format
+	// older than currentRecordVersion. Upgrade rewrites such segments.
+	outdated bool
+
+	// expiries holds when the keys whose newest record in the segment was
+	// written with a TTL expire, so that expiry is checked without reading
+	// records. Like keyIndex, it is guarded by mu.
+	expiries map[string]int64
 }
 
-func CreateDb(directory string, maxSegmentSize int64) (*Db, error) {
-	if err := os.MkdirAll(directory, defaultFileMode); err != nil {
+// CreateDb opens the database in directory for reading and writing, creating
+// the directory if needed and recovering any segments already in it.
+func CreateDb(directory string, opts ...Option) (*Db, error) {
+	database, err := openDb(directory, false, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.initializeNewSegment(); err != nil {
+		database.lockFile.Close()
 		return nil, err
 	}
 
+	database.startWriteHandler()
+	database.startSweeper()
+
+	return database, nil
+}
+
+// OpenReadOnly opens an existing database without modifying it: no active
+// segment is created, no compaction runs and incomplete trailing records are
+// skipped rather than truncated. Reads work as usual while every write fails
+// with ErrReadOnly.
+func OpenReadOnly(directory string, opts ...Option) (*Db, error) {
+	return openDb(directory, true, opts)
+}
+
+// openDb loads the segments found in directory and recovers their indices.
+func openDb(directory string, readOnly bool, opts []Option) (*Db, error) {
 	database := &Db{
-		segments:        make([]*Segment, 0),
 		directory:       directory,
-		maxSegmentSize:  maxSegmentSize,
-		indexOperations: make(chan IndexOperation, 100),
-		writeOperations: make(chan WriteOperation, 100),
+		maxSegmentSize:  DefaultMaxSegmentSize,
+		bufferSize:      defaultBufferSize,
+		compactTailKeep: defaultCompactTailKeep,
+		writeBufferSize: defaultWriteBufferSize,
+		maxOpenFiles:    defaultMaxOpenFiles,
+		filePrefix:      dataFileName,
+		fileMode:        defaultFileMode,
+		dirMode:         defaultDirMode,
+		readOnly:        readOnly,
+		storage:         osStorage{},
+	}
+	for _, opt := range opts {
+		opt(database)
+	}
+	if database.maxSegmentSize <= 0 {
+		return nil, fmt.Errorf("invalid maximum segment size %d", database.maxSegmentSize)
 	}
+	if database.bufferSize < minBufferSize {
+		return nil, fmt.Errorf("invalid buffer size %d, must be at least %d", database.bufferSize, minBufferSize)
+	}
+	if database.compactTailKeep < 1 {
+		return nil, fmt.Errorf("invalid number of segments to keep uncompacted %d, must be at least 1", database.compactTailKeep)
+	}
+	if database.writeBufferSize < 0 {
+		return nil, fmt.Errorf("invalid write buffer size %d", database.writeBufferSize)
+	}
+	if database.maxOpenFiles < 0 {
+		return nil, fmt.Errorf("invalid maximum number of open files %d", database.maxOpenFiles)
+	}
+	if err := validateFilePrefix(database.filePrefix); err != nil {
+		return nil, err
+	}
+	database.writeOperations = make(chan WriteOperation, database.writeBufferSize)
+	database.handles = newHandleCache(database.maxOpenFiles)
 
-	files, err := os.ReadDir(directory)
-	if err != nil {
+	if !readOnly {
+		if err := database.storage.MkdirAll(directory, database.dirMode); err != nil {
+			return nil, err
+		}
+	}
+
+	// A writer holds the lock for as long as the database is open, so that a
+	// second process cannot recover, truncate or append to the same segments.
+	if !readOnly {
+		lock, err := database.storage.Lock(filepath.Join(directory, database.filePrefix+lockFileSuffix), database.fileMode)
+		if err != nil {
+			return nil, err
+		}
+		database.lockFile = lock
+	}
+
+	if err := database.loadSegments(); err != nil {
+		if database.lockFile != nil {
+			database.lockFile.Close()
+		}
 		return nil, err
 	}
-	for _, file := range files {
-		if file.IsDir() || !file.Type().IsRegular() || !filepath.HasPrefix(file.Name(), dataFileName) {
+	return database, nil
+}
+
+// loadSegments finds the segment files in the database directory and recovers
+// their indices.
+func (db *Db) loadSegments() error {
+	files, err := db.storage.List(db.directory)
+	if err != nil {
+		return err
+	}
+	skipped, err := db.recoverCompactions(files)
+	if err != nil {
+		return err
+	}
+	var segments []*Segment
+	segmentNames := make(map[*Segment]segmentName)
+	for _, fileName := range files {
+		if skipped[fileName] {
+			continue
+		}
+		name, ok := parseSegmentName(fileName, db.filePrefix)
+		if !ok {
 			continue
 		}
-		path := filepath.Join(directory, file.Name())
+		path := filepath.Join(db.directory, fileName)
 		segment := &Segment{
 			path:     path,
+			storage:  db.storage,
+			handles:  db.handles,
 			keyIndex: make(keyIndex),
 		}
-		database.segments = append(database.segments, segment)
+		segments = append(segments, segment)
+		segmentNames[segment] = name
+		if name.number >= db.segmentCounter {
+			db.segmentCounter = name.number + 1
+		}
 	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segmentNames[segments[i]].less(segmentNames[segments[j]])
+	})
 
-	if err := database.recoverAllSegments(); err != nil && err != io.EOF {
-		return nil, err
-	}
+	db.segmentLock.Lock()
+	db.segments = segments
+	db.segmentLock.Unlock()
 
-	if err := database.initializeNewSegment(); err != nil {
-		return nil, err
+	if err := db.recoverAllSegments(); err != nil {
+		return err
 	}
+	db.segmentLock.Lock()
+	db.recountKeysLocked()
+	db.segmentLock.Unlock()
+	if outdated := db.outdatedSegments(); outdated > 0 {
+		fmt.Printf("Warning: %d segments in %s hold records of an older format, Upgrade rewrites them\n", outdated, db.directory)
+	}
+	return nil
+}
 
-	database.startIndexHandler()
-	database.startWriteHandler()
+// segmentList returns a snapshot of the segments, oldest first. The slice may
+// be read without segmentLock; the segments themselves may still change.
+func (db *Db) segmentList() []*Segment {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
 
-	return database, nil
+	segments := make([]*Segment, len(db.segments))
+	copy(segments, db.segments)
+	return segments
 }
 
 func (db *Db) Close() error {
+	return db.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but gives up waiting for queued writes and
+// compaction once ctx is done, so a write stuck on the disk cannot hang
+// shutdown. It then returns ctx.Err() and leaves the files open, since the
+// stuck write may still use them; the database is closed for further use
+// either way.
+func (db *Db) CloseContext(ctx context.Context) error {
+	// The sweeper writes through submitWrite, so it has to be stopped before
+	// closeMutex is taken.
+	db.stopSweeper()
+
 	db.closeMutex.Lock()
 	defer db.closeMutex.Unlock()
 
@@ -113,35 +347,33 @@ func (db *Db) Close() error {
 	}
 
 	db.closed = true
-	close(db.indexOperations)
 	close(db.writeOperations)
 
-	db.indexWG.Wait()
-	db.writeWG.Wait()
+	done := make(chan struct{})
+	go func() {
+		db.writeWG.Wait()
+		// Compaction may still be renaming and removing segment files,
+		// which must be done before another Db can open the directory.
+		db.compactionWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fmt.Printf("Warning: closing %s timed out, a write or compaction may have been in flight\n", db.directory)
+		return ctx.Err()
+	}
+	db.watchers.close()
+	db.handles.close()
 
+	var err error
 	if db.activeFile != nil {
-		return db.activeFile.Close()
+		err = db.activeFile.Close()
 	}
-	return nil
-}
-
-func (db *Db) startIndexHandler() {
-	db.indexWG.Add(1)
-	go func() {
-		defer db.indexWG.Done()
-		for operation := range db.indexOperations {
-			if operation.isWrite {
-				db.updateIndex(operation.key, operation.position)
-			} else {
-				segment, pos, err := db.findKeyLocation(operation.key)
-				if err != nil {
-					operation.response <- nil
-				} else {
-					operation.response <- &KeyLocation{segment, pos}
-				}
-			}
-		}
-	}()
+	if db.lockFile != nil {
+		db.lockFile.Close()
+	}
+	return err
 }
 
 func (db *Db) startWriteHandler() {
@@ -150,72 +382,469 @@ func (db *Db) startWriteHandler() {
 		defer db.writeWG.Done()
 		for operation := range db.writeOperations {
 			db.fileLock.Lock()
-
-			entrySize := operation.data.GetLength()
-			fileInfo, err := db.activeFile.Stat()
-			if err != nil {
+			if operation.batch != nil {
+				operation.response <- db.writeBatch(operation.batch)
+			} else if operation.update != nil {
+				operation.response <- db.readModifyWrite(operation.data, operation.update)
+			} else if operation.stream != nil {
+				operation.response <- db.writeStream(operation.data.key, operation.stream)
+			} else if operation.sweep != nil {
+				operation.response <- db.deleteExpired(operation.sweep)
+			} else if operation.ping {
+				_, err := db.activeFile.Size()
 				operation.response <- err
-				db.fileLock.Unlock()
-				continue
+			} else {
+				operation.response <- db.writeSingle(operation.data)
 			}
+			db.fileLock.Unlock()
+		}
+	}()
+}
 
-			if fileInfo.Size()+entrySize > db.maxSegmentSize {
-				if err := db.initializeNewSegment(); err != nil {
-					operation.response <- err
-					db.fileLock.Unlock()
-					continue
-				}
-			}
+// readModifyWrite reads the current value of the key, passes it to update
+// and writes the result. It runs on the write handler, so no other write can
+// come in between.
+func (db *Db) readModifyWrite(record entry, update updateFunc) error {
+	var current string
+	existed := false
+	if location := db.acquireKeyLocation(record.key); location != nil {
+		value, err := location.segment.readFromSegmentWithChecksum(location.position)
+		location.segment.release()
+		if err == nil {
+			current, existed = value, true
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+	}
 
-			currentPos := db.currentOffset
-			bytesWritten, err := db.activeFile.Write(operation.data.Encode())
-			if err == nil {
-				db.currentOffset += int64(bytesWritten)
-				db.updateIndex(operation.data.key, currentPos)
-			}
+	value, err := update(current, existed)
+	if err != nil {
+		return err
+	}
+	record.value = value
+	return db.writeSingle(record)
+}
 
-			operation.response <- err
-			db.fileLock.Unlock()
+func (db *Db) writeSingle(record entry) error {
+	if record.tombstone {
+		if _, _, err := db.lookupKey(record.key, time.Now().UnixNano()); err != nil {
+			return err
 		}
-	}()
+	} else if err := db.checkLimits([]entry{record}); err != nil {
+		return err
+	}
+	return db.writeRecord(record)
+}
+
+// writeRecord appends the record and indexes it, without the checks of
+// writeSingle.
+func (db *Db) writeRecord(record entry) error {
+	segment, position, err := db.appendEntry(record)
+	if err != nil {
+		return err
+	}
+	if db.syncOnWrite {
+		if err := db.activeFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if record.tombstone {
+		position = tombstonePosition
+	}
+	db.updateIndex(segment, record.key, position, record.expiresAt)
+	db.watchers.notify(record)
+	return nil
+}
+
+type batchIndexUpdate struct {
+	segment   *Segment
+	key       string
+	position  int64
+	expiresAt int64
+}
+
+func (db *Db) writeBatch(records []entry) error {
+	if err := db.checkLimits(records); err != nil {
+		return err
+	}
+
+	// Compaction only sees indexed keys, so it must not take its snapshot of
+	// the segments while batch records are appended but not yet indexed. A
+	// compaction started by a rollover within the batch waits until it is done.
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+
+	updates := make([]batchIndexUpdate, 0, len(records))
+	for _, record := range records {
+		segment, position, err := db.appendEntry(record)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, batchIndexUpdate{segment, record.key, position, record.expiresAt})
+	}
+
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+
+	db.segmentLock.Lock()
+	for _, update := range updates {
+		db.setIndexLocked(update.segment, update.key, update.position, update.expiresAt)
+	}
+	db.segmentLock.Unlock()
+
+	for _, record := range records {
+		db.watchers.notify(record)
+	}
+	return nil
 }
 
-func (db *Db) updateIndex(key string, position int64) {
-	currentSegment := db.getCurrentSegment()
-	currentSegment.mu.Lock()
-	currentSegment.keyIndex[key] = position
-	currentSegment.mu.Unlock()
+// appendEntry writes the record to the active file, rolling over to a new
+// segment first if the record would not fit, and returns the segment and
+// offset the record was written at.
+func (db *Db) appendEntry(record entry) (*Segment, int64, error) {
+	entrySize := record.GetLength()
+	if entrySize > maxRecordSize {
+		return nil, 0, fmt.Errorf("%w: record of %d bytes exceeds the maximum of %d bytes", ErrValueTooLarge, entrySize, maxRecordSize)
+	}
+	size, err := db.activeFile.Size()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if size+entrySize > db.maxSegmentSize {
+		if err := db.initializeNewSegment(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	record.timestamp = time.Now().UnixNano()
+	currentPos := db.currentOffset
+	bytesWritten, err := db.activeFile.Write(record.Encode())
+	if err != nil {
+		return nil, 0, err
+	}
+	db.currentOffset += int64(bytesWritten)
+	return db.activeSegment, currentPos, nil
+}
+
+// updateIndex records the position of a key in the segment the record was
+// appended to. The segment comes from appendEntry rather than being looked up
+// again, so a position is never attributed to another segment's file.
+// Segment indices are the single source of truth for key positions: they are
+// only modified by the write handler, recovery and compaction, each under the
+// segment's lock, and read directly by lookups.
+func (db *Db) updateIndex(segment *Segment, key string, position, expiresAt int64) {
+	db.segmentLock.Lock()
+	defer db.segmentLock.Unlock()
+
+	db.setIndexLocked(segment, key, position, expiresAt)
+}
+
+// setIndexLocked is updateIndex for callers holding segmentLock. It counts the
+// key in or out of the key counts if the write changes whether it is present.
+// The segment must be the newest one holding the key once it is updated.
+func (db *Db) setIndexLocked(segment *Segment, key string, position, expiresAt int64) {
+	_, _, err := db.findKeyLocationLocked(key)
+	wasLive, isLive := err == nil, position != tombstonePosition
+
+	segment.mu.Lock()
+	segment.setPositionLocked(key, position, expiresAt)
+	segment.mu.Unlock()
+
+	switch {
+	case isLive && !wasLive:
+		db.countKeyLocked(key, 1)
+	case wasLive && !isLive:
+		db.countKeyLocked(key, -1)
+	}
+}
+
+// countKeyLocked adds delta to the key counts for a key that appeared or went
+// away. The caller holds segmentLock.
+func (db *Db) countKeyLocked(key string, delta int) {
+	db.liveKeyCount += delta
+	if isBucketKey(key) {
+		db.bucketKeyCount += delta
+	}
 }
 
 func (db *Db) getKeyPosition(key string) *KeyLocation {
-	db.closeMutex.Lock()
-	defer db.closeMutex.Unlock()
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
 
 	if db.closed {
 		return nil
 	}
+	return db.acquireKeyLocation(key)
+}
+
+// acquireKeyLocation finds the key and acquires its segment. The segment is
+// acquired under segmentLock, so a concurrent compaction cannot remove its
+// file before the caller releases it.
+func (db *Db) acquireKeyLocation(key string) *KeyLocation {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
 
-	segment, pos, err := db.findKeyLocation(key)
+	segment, pos, err := db.findKeyLocationLocked(key)
 	if err != nil {
 		return nil
 	}
+	segment.acquire()
 	return &KeyLocation{segment, pos}
 }
 
 func (db *Db) Get(key string) (string, error) {
-	location := db.getKeyPosition(key)
-	if location == nil {
-		return "", fmt.Errorf("key not found in datastore")
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get but gives up with ctx.Err() once ctx is done.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := db.getFrom(ctx, key)
+	return value, err
+}
+
+// GetFrom is like Get but also returns the path of the segment file the value
+// was read from, to tell reads of the active segment from those of compacted
+// or older ones. The segment may be compacted away right after.
+func (db *Db) GetFrom(key string) (string, string, error) {
+	return db.getFrom(context.Background(), key)
+}
+
+func (db *Db) getFrom(ctx context.Context, key string) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
 	}
 
-	value, err := location.segment.readFromSegmentWithChecksum(location.position)
+	for {
+		location := db.getKeyPosition(key)
+		if location == nil {
+			return "", "", ErrKeyNotFound
+		}
+
+		if err := ctx.Err(); err != nil {
+			location.segment.release()
+			return "", "", err
+		}
+
+		value, err := location.segment.readFromSegmentWithChecksum(location.position)
+		location.segment.release()
+		if errors.Is(err, os.ErrNotExist) {
+			// The segment is skipped from now on, so the next lookup
+			// finds the key in an older segment, if any.
+			db.markMissing(location.segment)
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return value, location.segment.path, nil
+	}
+}
+
+// GetOr returns the value stored under key, or fallback when there is none.
+// Errors other than ErrKeyNotFound are logged and also yield fallback.
+func (db *Db) GetOr(key, fallback string) string {
+	value, err := db.Get(key)
 	if err != nil {
-		return "", err
+		if !errors.Is(err, ErrKeyNotFound) {
+			fmt.Printf("Warning: failed to read key %q: %v\n", key, err)
+		}
+		return fallback
 	}
-	return value, nil
+	return value
 }
 
 func (db *Db) Put(key, value string) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put but stops waiting for the write handler once ctx is
+// done and returns ctx.Err(). A write that was already queued may still be
+// applied after PutContext returns.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	return db.submitWrite(ctx, WriteOperation{
+		data: entry{
+			key:   key,
+			value: value,
+		},
+	})
+}
+
+// Delete removes the key by appending a tombstone record. It returns
+// ErrKeyNotFound if the key is not present.
+func (db *Db) Delete(key string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	return db.deleteKey(key)
+}
+
+// deleteKey is Delete for any stored key, including those of buckets.
+func (db *Db) deleteKey(key string) error {
+	return db.submitWrite(context.Background(), WriteOperation{
+		data: entry{
+			key:       key,
+			tombstone: true,
+		},
+	})
+}
+
+// GetSet stores the value and returns the value the key had before, if any.
+// Reading the old value and writing the new one happen as a single operation
+// with respect to other writes.
+func (db *Db) GetSet(key, value string) (old string, existed bool, err error) {
+	if err := ValidateKey(key); err != nil {
+		return "", false, err
+	}
+
+	err = db.submitWrite(context.Background(), WriteOperation{
+		data: entry{key: key},
+		update: func(current string, found bool) (string, error) {
+			old, existed = current, found
+			return value, nil
+		},
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return old, existed, nil
+}
+
+// Increment adds delta to the integer stored under key and returns the new
+// value. A missing key counts as zero. The update is atomic with respect to
+// other writes, so concurrent increments are never lost.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	if err := ValidateKey(key); err != nil {
+		return 0, err
+	}
+
+	var result int64
+	err := db.submitWrite(context.Background(), WriteOperation{
+		data: entry{key: key},
+		update: func(current string, existed bool) (string, error) {
+			var value int64
+			if existed {
+				var err error
+				if value, err = strconv.ParseInt(current, 10, 64); err != nil {
+					return "", fmt.Errorf("value of key %q is not an integer: %w", key, err)
+				}
+			}
+			result = value + delta
+			return strconv.FormatInt(result, 10), nil
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// Append adds suffix to the end of the value stored under key and returns the
+// length of the result. A missing key counts as empty. Like Increment, the
+// update is atomic with respect to other writes, so concurrent appends are
+// never lost.
+func (db *Db) Append(key, suffix string) (int, error) {
+	if err := ValidateKey(key); err != nil {
+		return 0, err
+	}
+
+	var length int
+	err := db.submitWrite(context.Background(), WriteOperation{
+		data: entry{key: key},
+		update: func(current string, existed bool) (string, error) {
+			value := current + suffix
+			length = len(value)
+			return value, nil
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// GetMany looks up several keys and returns the values of those present.
+// Missing keys are left out of the result. Keys are read independently by up
+// to getManyWorkers goroutines, so the result is not a snapshot if writes
+// happen concurrently. If any reads fail, the errors of all of them are
+// returned joined.
+func (db *Db) GetMany(keys []string) (map[string]string, error) {
+	return db.getMany(keys, getManyWorkers)
+}
+
+// getMany is GetMany with the number of parallel reads as a parameter. Every
+// read opens its segment and reads at the indexed position, so reads of the
+// same segment do not wait for each other.
+func (db *Db) getMany(keys []string, workers int) (map[string]string, error) {
+	results := make([]string, len(keys))
+	errs := make([]error, len(keys))
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(keys)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				results[index], errs[index] = db.Get(keys[index])
+			}
+		}()
+	}
+	for index := range keys {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+
+	values := make(map[string]string, len(keys))
+	var failures []error
+	for index, key := range keys {
+		err := errs[index]
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			failures = append(failures, fmt.Errorf("get %q: %w", key, err))
+			continue
+		}
+		values[key] = results[index]
+	}
+	if len(failures) > 0 {
+		return nil, errors.Join(failures...)
+	}
+	return values, nil
+}
+
+// PutBatch writes all pairs with a single fsync at the end. The index is
+// updated for every key at once, so readers see either none or all of the
+// batch. If a write fails part way through, none of the batch becomes visible,
+// but records already appended may still be picked up by recovery on the next
+// start. A batch waits for a running compaction to finish, and compactions
+// wait for the batch.
+func (db *Db) PutBatch(pairs map[string]string) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	records := make([]entry, 0, len(pairs))
+	for key, value := range pairs {
+		if err := ValidateKey(key); err != nil {
+			return err
+		}
+		records = append(records, entry{key: key, value: value})
+	}
+
+	return db.submitWrite(context.Background(), WriteOperation{batch: records})
+}
+
+// Sync flushes the active segment file to stable storage, so every write that
+// has completed is durable without closing the database. It is safe to call
+// concurrently with writes.
+func (db *Db) Sync() error {
 	db.closeMutex.Lock()
 	defer db.closeMutex.Unlock()
 
@@ -223,178 +852,327 @@ func (db *Db) Put(key, value string) error {
 		return fmt.Errorf("database is closed")
 	}
 
+	if db.readOnly {
+		return nil
+	}
+
+	db.fileLock.Lock()
+	defer db.fileLock.Unlock()
+
+	return db.activeFile.Sync()
+}
+
+// pingTimeout is how long Ping waits for the write handler. Tests shorten it.
+var pingTimeout = 2 * time.Second
+
+// Ping checks that the database can still take writes: the write handler
+// picks up an operation within pingTimeout and the active segment file is
+// still accessible. A read-only database only has to be open.
+func (db *Db) Ping() error {
+	if db.readOnly {
+		db.closeMutex.Lock()
+		defer db.closeMutex.Unlock()
+		if db.closed {
+			return fmt.Errorf("database is closed")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if err := db.submitWrite(ctx, WriteOperation{ping: true}); err != nil {
+		return fmt.Errorf("write handler: %w", err)
+	}
+	return nil
+}
+
+// Rollover closes the active segment and starts a new one regardless of its
+// size. Like a rollover caused by size, it may start a compaction.
+func (db *Db) Rollover() error {
+	db.closeMutex.Lock()
+	defer db.closeMutex.Unlock()
+
+	if db.closed {
+		return fmt.Errorf("database is closed")
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.fileLock.Lock()
+	defer db.fileLock.Unlock()
+
+	return db.initializeNewSegment()
+}
+
+// DropAll removes every key and segment and continues with a fresh, empty
+// active segment. It holds the write and compaction locks throughout, so no
+// write or compaction sees a partly dropped state. Segment numbers keep
+// increasing rather than starting over, since files of dropped segments are
+// only removed once their last reader is done and must not be confused with
+// new ones. Watchers of keys that existed are notified of their deletion.
+func (db *Db) DropAll() error {
+	db.closeMutex.Lock()
+	defer db.closeMutex.Unlock()
+
+	if db.closed {
+		return fmt.Errorf("database is closed")
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.fileLock.Lock()
+	defer db.fileLock.Unlock()
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+
+	var deleted []entry
+	for _, key := range db.watchers.keys() {
+		if db.Has(key) {
+			deleted = append(deleted, entry{key: key, tombstone: true})
+		}
+	}
+
+	db.segmentLock.Lock()
+	dropped := db.segments
+	db.segments = nil
+	db.liveKeyCount = 0
+	db.bucketKeyCount = 0
+	db.segmentLock.Unlock()
+
+	for _, segment := range dropped {
+		segment.retire()
+	}
+
+	// Closes the file of the dropped active segment.
+	if err := db.initializeNewSegment(); err != nil {
+		return err
+	}
+	for _, record := range deleted {
+		db.watchers.notify(record)
+	}
+	return nil
+}
+
+// submitWrite queues operation for the write handler and waits for its result.
+// closeMutex is only held until the operation is queued: Close lets the handler
+// finish every queued operation, so writers wait for their results unlocked and
+// several of them can be queued at once.
+func (db *Db) submitWrite(ctx context.Context, operation WriteOperation) error {
 	responseChannel := make(chan error, 1)
-	operation := WriteOperation{
-		data: entry{
-			key:   key,
-			value: value,
-		},
-		response: responseChannel,
+	operation.response = responseChannel
+	if err := db.enqueueWrite(ctx, operation); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-responseChannel:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *Db) enqueueWrite(ctx context.Context, operation WriteOperation) error {
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
+
+	if db.closed {
+		return fmt.Errorf("database is closed")
+	}
+	if db.readOnly {
+		return ErrReadOnly
 	}
 
-	db.writeOperations <- operation
-	return <-responseChannel
+	select {
+	case db.writeOperations <- operation:
+		return nil
+	default:
+	}
+
+	db.writesBlocked.Add(1)
+	select {
+	case db.writeOperations <- operation:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (db *Db) initializeNewSegment() error {
 	newFilePath := db.generateFileName()
-	file, err := os.OpenFile(newFilePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, defaultFileMode)
+	file, err := db.storage.OpenAppend(newFilePath, db.fileMode)
 	if err != nil {
 		return err
 	}
 
 	segment := &Segment{
 		path:     newFilePath,
+		storage:  db.storage,
+		handles:  db.handles,
 		keyIndex: make(keyIndex),
 	}
 
 	if db.activeFile != nil {
+		db.activeFile.Sync()
 		db.activeFile.Close()
 	}
 
 	db.activeFile = file
 	db.currentOffset = 0
 	db.activeFilePath = newFilePath
+	db.activeSegment = segment
 
 	db.segmentLock.Lock()
 	db.segments = append(db.segments, segment)
+	segmentCount := len(db.segments)
 	db.segmentLock.Unlock()
 
-	if len(db.segments) >= minSegments {
-		go db.compactOldSegments()
+	if segmentCount >= db.compactionThreshold() {
+		db.startCompaction()
 	}
 
 	return nil
 }
 
+// compactionThreshold is the number of segments at which a rollover starts a
+// compaction: minSegments, plus one for every further segment kept out of it.
+func (db *Db) compactionThreshold() int {
+	return minSegments + db.compactTailKeep - 1
+}
+
 func (db *Db) generateFileName() string {
-	fileName := filepath.Join(db.directory, fmt.Sprintf("%s%d", dataFileName, db.segmentCounter))
+	fileName := filepath.Join(db.directory, fmt.Sprintf("%s%d", db.filePrefix, db.segmentCounter))
 	db.segmentCounter++
 	return fileName
 }
 
-func (db *Db) compactOldSegments() {
-	db.segmentLock.Lock()
-	defer db.segmentLock.Unlock()
-
-	if len(db.segments) < minSegments {
-		return
-	}
-
-	compactedFilePath := db.generateFileName()
-	compactedFile, err := os.OpenFile(compactedFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, defaultFileMode)
-	if err != nil {
-		return
-	}
-	defer compactedFile.Close()
+// recoverAllSegments rebuilds the index of every segment. Each segment has its
+// own keyIndex, so segments are recovered in parallel by a bounded pool of
+// workers.
+func (db *Db) recoverAllSegments() error {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
 
-	compactedSegment := &Segment{
-		path:     compactedFilePath,
-		keyIndex: make(keyIndex),
+	if len(db.segments) == 0 {
+		return nil
 	}
 
-	var writeOffset int64
-	keysWritten := make(map[string]bool)
-
-	for i := len(db.segments) - 2; i >= 0; i-- {
-		segment := db.segments[i]
-		segment.mu.RLock()
-
-		for key, position := range segment.keyIndex {
-			if !keysWritten[key] {
-				value, err := segment.readFromSegmentWithChecksum(position)
+	validSizes := make([]int64, len(db.segments))
+	errs := make([]error, len(db.segments))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(runtime.GOMAXPROCS(0), len(db.segments)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				segment := db.segments[i]
+				validSize, err := db.recoverSegmentData(segment)
 				if err != nil {
-					continue
-				}
-
-				record := entry{
-					key:   key,
-					value: value,
-				}
-
-				bytesWritten, err := compactedFile.Write(record.Encode())
-				if err == nil {
-					compactedSegment.keyIndex[key] = writeOffset
-					writeOffset += int64(bytesWritten)
-					keysWritten[key] = true
+					err = fmt.Errorf("failed to recover %s: %w", segment.path, err)
 				}
+				validSizes[i], errs[i] = validSize, err
 			}
-		}
-		segment.mu.RUnlock()
+		}()
 	}
-
-	newSegments := []*Segment{compactedSegment, db.segments[len(db.segments)-1]}
-	for i := 0; i < len(db.segments)-1; i++ {
-		_ = os.Remove(db.segments[i].path)
+	for i := range db.segments {
+		jobs <- i
 	}
+	close(jobs)
+	wg.Wait()
 
-	db.segments = newSegments
+	db.currentOffset = validSizes[len(validSizes)-1]
+	return errors.Join(errs...)
 }
 
-func (db *Db) recoverAllSegments() error {
-	db.segmentLock.RLock()
-	defer db.segmentLock.RUnlock()
+func (db *Db) recoverSegmentData(segment *Segment) (int64, error) {
+	file, err := db.storage.Open(segment.path)
+	if err != nil {
+		return 0, err
+	}
 
-	for _, segment := range db.segments {
-		if err := db.recoverSegmentData(segment); err != nil && err != io.EOF {
-			return err
+	validSize, err := db.processRecovery(file, segment)
+	file.Close()
+
+	if err == errIncompleteRecord {
+		if db.readOnly {
+			fmt.Printf("Warning: ignoring incomplete record at the end of %s\n", segment.path)
+			return validSize, nil
 		}
+		return validSize, db.truncateSegment(segment.path, validSize)
 	}
-	return nil
+	return validSize, err
 }
 
-func (db *Db) recoverSegmentData(segment *Segment) error {
-	file, err := os.Open(segment.path)
+func (db *Db) truncateSegment(path string, validSize int64) error {
+	size, err := db.storage.Size(path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	return db.processRecovery(file, segment)
+	if err := db.storage.Truncate(path, validSize); err != nil {
+		return fmt.Errorf("failed to truncate incomplete record in %s: %w", path, err)
+	}
+	fmt.Printf("Warning: truncated %d bytes of incomplete record at the end of %s\n", size-validSize, path)
+	return nil
 }
 
-func (db *Db) processRecovery(file *os.File, segment *Segment) error {
+func (db *Db) processRecovery(file io.Reader, segment *Segment) (int64, error) {
 	var err error
-	var buffer [bufferSize]byte
+	buffer := make([]byte, db.bufferSize)
 	var currentOffset int64
 
-	reader := bufio.NewReaderSize(file, bufferSize)
+	reader := bufio.NewReaderSize(file, db.bufferSize)
 	for err == nil {
 		var header, data []byte
 		var bytesRead int
 
-		header, err = reader.Peek(bufferSize)
+		header, err = reader.Peek(db.bufferSize)
 		if err == io.EOF {
 			if len(header) == 0 {
-				return err
+				break
 			}
 		} else if err != nil {
-			return err
+			return currentOffset, err
 		}
 
-		if len(header) < 4 {
-			return io.EOF
+		if len(header) < totalHeaderSize {
+			return currentOffset, errIncompleteRecord
 		}
 
-		recordSize := binary.LittleEndian.Uint32(header)
-		if recordSize == 0 || recordSize > uint32(bufferSize*10) {
-			return fmt.Errorf("invalid record size: %d", recordSize)
+		recordSize := binary.LittleEndian.Uint32(header) & recordSizeMask
+		if recordSize == 0 || recordSize > maxRecordSize {
+			return currentOffset, fmt.Errorf("invalid record size: %d", recordSize)
 		}
 
-		if recordSize < bufferSize {
+		if int(recordSize) <= len(buffer) {
 			data = buffer[:recordSize]
 		} else {
 			data = make([]byte, recordSize)
 		}
 
-		bytesRead, err = reader.Read(data)
+		bytesRead, err = io.ReadFull(reader, data)
+		if err == io.ErrUnexpectedEOF {
+			return currentOffset, errIncompleteRecord
+		}
 		if err == nil {
-			if bytesRead != int(recordSize) {
-				return fmt.Errorf("data corruption detected: expected %d bytes, got %d", recordSize, bytesRead)
+			var record entry
+			decodeErr := record.Decode(data)
+
+			// A newer format must not be mistaken for corruption and cut off.
+			if versionErr := checkRecordVersion(record.version); versionErr != nil {
+				return currentOffset, versionErr
 			}
 
-			var record entry
-			record.Decode(data)
+			// The size header was intact, so a malformed record can be
+			// skipped like one with a bad checksum.
+			if decodeErr != nil {
+				fmt.Printf("Warning: skipping malformed record at offset %d in %s: %v\n", currentOffset, segment.path, decodeErr)
+				currentOffset += int64(bytesRead)
+				continue
+			}
 
 			if checksumErr := record.verifyChecksum(); checksumErr != nil {
 				fmt.Printf("Warning: corrupted entry found during recovery for key '%s': %v\n", record.key, checksumErr)
@@ -402,86 +1180,398 @@ func (db *Db) processRecovery(file *os.File, segment *Segment) error {
 				continue
 			}
 
+			position := currentOffset
+			if record.tombstone {
+				position = tombstonePosition
+			}
 			segment.mu.Lock()
-			segment.keyIndex[record.key] = currentOffset
+			segment.setPositionLocked(record.key, position, record.expiresAt)
+			if record.version < currentRecordVersion {
+				segment.outdated = true
+			}
 			segment.mu.Unlock()
 
 			currentOffset += int64(bytesRead)
 		}
 	}
 
-	if segment == db.getCurrentSegment() {
-		db.currentOffset = currentOffset
+	if err == io.EOF {
+		return currentOffset, nil
 	}
-
-	return err
+	return currentOffset, err
 }
 
 func (db *Db) findKeyLocation(key string) (*Segment, int64, error) {
 	db.segmentLock.RLock()
 	defer db.segmentLock.RUnlock()
 
+	return db.findKeyLocationLocked(key)
+}
+
+// findKeyLocationLocked is findKeyLocation for callers holding segmentLock.
+func (db *Db) findKeyLocationLocked(key string) (*Segment, int64, error) {
 	for i := len(db.segments) - 1; i >= 0; i-- {
 		segment := db.segments[i]
+		if segment.missing.Load() {
+			continue
+		}
 		segment.mu.RLock()
 		position, found := segment.keyIndex[key]
 		segment.mu.RUnlock()
 
 		if found {
+			if position == tombstonePosition {
+				return nil, 0, ErrKeyNotFound
+			}
 			return segment, position, nil
 		}
 	}
-	return nil, 0, fmt.Errorf("key not found in datastore")
+	return nil, 0, ErrKeyNotFound
 }
 
-func (db *Db) getCurrentSegment() *Segment {
+// lookupKey is findKeyLocation, except that a key that has expired by now is
+// reported as missing. Keys, Count and the limits still see expired keys until
+// they are swept or compacted away.
+func (db *Db) lookupKey(key string, now int64) (*Segment, int64, error) {
 	db.segmentLock.RLock()
 	defer db.segmentLock.RUnlock()
 
-	if len(db.segments) == 0 {
-		return nil
+	segment, position, err := db.findKeyLocationLocked(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if segment.expired(key, now) {
+		return nil, 0, ErrKeyNotFound
 	}
-	return db.segments[len(db.segments)-1]
+	return segment, position, nil
 }
 
-func (segment *Segment) readFromSegment(position int64) (string, error) {
-	file, err := os.Open(segment.path)
-	if err != nil {
-		return "", err
+// liveKeys returns every key that is present, with newer segments shadowing
+// older ones and deleted keys left out.
+func (db *Db) liveKeys() []string {
+	var keys []string
+	db.forEachLiveKey(func(key string) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+func (db *Db) forEachLiveKey(fn func(key string)) {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+
+	db.forEachLiveKeyLocked(fn)
+}
+
+// forEachLiveKeyLocked is forEachLiveKey for callers holding segmentLock.
+func (db *Db) forEachLiveKeyLocked(fn func(key string)) {
+	seen := make(map[string]bool)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		segment := db.segments[i]
+		if segment.missing.Load() {
+			continue
+		}
+		segment.mu.RLock()
+		for key, position := range segment.keyIndex {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if position != tombstonePosition {
+				fn(key)
+			}
+		}
+		segment.mu.RUnlock()
 	}
-	defer file.Close()
+}
+
+// Has reports whether the key is present. An expired key is not, like for Get.
+func (db *Db) Has(key string) bool {
+	_, _, err := db.lookupKey(key, time.Now().UnixNano())
+	return err == nil
+}
+
+// Keys returns every present key outside of buckets in sorted order. Keys
+// stored with PutInBucket are not listed.
+func (db *Db) Keys() []string {
+	var keys []string
+	db.forEachLiveKey(func(key string) {
+		if !isBucketKey(key) {
+			keys = append(keys, key)
+		}
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// KV is a key with its value.
+type KV struct {
+	Key   string
+	Value string
+}
 
-	_, err = file.Seek(position, 0)
+// GetRange returns up to limit pairs in key order, skipping the first offset
+// keys, for paging through the database. An offset past the last key gives an
+// empty result. Keys deleted while the page is read are left out, so a page
+// may come back shorter than limit even if more keys follow.
+func (db *Db) GetRange(offset, limit int) ([]KV, error) {
+	if offset < 0 || limit < 0 {
+		return nil, fmt.Errorf("invalid range: offset %d, limit %d", offset, limit)
+	}
+
+	keys := db.Keys()
+	if offset >= len(keys) {
+		return []KV{}, nil
+	}
+	keys = keys[offset:]
+	if limit < len(keys) {
+		keys = keys[:limit]
+	}
+
+	values, err := db.GetMany(keys)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	pairs := make([]KV, 0, len(keys))
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			pairs = append(pairs, KV{Key: key, Value: value})
+		}
+	}
+	return pairs, nil
+}
+
+// Count returns the number of live keys outside of buckets, the keys Keys
+// lists. Keys shadowed by newer segments are counted once and deleted keys are
+// not counted. The count is kept up to date by writes, so Count does not go
+// over the keys.
+func (db *Db) Count() int {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+	return db.liveKeyCount - db.bucketKeyCount
+}
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+// storedKeyCount returns the number of live keys including those in buckets,
+// which is what WithMaxKeys limits.
+func (db *Db) storedKeyCount() int {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+	return db.liveKeyCount
+}
+
+// recountKeysLocked sets the key counts by going over every segment, for when
+// they have to be set from scratch. The caller holds segmentLock.
+func (db *Db) recountKeysLocked() {
+	db.liveKeyCount, db.bucketKeyCount = 0, 0
+	db.forEachLiveKeyLocked(func(key string) {
+		db.countKeyLocked(key, 1)
+	})
+}
+
+// DiskSize returns the total size of all segment files in bytes.
+func (db *Db) DiskSize() (int64, error) {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+
+	var total int64
+	for _, segment := range db.segments {
+		size, err := db.storage.Size(segment.path)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// SegmentStat describes one segment file.
+type SegmentStat struct {
+	Path string
+	Size int64
+	// Keys is the number of keys the segment holds a value for, including
+	// keys shadowed by newer segments.
+	Keys   int
+	Active bool
+}
+
+// SegmentInfo describes every segment, oldest first. The last segment is the
+// active one, unless the database is read-only.
+func (db *Db) SegmentInfo() ([]SegmentStat, error) {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+
+	stats := make([]SegmentStat, 0, len(db.segments))
+	for i, segment := range db.segments {
+		size, err := db.storage.Size(segment.path)
+		if err != nil {
+			return nil, err
+		}
+
+		keys := 0
+		segment.mu.RLock()
+		for _, position := range segment.keyIndex {
+			if position != tombstonePosition {
+				keys++
+			}
+		}
+		segment.mu.RUnlock()
+
+		stats = append(stats, SegmentStat{
+			Path:   segment.path,
+			Size:   size,
+			Keys:   keys,
+			Active: !db.readOnly && i == len(db.segments)-1,
+		})
+	}
+	return stats, nil
+}
+
+// Stats is a snapshot of the database as a whole.
+type Stats struct {
+	// Keys is the number of live keys outside of buckets, like Count.
+	Keys      int
+	Segments  int
+	DiskBytes int64
+	// Compactions is the number of compactions that completed since the
+	// database was opened, and LastCompaction when the latest one did. It is
+	// zero if none has.
+	Compactions          int64
+	LastCompaction       time.Time
+	CompactionInProgress bool
+	// WriteQueueDepth is the number of writes waiting for the write handler,
+	// out of WriteQueueCapacity. WritesBlocked counts the writes since the
+	// database was opened that found the queue full and had to wait.
+	WriteQueueDepth    int
+	WriteQueueCapacity int
+	WritesBlocked      int64
+	// OutdatedSegments is the number of segments holding records of an
+	// older format, which Upgrade rewrites.
+	OutdatedSegments int
+	// OpenReadFiles is the number of segment files kept open for reads.
+	OpenReadFiles int
+}
+
+// Stats reports the size of the database, the state of compaction and the
+// backlog of the write handler. A backup taken while CompactionInProgress is
+// false does not race with segment files being replaced.
+func (db *Db) Stats() (Stats, error) {
+	size, err := db.DiskSize()
 	if err != nil {
-		return "", err
+		return Stats{}, err
+	}
+	stats := Stats{
+		Keys:                 db.Count(),
+		Segments:             len(db.segmentList()),
+		DiskBytes:            size,
+		Compactions:          db.compactions.Load(),
+		CompactionInProgress: db.compactionInProgress.Load(),
+		WriteQueueDepth:      len(db.writeOperations),
+		WriteQueueCapacity:   cap(db.writeOperations),
+		WritesBlocked:        db.writesBlocked.Load(),
+		OutdatedSegments:     db.outdatedSegments(),
+		OpenReadFiles:        db.handles.size(),
 	}
-	return value, nil
+	if last := db.lastCompaction.Load(); last != 0 {
+		stats.LastCompaction = time.Unix(0, last)
+	}
+	return stats, nil
 }
 
-func (segment *Segment) readFromSegmentWithChecksum(position int64) (string, error) {
-	file, err := os.Open(segment.path)
+// markMissing makes lookups skip the segment after its file was found to be
+// missing. Keys are counted again, since older values may now show through.
+func (db *Db) markMissing(segment *Segment) {
+	db.segmentLock.Lock()
+	defer db.segmentLock.Unlock()
+
+	if segment.missing.CompareAndSwap(false, true) {
+		fmt.Printf("Warning: segment file %s is missing, reading older segments instead\n", segment.path)
+		db.recountKeysLocked()
+	}
+}
+
+// setPositionLocked records the position of the key's newest record in the
+// segment and when the record expires, zero meaning never. The caller holds mu
+// unless no one else can see the segment yet.
+func (segment *Segment) setPositionLocked(key string, position, expiresAt int64) {
+	segment.keyIndex[key] = position
+	if expiresAt == 0 {
+		delete(segment.expiries, key)
+		return
+	}
+	if segment.expiries == nil {
+		segment.expiries = make(map[string]int64)
+	}
+	segment.expiries[key] = expiresAt
+}
+
+// expired reports whether the key's record in the segment has expired by now.
+func (segment *Segment) expired(key string, now int64) bool {
+	segment.mu.RLock()
+	defer segment.mu.RUnlock()
+
+	expiresAt, found := segment.expiries[key]
+	return found && now >= expiresAt
+}
+
+func (segment *Segment) acquire() {
+	segment.refs.Add(1)
+}
+
+func (segment *Segment) release() {
+	if segment.refs.Add(-1) == 0 && segment.retired.Load() {
+		segment.removeFile()
+	}
+}
+
+// retire marks a segment as no longer part of the database and removes its
+// file as soon as no reader holds it.
+func (segment *Segment) retire() {
+	segment.retired.Store(true)
+	if segment.refs.Load() == 0 {
+		segment.removeFile()
+	}
+}
+
+func (segment *Segment) removeFile() {
+	segment.removeOnce.Do(func() {
+		segment.handles.drop(segment)
+		err := segment.storage.Remove(segment.path)
+		if segment.onRemove != nil {
+			segment.onRemove(err)
+		}
+	})
+}
+
+func (segment *Segment) readFromSegment(position int64) (string, error) {
+	file, release, err := segment.handles.open(segment)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
+	defer release()
 
-	_, err = file.Seek(position, 0)
+	return readValueAt(file, position)
+}
+
+func (segment *Segment) readFromSegmentWithChecksum(position int64) (string, error) {
+	return segment.readValueAsOf(position, time.Now().UnixNano())
+}
+
+// readValueAsOf is readFromSegmentWithChecksum with expiry evaluated at now,
+// in Unix nanoseconds, rather than the current time.
+func (segment *Segment) readValueAsOf(position, now int64) (string, error) {
+	file, release, err := segment.handles.open(segment)
 	if err != nil {
 		return "", err
 	}
+	defer release()
 
-	reader := bufio.NewReader(file)
-
-	value, err := readValue(reader)
+	record, err := readRecordAt(file, position)
 	if err != nil {
 		return "", fmt.Errorf("checksum verification failed: %w", err)
 	}
+	if record.expired(now) {
+		return "", ErrKeyNotFound
+	}
 
-	return value, nil
+	return record.value, nil
 }
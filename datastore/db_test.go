@@ -1,18 +1,24 @@
 package datastore
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 const (
-	testSegmentSize    = 45 
-	smallSegmentSize   = 35
-	compactionWaitTime = 2 * time.Second
+	testSegmentSize  = 45 
+	smallSegmentSize = 35
 )
 
 func TestDb_Put(t *testing.T) {
@@ -44,8 +50,6 @@ func TestDb_Put(t *testing.T) {
 				t.Errorf("Failed to put key %s: %v", pair.key, err)
 			}
 
-			time.Sleep(10 * time.Millisecond)
-
 			retrievedValue, err := database.Get(pair.key)
 			if err != nil {
 				t.Errorf("Failed to get key %s: %v", pair.key, err)
@@ -58,7 +62,6 @@ func TestDb_Put(t *testing.T) {
 	})
 
 	t.Run("database recovery after restart", func(t *testing.T) {
-		time.Sleep(100 * time.Millisecond)
 		database.Close()
 
 		recoveredDb, err := createTestDatabase(tempDir, 10)
@@ -95,20 +98,11 @@ func TestDb_Segmentation(t *testing.T) {
 
 	t.Run("segment creation on size limit", func(t *testing.T) {
 		database.Put("1", "v1")
-		time.Sleep(50 * time.Millisecond)
-
 		database.Put("2", "v2")
-		time.Sleep(50 * time.Millisecond)
-
 		database.Put("3", "v3")
-		time.Sleep(50 * time.Millisecond)
-
 		database.Put("2", "v5")
-		time.Sleep(50 * time.Millisecond)
 
-		time.Sleep(200 * time.Millisecond)
-
-		finalSegmentCount := len(database.segments)
+		finalSegmentCount := len(database.segmentList())
 		if finalSegmentCount < 2 {
 			t.Errorf("Expected at least 2 segments due to size limit, got %d", finalSegmentCount)
 		}
@@ -119,17 +113,26 @@ func TestDb_Segmentation(t *testing.T) {
 		database.Put("5", "v5")
 		database.Put("6", "v6")
 
-		time.Sleep(200 * time.Millisecond)
-
-		segmentCountBeforeCompaction := len(database.segments)
+		segmentCountBeforeCompaction := len(database.segmentList())
 		if segmentCountBeforeCompaction >= 3 {
-			time.Sleep(compactionWaitTime)
+			database.waitForCompaction()
 
-			segmentCountAfterCompaction := len(database.segments)
-			if segmentCountAfterCompaction >= segmentCountBeforeCompaction {
-				t.Errorf("Compaction should reduce segment count: before %d, after %d",
+			segments := database.segmentList()
+			segmentCountAfterCompaction := len(segments)
+			if segmentCountAfterCompaction > segmentCountBeforeCompaction {
+				t.Errorf("Compaction should not increase segment count: before %d, after %d",
 					segmentCountBeforeCompaction, segmentCountAfterCompaction)
 			}
+
+			keySegments := make(map[string]string)
+			for _, segment := range segments[:len(segments)-1] {
+				for key := range segment.keyIndex {
+					if previous, found := keySegments[key]; found {
+						t.Errorf("Key %s kept in both %s and %s after compaction", key, previous, segment.path)
+					}
+					keySegments[key] = segment.path
+				}
+			}
 		}
 	})
 
@@ -146,7 +149,7 @@ func TestDb_Segmentation(t *testing.T) {
 	})
 
 	t.Run("compacted segment is not empty and valid", func(t *testing.T) {
-		compactedSegmentFile, err := os.Open(database.segments[0].path)
+		compactedSegmentFile, err := os.Open(database.segmentList()[0].path)
 		if err != nil {
 			t.Error(err)
 			return
@@ -169,7 +172,7 @@ func TestDb_Segmentation(t *testing.T) {
 }
 
 func createTestDatabase(directory string, segmentSize int64) (*Db, error) {
-	return CreateDb(directory, segmentSize)
+	return CreateDb(directory, WithMaxSegmentSize(segmentSize))
 }
 
 func TestDb_ParallelOperations(t *testing.T) {
@@ -198,8 +201,6 @@ func TestDb_ParallelOperations(t *testing.T) {
 			}
 		}
 
-		time.Sleep(500 * time.Millisecond)
-
 		var wg sync.WaitGroup
 		errors := make(chan error, numKeys)
 
@@ -260,8 +261,6 @@ func TestDb_ParallelOperations(t *testing.T) {
 			t.Error(err)
 		}
 
-		time.Sleep(1 * time.Second)
-
 		for workerID := 0; workerID < numWorkers; workerID++ {
 			for j := 0; j < keysPerWorker; j++ {
 				key := fmt.Sprintf("worker_%d_key_%d", workerID, j)
@@ -303,8 +302,6 @@ func TestDb_ParallelOperations(t *testing.T) {
 
 		wg.Wait()
 
-		time.Sleep(1 * time.Second)
-
 		finalValue, err := database.Get(key)
 		if err != nil {
 			t.Errorf("Failed to get final value: %v", err)
@@ -344,8 +341,6 @@ func TestDb_MixedConcurrentOperations(t *testing.T) {
 		database.Put(key, value)
 	}
 
-	time.Sleep(100 * time.Millisecond)
-
 	var wg sync.WaitGroup
 	errors := make(chan error, 100)
 
@@ -426,4 +421,2089 @@ func TestDb_ConcurrentClose(t *testing.T) {
 	if err != nil {
 		t.Errorf("Second close should not fail: %v", err)
 	}
-}
\ No newline at end of file
+}
+func TestDb_TornWriteRecovery(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "torn_write_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	segmentPath := database.activeFilePath
+	database.Close()
+
+	fileInfo, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validSize := fileInfo.Size()
+
+	torn := (&entry{key: "key3", value: "value3"}).Encode()
+	file, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(torn[:len(torn)/2]); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	recoveredDb, err := createTestDatabase(tempDir, 1000)
+	if err != nil {
+		t.Fatalf("Recovery should succeed with a torn final write: %v", err)
+	}
+	defer recoveredDb.Close()
+
+	for key, expectedValue := range map[string]string{"key1": "value1", "key2": "value2"} {
+		value, err := recoveredDb.Get(key)
+		if err != nil {
+			t.Errorf("Failed to get key %s after recovery: %v", key, err)
+		} else if value != expectedValue {
+			t.Errorf("Value mismatch for key %s: expected %s, got %s", key, expectedValue, value)
+		}
+	}
+
+	if _, err := recoveredDb.Get("key3"); err == nil {
+		t.Error("Torn record should not be recovered")
+	}
+
+	fileInfo, err = os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Size() != validSize {
+		t.Errorf("Expected segment to be truncated to %d bytes, got %d", validSize, fileInfo.Size())
+	}
+}
+
+func TestDb_ContextOperations(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "context_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	t.Run("put and get with live context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if err := database.PutContext(ctx, "key", "value"); err != nil {
+			t.Fatalf("Failed to put key: %v", err)
+		}
+
+		value, err := database.GetContext(ctx, "key")
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+		if value != "value" {
+			t.Errorf("Value mismatch: expected value, got %s", value)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := database.GetContext(ctx, "key"); err != context.Canceled {
+			t.Errorf("Expected context.Canceled from GetContext, got %v", err)
+		}
+	})
+}
+
+func TestDb_PutBatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "batch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		pairs[fmt.Sprintf("batch_key_%d", i)] = fmt.Sprintf("batch_value_%d", i)
+	}
+
+	if err := database.PutBatch(pairs); err != nil {
+		t.Fatalf("Failed to put batch: %v", err)
+	}
+
+	for key, expectedValue := range pairs {
+		value, err := database.Get(key)
+		if err != nil {
+			t.Errorf("Failed to get key %s: %v", key, err)
+		} else if value != expectedValue {
+			t.Errorf("Value mismatch for key %s: expected %s, got %s", key, expectedValue, value)
+		}
+	}
+
+	database.Close()
+
+	recoveredDb, err := createTestDatabase(tempDir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recoveredDb.Close()
+
+	for key, expectedValue := range pairs {
+		value, err := recoveredDb.Get(key)
+		if err != nil {
+			t.Errorf("Failed to get key %s after recovery: %v", key, err)
+		} else if value != expectedValue {
+			t.Errorf("Value mismatch after recovery for key %s: expected %s, got %s", key, expectedValue, value)
+		}
+	}
+}
+
+// syncBlockingStorage is a MemoryStorage whose files opened for appending
+// while blocking is set stall in Sync until release is closed. entered is
+// closed once the first such Sync starts.
+type syncBlockingStorage struct {
+	*MemoryStorage
+	blocking    atomic.Bool
+	entered     chan struct{}
+	enteredOnce sync.Once
+	release     chan struct{}
+}
+
+func (s *syncBlockingStorage) OpenAppend(path string, mode os.FileMode) (segmentFile, error) {
+	file, err := s.MemoryStorage.OpenAppend(path, mode)
+	if err != nil || !s.blocking.Load() {
+		return file, err
+	}
+	return syncBlockingFile{file, s}, nil
+}
+
+type syncBlockingFile struct {
+	segmentFile
+	storage *syncBlockingStorage
+}
+
+func (f syncBlockingFile) Sync() error {
+	f.storage.enteredOnce.Do(func() { close(f.storage.entered) })
+	<-f.storage.release
+	return f.segmentFile.Sync()
+}
+
+func TestDb_PutBatchDuringCompaction(t *testing.T) {
+	storage := &syncBlockingStorage{
+		MemoryStorage: NewMemoryStorage(),
+		entered:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	database, err := CreateDb("mem", WithMaxSegmentSize(200), func(db *Db) { db.storage = storage })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// A compaction is triggered but waits for compactionLock, so its
+	// snapshot of the segments is taken only once the lock is released.
+	database.compactionLock.Lock()
+	for i := 0; i < 2; i++ {
+		if err := database.Rollover(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The batch rolls over, and its final Sync on the new segment stalls
+	// with the batch records appended but not yet indexed.
+	storage.blocking.Store(true)
+	pairs := make(map[string]string)
+	for i := 0; i < 12; i++ {
+		pairs[fmt.Sprintf("batch_key_%d", i)] = fmt.Sprintf("batch_value_%d", i)
+	}
+	written := make(chan error, 1)
+	go func() {
+		written <- database.PutBatch(pairs)
+	}()
+	select {
+	case <-storage.entered:
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Give the waiting compaction the chance to run over the batch's
+	// segments before the batch indexes them.
+	database.compactionLock.Unlock()
+	for deadline := time.Now().Add(100 * time.Millisecond); database.compactions.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	close(storage.release)
+
+	if err := <-written; err != nil {
+		t.Fatalf("Failed to put batch: %v", err)
+	}
+	database.waitForCompaction()
+	for key, expectedValue := range pairs {
+		if value, err := database.Get(key); err != nil || value != expectedValue {
+			t.Errorf("Expected %s to be %s after the compaction, got %q, %v", key, expectedValue, value, err)
+		}
+	}
+}
+
+func TestDb_FilePrefix(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "prefix_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := ioutil.WriteFile(tempDir+"/users-backup", []byte("not a segment"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := CreateDb(tempDir, WithMaxSegmentSize(1000), WithFilePrefix("users-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := CreateDb(tempDir, WithMaxSegmentSize(1000), WithFilePrefix("orders-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := users.Put("1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := orders.Put("1", "book"); err != nil {
+		t.Fatal(err)
+	}
+	users.Close()
+	orders.Close()
+
+	users, err = CreateDb(tempDir, WithMaxSegmentSize(1000), WithFilePrefix("users-"))
+	if err != nil {
+		t.Fatalf("Stray file should not be treated as a segment: %v", err)
+	}
+	defer users.Close()
+
+	value, err := users.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "alice" {
+		t.Errorf("Stores with different prefixes collided: expected alice, got %s", value)
+	}
+}
+
+func TestDb_OverlappingFilePrefixes(t *testing.T) {
+	tempDir := t.TempDir()
+
+	for _, prefix := range []string{"db1", "db_", ""} {
+		if _, err := CreateDb(tempDir, WithFilePrefix(prefix)); err == nil {
+			t.Errorf("Expected prefix %q to be rejected", prefix)
+		}
+	}
+
+	short, err := CreateDb(tempDir, WithMaxSegmentSize(smallSegmentSize), WithFilePrefix("db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := CreateDb(tempDir, WithMaxSegmentSize(smallSegmentSize), WithFilePrefix("db1-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := long.Put(fmt.Sprintf("long%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := short.Put(fmt.Sprintf("short%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	short.Close()
+	long.Close()
+
+	short, err = CreateDb(tempDir, WithMaxSegmentSize(smallSegmentSize), WithFilePrefix("db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer short.Close()
+	if _, err := short.Get("long0"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the store with the shorter prefix to leave the other one's files alone, got %v", err)
+	}
+
+	long, err = CreateDb(tempDir, WithMaxSegmentSize(smallSegmentSize), WithFilePrefix("db1-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer long.Close()
+	for i := 0; i < 10; i++ {
+		if value, err := long.Get(fmt.Sprintf("long%d", i)); err != nil || value != "value" {
+			t.Errorf("Expected long%d to survive the other store, got %q, %v", i, value, err)
+		}
+	}
+}
+
+func TestDb_RecoveryAfterCompaction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "compaction_recovery_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, smallSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 12; i++ {
+		if err := database.Put("key", fmt.Sprintf("v%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database.Close()
+
+	recoveredDb, err := createTestDatabase(tempDir, smallSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recoveredDb.Close()
+
+	value, err := recoveredDb.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "v11" {
+		t.Errorf("Expected newest value v11 after recovery, got %s", value)
+	}
+}
+
+func TestDb_Delete(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "delete_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("delete existing key", func(t *testing.T) {
+		if err := database.Delete("key"); err != nil {
+			t.Fatalf("Failed to delete key: %v", err)
+		}
+		if _, err := database.Get("key"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound after delete, got %v", err)
+		}
+	})
+
+	t.Run("delete missing key", func(t *testing.T) {
+		if err := database.Delete("missing"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound, got %v", err)
+		}
+	})
+
+	t.Run("delete survives restart", func(t *testing.T) {
+		database.Close()
+
+		recoveredDb, err := createTestDatabase(tempDir, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer recoveredDb.Close()
+
+		if _, err := recoveredDb.Get("key"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound after recovery, got %v", err)
+		}
+		if value, err := recoveredDb.Get("other"); err != nil || value != "value" {
+			t.Errorf("Expected other key to survive, got %q, %v", value, err)
+		}
+	})
+}
+
+func TestDb_CountAndDiskSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "count_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if count := database.Count(); count != 0 {
+		t.Errorf("Expected empty store to have 0 keys, got %d", count)
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			if err := database.Put(key, fmt.Sprintf("%s%d", key, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := database.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := database.Count(); count != 2 {
+		t.Errorf("Expected 2 live keys, got %d", count)
+	}
+
+	size, err := database.DiskSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size <= 0 {
+		t.Errorf("Expected positive disk size, got %d", size)
+	}
+}
+
+func TestDb_CountTracksChanges(t *testing.T) {
+	dir := t.TempDir()
+	database, err := CreateDb(dir, WithMaxSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectCount := func(expected int) {
+		t.Helper()
+		if count, scanned := database.Count(), len(database.liveKeys()); count != expected || scanned != expected {
+			t.Errorf("Expected %d keys, got a count of %d and %d keys scanned", expected, count, scanned)
+		}
+	}
+
+	for _, key := range []string{"a", "b", "c", "a"} {
+		if err := database.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCount(3)
+	if err := database.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(2)
+	if err := database.PutBatch(map[string]string{"b": "value", "c": "value", "d": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(4)
+
+	// Expired keys are counted until compaction drops them, unless a newer
+	// value shadows them.
+	for _, key := range []string{"e", "g"} {
+		if err := database.PutWithTTL(key, "old", time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := database.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("g", "new"); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(6)
+	time.Sleep(5 * time.Millisecond)
+	if err := database.compactSegments(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(5)
+
+	database.Close()
+	database, err = CreateDb(dir, WithMaxSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	expectCount(5)
+
+	if err := database.DropAll(); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(0)
+}
+
+func TestDb_ConcurrentRecovery(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "concurrent_recovery_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	pairs := make(map[string]string)
+	for i := 0; i < 8; i++ {
+		segment := make([]byte, 0)
+		for j := 0; j < 10; j++ {
+			key := fmt.Sprintf("key_%d_%d", i, j)
+			pairs[key] = fmt.Sprintf("value_%d_%d", i, j)
+			segment = append(segment, (&entry{key: key, value: pairs[key]}).Encode()...)
+		}
+		path := fmt.Sprintf("%s/%s%d", tempDir, dataFileName, i)
+		if err := ioutil.WriteFile(path, segment, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	database, err := createTestDatabase(tempDir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for key, expectedValue := range pairs {
+		value, err := database.Get(key)
+		if err != nil {
+			t.Errorf("Failed to get key %s: %v", key, err)
+		} else if value != expectedValue {
+			t.Errorf("Value mismatch for key %s: expected %s, got %s", key, expectedValue, value)
+		}
+	}
+}
+
+func TestDb_RecoveryErrorIsReported(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "recovery_error_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	valid := (&entry{key: "key", value: "value"}).Encode()
+	if err := ioutil.WriteFile(tempDir+"/"+dataFileName+"0", valid, 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := make([]byte, totalHeaderSize)
+	if err := ioutil.WriteFile(tempDir+"/"+dataFileName+"1", invalid, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := createTestDatabase(tempDir, 1000); err == nil {
+		t.Error("Expected recovery error for a segment with an invalid record")
+	}
+}
+
+func TestDb_CompactionRespectsSegmentSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "bounded_compaction_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const segmentSize = 150
+
+	database, err := createTestDatabase(tempDir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key_%02d", i)
+		if err := database.Put(key, fmt.Sprintf("value_%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database.waitForCompaction()
+
+	database.segmentLock.RLock()
+	for _, segment := range database.segments {
+		fileInfo, err := os.Stat(segment.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fileInfo.Size() > segmentSize {
+			t.Errorf("Segment %s has %d bytes, exceeding the %d byte limit", segment.path, fileInfo.Size(), segmentSize)
+		}
+	}
+	database.segmentLock.RUnlock()
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key_%02d", i)
+		if _, err := database.Get(key); err != nil {
+			t.Errorf("Key %s lost after compaction: %v", key, err)
+		}
+	}
+}
+
+func TestDb_ReadsDuringCompaction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "compaction_stress_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	const numKeys = 20
+	for i := 0; i < numKeys; i++ {
+		if err := database.Put(fmt.Sprintf("key_%d", i), "initial"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	errors := make(chan error, 100)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(readerID int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key_%d", (readerID+j)%numKeys)
+				if _, err := database.Get(key); err != nil {
+					select {
+					case errors <- fmt.Errorf("Reader %d failed to get %s: %v", readerID, key, err):
+					default:
+					}
+					return
+				}
+			}
+		}(i)
+	}
+
+	for round := 0; round < 30; round++ {
+		for i := 0; i < numKeys; i++ {
+			if err := database.Put(fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	close(done)
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		t.Error(err)
+	}
+}
+
+func TestDb_Sync(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sync_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				database.Put(fmt.Sprintf("sync_%d_%d", workerID, j), "value")
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		if err := database.Sync(); err != nil {
+			t.Errorf("Sync failed during writes: %v", err)
+		}
+	}
+	wg.Wait()
+
+	database.Close()
+	if err := database.Sync(); err == nil {
+		t.Error("Expected Sync on a closed database to fail")
+	}
+}
+
+func TestDb_OpenReadOnly(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "read_only_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+
+	filesBefore, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readOnlyDb, err := OpenReadOnly(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnlyDb.Close()
+
+	if value, err := readOnlyDb.Get("a"); err != nil || value != "1" {
+		t.Errorf("Expected a=1, got %q, %v", value, err)
+	}
+	if !readOnlyDb.Has("b") || readOnlyDb.Has("c") {
+		t.Error("Has reported wrong key presence")
+	}
+	if keys := readOnlyDb.Keys(); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+	if err := readOnlyDb.Put("c", "3"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Put, got %v", err)
+	}
+
+	filesAfter, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesAfter) != len(filesBefore) {
+		t.Errorf("Read-only open changed the directory: %d files before, %d after", len(filesBefore), len(filesAfter))
+	}
+}
+
+func TestDb_GetMany(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "get_many_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := database.Put(fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values, err := database.GetMany([]string{"key_1", "key_7", "missing"})
+	if err != nil {
+		t.Fatalf("Failed to get many: %v", err)
+	}
+	if len(values) != 2 || values["key_1"] != "value_1" || values["key_7"] != "value_7" {
+		t.Errorf("Unexpected values %v", values)
+	}
+
+	keys := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("key_%d", i%12))
+	}
+	values, err = database.GetMany(keys)
+	if err != nil {
+		t.Fatalf("Failed to get many: %v", err)
+	}
+	if len(values) != 10 {
+		t.Errorf("Expected 10 values for more keys than workers, got %v", values)
+	}
+	for i := 0; i < 10; i++ {
+		if values[fmt.Sprintf("key_%d", i)] != fmt.Sprintf("value_%d", i) {
+			t.Errorf("Unexpected value for key_%d: %q", i, values[fmt.Sprintf("key_%d", i)])
+		}
+	}
+}
+
+func BenchmarkDb_GetMany(b *testing.B) {
+	database, err := createTestDatabase(b.TempDir(), 64*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer database.Close()
+
+	value := strings.Repeat("v", 4096)
+	keys := make([]string, 256)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		if err := database.Put(keys[i], value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{1, getManyWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := database.getMany(keys, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDb_RecoveryRejectsNewerRecordVersion(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "version_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	record := entry{key: "key", value: "value"}
+	data := record.Encode()
+	data[3] = data[3]&0x0F | byte(currentRecordVersion+1)<<4
+	path := filepath.Join(tempDir, dataFileName+"0")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := createTestDatabase(tempDir, 1024); err == nil {
+		t.Fatal("expected opening a segment with a newer record version to fail")
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(data)) {
+		t.Error("segment with a newer record version must not be truncated")
+	}
+}
+
+func TestDb_MaxKeySize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "key_size_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	largest := strings.Repeat("k", MaxKeySize)
+	if err := database.Put(largest, "value"); err != nil {
+		t.Errorf("Expected a key of MaxKeySize bytes to be accepted: %v", err)
+	}
+
+	oversized := largest + "k"
+	if err := database.Put(oversized, "value"); err == nil {
+		t.Error("Expected an oversized key to be rejected")
+	}
+	if err := database.PutBatch(map[string]string{oversized: "value"}); err == nil {
+		t.Error("Expected an oversized key to be rejected in a batch")
+	}
+	if err := database.PutInBucket("bucket", largest, "value"); err == nil {
+		t.Error("Expected a bucket key over MaxKeySize to be rejected")
+	}
+}
+
+func TestDb_RecoverySkipsMalformedRecord(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "malformed_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	first := entry{key: "first", value: "value1"}
+	malformed := entry{key: "bad", value: "value2"}
+	last := entry{key: "last", value: "value3"}
+
+	broken := malformed.Encode()
+	binary.LittleEndian.PutUint32(broken[headerSize:], uint32(len(broken)))
+
+	var data []byte
+	data = append(data, first.Encode()...)
+	data = append(data, broken...)
+	data = append(data, last.Encode()...)
+	if err := os.WriteFile(filepath.Join(tempDir, dataFileName+"0"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := createTestDatabase(tempDir, 1024)
+	if err != nil {
+		t.Fatalf("Expected recovery to skip the malformed record: %v", err)
+	}
+	defer database.Close()
+
+	for _, record := range []entry{first, last} {
+		if value, err := database.Get(record.key); err != nil || value != record.value {
+			t.Errorf("Expected %s=%s after recovery, got %q, %v", record.key, record.value, value, err)
+		}
+	}
+	if database.Has("bad") {
+		t.Error("Malformed record should not be indexed")
+	}
+}
+
+func TestDb_GetSet(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "get_set_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	old, existed, err := database.GetSet("key", "first")
+	if err != nil || existed || old != "" {
+		t.Fatalf("Expected no previous value, got %q, %t, %v", old, existed, err)
+	}
+	old, existed, err = database.GetSet("key", "second")
+	if err != nil || !existed || old != "first" {
+		t.Fatalf("Expected previous value first, got %q, %t, %v", old, existed, err)
+	}
+	if value, _ := database.Get("key"); value != "second" {
+		t.Errorf("Expected the new value to be stored, got %q", value)
+	}
+
+	// Every writer must see a different previous value: no two GetSet calls
+	// may read the same state.
+	const writers = 50
+	var wg sync.WaitGroup
+	seen := make(chan string, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			old, _, err := database.GetSet("counter", fmt.Sprintf("value_%d", i))
+			if err != nil {
+				t.Errorf("GetSet failed: %v", err)
+				return
+			}
+			seen <- old
+		}(i)
+	}
+	wg.Wait()
+	close(seen)
+
+	previous := make(map[string]bool)
+	for old := range seen {
+		if previous[old] {
+			t.Errorf("Previous value %q returned twice", old)
+		}
+		previous[old] = true
+	}
+}
+
+func TestDb_Increment(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "increment_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if value, err := database.Increment("counter", 5); err != nil || value != 5 {
+		t.Fatalf("Expected a missing key to count as zero, got %d, %v", value, err)
+	}
+	if value, err := database.Increment("counter", -7); err != nil || value != -2 {
+		t.Fatalf("Expected -2, got %d, %v", value, err)
+	}
+
+	const workers, increments = 10, 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if _, err := database.Increment("counter", 1); err != nil {
+					t.Errorf("Increment failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := database.Get("counter"); value != fmt.Sprint(workers*increments-2) {
+		t.Errorf("Expected no lost increments, got %s", value)
+	}
+
+	database.Put("text", "not a number")
+	if _, err := database.Increment("text", 1); err == nil {
+		t.Error("Expected error for a non-integer value")
+	}
+	if value, _ := database.Get("text"); value != "not a number" {
+		t.Errorf("Failed increment should not change the value, got %q", value)
+	}
+}
+
+func TestDb_Append(t *testing.T) {
+	database, err := createTestDatabase(t.TempDir(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if length, err := database.Append("list", "a"); err != nil || length != 1 {
+		t.Fatalf("Expected a missing key to count as empty, got %d, %v", length, err)
+	}
+
+	const workers, appends = 10, 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < appends; j++ {
+				if _, err := database.Append("list", "x"); err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := database.Get("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "a"+strings.Repeat("x", workers*appends) {
+		t.Errorf("Expected no lost appends, got %d bytes", len(value))
+	}
+	if length, err := database.Append("list", "yz"); err != nil || length != len(value)+2 {
+		t.Errorf("Expected length %d, got %d, %v", len(value)+2, length, err)
+	}
+}
+
+func TestDb_SegmentInfo(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "segment_info_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := database.Put(fmt.Sprintf("key_%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := database.Delete("key_0"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := database.SegmentInfo()
+	if err != nil {
+		t.Fatalf("Failed to get segment info: %v", err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("Expected a single segment, got %+v", stats)
+	}
+
+	diskSize, _ := database.DiskSize()
+	stat := stats[0]
+	if !stat.Active || stat.Keys != 2 || stat.Size != diskSize || filepath.Dir(stat.Path) != tempDir {
+		t.Errorf("Unexpected segment stat %+v", stat)
+	}
+}
+
+func TestDb_Rollover(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "rollover_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Rollover(); err != nil {
+		t.Fatalf("Failed to roll over: %v", err)
+	}
+	if err := database.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := database.SegmentInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Keys != 1 || stats[0].Active || stats[1].Keys != 1 || !stats[1].Active {
+		t.Fatalf("Expected each key in its own segment, got %+v", stats)
+	}
+
+	database.Close()
+	database, err = createTestDatabase(tempDir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for key, expected := range map[string]string{"key1": "value1", "key2": "value2"} {
+		if value, err := database.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s=%s after reopening, got %q, %v", key, expected, value, err)
+		}
+	}
+}
+
+func TestDb_WritesAcrossRollover(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "rollover_index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Each record takes 48 bytes, so every segment holds exactly two.
+	database, err := createTestDatabase(tempDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+		if err := database.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+
+		// Every key must be indexed in the segment whose file holds it.
+		stats, err := database.SegmentInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := stats[len(stats)-1]; !last.Active || last.Keys != 2-(i+1)%2 {
+			t.Fatalf("After writing %s: unexpected active segment %+v", key, last)
+		}
+
+		for key, value := range expected {
+			if got, err := database.Get(key); err != nil || got != value {
+				t.Fatalf("Expected %s=%s, got %q, %v", key, value, got, err)
+			}
+		}
+	}
+
+	database.Close()
+	database, err = createTestDatabase(tempDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	for key, value := range expected {
+		if got, err := database.Get(key); err != nil || got != value {
+			t.Errorf("Expected %s=%s after reopening, got %q, %v", key, value, got, err)
+		}
+	}
+}
+
+func TestDb_CompactionErrorKeepsSegments(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "compaction_error_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if err := database.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the value of key1 so the merge cannot read it.
+	stats, _ := database.SegmentInfo()
+	corruptPath := stats[0].Path
+	data, err := os.ReadFile(corruptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[headerSize+keyLengthSize+len("key1")+valueLengthSize] ^= 0xFF
+	if err := os.WriteFile(corruptPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.compactOldSegments(); err == nil {
+		t.Fatal("Expected compaction to fail on an unreadable value")
+	}
+
+	stats, err = database.SegmentInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 || stats[0].Path != corruptPath {
+		t.Errorf("Expected the segments to stay in place, got %+v", stats)
+	}
+	if value, err := database.Get("key2"); err != nil || value != "value2" {
+		t.Errorf("Expected key2 to stay readable, got %q, %v", value, err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(tempDir, "*"+compactionSuffix)); len(matches) != 0 {
+		t.Errorf("Expected no leftover compaction outputs, got %v", matches)
+	}
+}
+
+func TestDb_RecoveryAfterCrashInCompaction(t *testing.T) {
+	storage := NewMemoryStorage()
+	database, err := CreateDb("mem", WithMemoryStorage(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.Put("deleted", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader keeps the file of the oldest segment, which holds the value,
+	// while the newer one holding the tombstone is removed by the compaction.
+	// The process then dies before the reader is done.
+	oldest := database.segmentList()[0]
+	oldest.acquire()
+	if err := database.compactSegments(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Size(oldest.path); err != nil {
+		t.Fatalf("Expected the file of the held segment to remain, got %v", err)
+	}
+	database.lockFile.Close()
+
+	for _, open := range []func() (*Db, error){
+		func() (*Db, error) { return OpenReadOnly("mem", WithMemoryStorage(storage)) },
+		func() (*Db, error) { return CreateDb("mem", WithMemoryStorage(storage)) },
+	} {
+		recovered, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := recovered.Get("deleted"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected the deleted key to stay deleted after the crash, got %v", err)
+		}
+		if value, err := recovered.Get("kept"); err != nil || value != "value" {
+			t.Errorf("Expected kept to survive the crash, got %q, %v", value, err)
+		}
+		if recovered.readOnly {
+			if _, err := storage.Size(oldest.path); err != nil {
+				t.Errorf("Expected a read-only open to leave the files alone, got %v", err)
+			}
+		}
+		recovered.Close()
+	}
+
+	files, _ := storage.List("mem")
+	for _, file := range files {
+		if file == filepath.Base(oldest.path) || strings.HasSuffix(file, manifestSuffix) {
+			t.Errorf("Expected recovery to remove %s", file)
+		}
+	}
+}
+
+func TestDb_RecoveryRemovesStaleCompactionFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	stale := []string{dataFileName + "5_1" + compactionSuffix, dataFileName + "5_1" + manifestSuffix + compactionSuffix}
+	for _, name := range append(stale, "other5_1"+compactionSuffix) {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	database, err := CreateDb(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for _, name := range stale {
+		if _, err := os.Stat(filepath.Join(tempDir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "other5_1"+compactionSuffix)); err != nil {
+		t.Errorf("Expected files of other prefixes to be left alone, got %v", err)
+	}
+}
+
+func TestDb_CompactionRemovesManifest(t *testing.T) {
+	tempDir := t.TempDir()
+	database, err := CreateDb(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := database.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := database.Rollover(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database.waitForCompaction()
+
+	if matches, _ := filepath.Glob(filepath.Join(tempDir, "*"+manifestSuffix)); len(matches) != 0 {
+		t.Errorf("Expected the manifest to be removed with the merged segments, got %v", matches)
+	}
+	if value, err := database.Get("key"); err != nil || value != "value1" {
+		t.Errorf("Expected value1, got %q, %v", value, err)
+	}
+}
+
+func TestDb_CompactionKeepsNewestValue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "newest_wins_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writes := [][]string{
+		{"v1", "v2", "v3"},
+		{"v4", "v5"},
+		{"v6"},
+	}
+	for i, values := range writes {
+		for _, value := range values {
+			if err := database.Put("key", value); err != nil {
+				t.Fatal(err)
+			}
+			if err := database.Put("other_"+value, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i < len(writes)-1 {
+			if err := database.Rollover(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Reopening recovers the indices from the files, then compaction merges
+	// every segment written above.
+	database.Close()
+	database, err = createTestDatabase(tempDir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.compactOldSegments(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+
+	if value, err := database.Get("key"); err != nil || value != "v6" {
+		t.Errorf("Expected the newest value v6, got %q, %v", value, err)
+	}
+	for _, values := range writes {
+		for _, value := range values {
+			if got, err := database.Get("other_" + value); err != nil || got != value {
+				t.Errorf("Expected other_%s=%s, got %q, %v", value, value, got, err)
+			}
+		}
+	}
+}
+
+func TestDb_DirectoryLock(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "lock_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateDb(tempDir, WithMaxSegmentSize(1024)); !errors.Is(err, ErrInUse) {
+		t.Fatalf("Expected ErrInUse for a second writer, got %v", err)
+	}
+
+	reader, err := OpenReadOnly(tempDir)
+	if err != nil {
+		t.Fatalf("Expected a read-only open to work next to the writer: %v", err)
+	}
+	reader.Close()
+
+	database.Close()
+	database, err = CreateDb(tempDir, WithMaxSegmentSize(1024))
+	if err != nil {
+		t.Fatalf("Expected the lock to be released on Close: %v", err)
+	}
+	database.Close()
+}
+
+func TestDb_FileModes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "mode_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	defaultDir := filepath.Join(tempDir, "default")
+	database, err := CreateDb(defaultDir, WithMaxSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+	if info, err := os.Stat(defaultDir); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("Expected the created directory to be traversable, got %v, %v", info.Mode(), err)
+	}
+
+	privateDir := filepath.Join(tempDir, "private")
+	database, err = CreateDb(privateDir, WithMaxSegmentSize(1024), WithDirMode(0700), WithFileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(privateDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected directory mode 0700, got %v, %v", info.Mode(), err)
+	}
+	stats, _ := database.SegmentInfo()
+	if info, err := os.Stat(stats[0].Path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected segment mode 0600, got %v, %v", info.Mode(), err)
+	}
+}
+
+func TestDb_DropAll(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "drop_all_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	database, err := createTestDatabase(tempDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := database.Put(fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watch, stop := database.Watch("key_1")
+	defer stop()
+
+	if err := database.DropAll(); err != nil {
+		t.Fatalf("Failed to drop all: %v", err)
+	}
+
+	if count := database.Count(); count != 0 {
+		t.Errorf("Expected no keys after DropAll, got %d", count)
+	}
+	if _, err := database.Get("key_1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound after DropAll, got %v", err)
+	}
+	if event := <-watch; !event.Deleted {
+		t.Errorf("Expected watchers to be notified of the deletion, got %+v", event)
+	}
+	stats, _ := database.SegmentInfo()
+	if len(stats) != 1 || !stats[0].Active || stats[0].Size != 0 {
+		t.Errorf("Expected a single empty active segment, got %+v", stats)
+	}
+
+	if err := database.Put("fresh", "value"); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+
+	database, err = createTestDatabase(tempDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if keys := database.Keys(); len(keys) != 1 || keys[0] != "fresh" {
+		t.Errorf("Expected only the key written after DropAll to survive reopening, got %v", keys)
+	}
+}
+
+func TestDb_GetRange(t *testing.T) {
+	database, err := CreateDb(t.TempDir(), WithMaxSegmentSize(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for i := 9; i >= 0; i-- {
+		if err := database.Put(fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := database.Delete("key_3"); err != nil {
+		t.Fatal(err)
+	}
+
+	var paged []KV
+	for offset := 0; ; offset += 4 {
+		page, err := database.GetRange(offset, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+	}
+	if len(paged) != 9 {
+		t.Fatalf("Expected 9 pairs over all pages, got %v", paged)
+	}
+	for i, pair := range paged {
+		if i > 0 && paged[i-1].Key >= pair.Key {
+			t.Errorf("Pairs out of order: %s before %s", paged[i-1].Key, pair.Key)
+		}
+		if pair.Value != "value_"+strings.TrimPrefix(pair.Key, "key_") {
+			t.Errorf("Unexpected value %s for %s", pair.Value, pair.Key)
+		}
+	}
+
+	if page, err := database.GetRange(100, 4); err != nil || page == nil || len(page) != 0 {
+		t.Errorf("Expected an empty page past the end, got %v (%v)", page, err)
+	}
+	if page, err := database.GetRange(8, math.MaxInt); err != nil || len(page) != 1 {
+		t.Errorf("Expected the last pair, got %v (%v)", page, err)
+	}
+	if _, err := database.GetRange(-1, 4); err == nil {
+		t.Error("Expected an error for a negative offset")
+	}
+}
+
+func TestDb_SegmentSizeOptions(t *testing.T) {
+	database, err := CreateDb(t.TempDir(), WithSyncOnWrite())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if database.maxSegmentSize != DefaultMaxSegmentSize {
+		t.Errorf("Expected the default segment size %d, got %d", DefaultMaxSegmentSize, database.maxSegmentSize)
+	}
+	if err := database.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := database.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected value, got %q (%v)", value, err)
+	}
+
+	if _, err := CreateDb(t.TempDir(), WithMaxSegmentSize(0)); err == nil {
+		t.Error("Expected an error for a zero segment size")
+	}
+}
+
+func TestDb_Stats(t *testing.T) {
+	database, err := createTestDatabase(t.TempDir(), 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	stats, err := database.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Compactions != 0 || !stats.LastCompaction.IsZero() || stats.CompactionInProgress {
+		t.Errorf("Expected no compaction yet, got %+v", stats)
+	}
+
+	started := time.Now()
+	for i := 0; i < 30; i++ {
+		if err := database.Put(fmt.Sprintf("key_%02d", i), fmt.Sprintf("value_%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database.waitForCompaction()
+
+	stats, err = database.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 30 || stats.Segments != len(database.segmentList()) || stats.DiskBytes == 0 {
+		t.Errorf("Unexpected size stats %+v", stats)
+	}
+	if stats.Compactions == 0 || stats.LastCompaction.Before(started) {
+		t.Errorf("Expected a recorded compaction, got %+v", stats)
+	}
+	if stats.CompactionInProgress {
+		t.Error("Expected no compaction in progress after waiting")
+	}
+}
+
+func TestDb_CompactionStress(t *testing.T) {
+	tempDir := t.TempDir()
+	database, err := createTestDatabase(tempDir, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	const writers, writes = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := fmt.Sprintf("key_%d_%d", w, i%10)
+				if err := database.Put(key, fmt.Sprintf("value_%d", i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	database.waitForCompaction()
+
+	for w := 0; w < writers; w++ {
+		for k := 0; k < 10; k++ {
+			key := fmt.Sprintf("key_%d_%d", w, k)
+			want := fmt.Sprintf("value_%d", writes-10+k)
+			if value, err := database.Get(key); err != nil || value != want {
+				t.Errorf("Expected %s for %s, got %q (%v)", want, key, value, err)
+			}
+		}
+	}
+
+	segments := database.segmentList()
+	paths := make(map[string]bool)
+	keySegments := make(map[string]string)
+	for _, segment := range segments {
+		paths[filepath.Base(segment.path)] = true
+		if segment == segments[len(segments)-1] {
+			continue
+		}
+		for key := range segment.keyIndex {
+			if previous, found := keySegments[key]; found {
+				t.Errorf("Key %s kept in both %s and %s after compaction", key, previous, segment.path)
+			}
+			keySegments[key] = segment.path
+		}
+	}
+
+	files, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), lockFileSuffix) {
+			continue
+		}
+		if !paths[file.Name()] {
+			t.Errorf("File %s is not a segment of the database", file.Name())
+		}
+	}
+	if len(files)-1 != len(segments) {
+		t.Errorf("Expected %d segment files, found %d files", len(segments), len(files)-1)
+	}
+}
+
+func TestDb_BufferSize(t *testing.T) {
+	large := strings.Repeat("x", 200*1024)
+
+	for _, bufferSize := range []int{minBufferSize, defaultBufferSize, 1024 * 1024} {
+		dir := t.TempDir()
+		database, err := CreateDb(dir, WithBufferSize(bufferSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := database.Put("small", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := database.Put("large", large); err != nil {
+			t.Fatal(err)
+		}
+		database.Close()
+
+		// Values larger than ten buffers used to be taken for corruption
+		// by recovery.
+		database, err = CreateDb(dir, WithBufferSize(bufferSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := database.Get("large"); err != nil || value != large {
+			t.Errorf("Buffer size %d: large value lost after reopening (%v)", bufferSize, err)
+		}
+		if value, err := database.Get("small"); err != nil || value != "value" {
+			t.Errorf("Buffer size %d: expected value after reopening, got %q (%v)", bufferSize, value, err)
+		}
+		database.Close()
+	}
+
+	if _, err := CreateDb(t.TempDir(), WithBufferSize(minBufferSize-1)); err == nil {
+		t.Error("Expected an error for a buffer below the minimum size")
+	}
+	database, err := CreateDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.Put("huge", strings.Repeat("x", maxRecordSize)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge for a value beyond the record size limit, got %v", err)
+	}
+}
+
+func TestDb_Ping(t *testing.T) {
+	database, err := CreateDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.Ping(); err != nil {
+		t.Errorf("Expected an open database to answer, got %v", err)
+	}
+
+	previous := pingTimeout
+	pingTimeout = 20 * time.Millisecond
+	defer func() { pingTimeout = previous }()
+
+	// Holding fileLock wedges the write handler like a stuck write would.
+	database.fileLock.Lock()
+	err = database.Ping()
+	database.fileLock.Unlock()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timeout while the write handler is stuck, got %v", err)
+	}
+
+	database.Close()
+	if err := database.Ping(); err == nil {
+		t.Error("Expected a closed database to fail")
+	}
+}
+
+func TestDb_GetSkipsMissingSegment(t *testing.T) {
+	database, err := createTestDatabase(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if err := database.Put("key", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("lost", "value"); err != nil {
+		t.Fatal(err)
+	}
+	database.waitForCompaction()
+
+	segments := database.segmentList()
+	if len(segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(segments))
+	}
+	if err := os.Remove(segments[1].path); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := database.Get("key"); err != nil || value != "old" {
+		t.Errorf("Expected the value from the older segment, got %q (%v)", value, err)
+	}
+	if _, err := database.Get("lost"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for a key only in the missing segment, got %v", err)
+	}
+	if database.Has("lost") || database.Count() != 1 {
+		t.Errorf("Expected the missing segment to be skipped, got keys %v", database.Keys())
+	}
+}
+
+func TestDb_GetOr(t *testing.T) {
+	database, err := createTestDatabase(t.TempDir(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if value := database.GetOr("key", "default"); value != "default" {
+		t.Errorf("Expected the fallback for a missing key, got %q", value)
+	}
+	if err := database.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value := database.GetOr("key", "default"); value != "value" {
+		t.Errorf("Expected the stored value, got %q", value)
+	}
+	if err := database.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if value := database.GetOr("key", "default"); value != "default" {
+		t.Errorf("Expected the fallback for a deleted key, got %q", value)
+	}
+}
+
+func TestDb_CompactTailKeep(t *testing.T) {
+	for _, keep := range []int{1, 2} {
+		t.Run(fmt.Sprintf("keep=%d", keep), func(t *testing.T) {
+			database, err := CreateDb(t.TempDir(), WithMaxSegmentSize(1024), WithCompactTailKeep(keep))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer database.Close()
+
+			for i := 0; i < 4; i++ {
+				if err := database.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+					t.Fatal(err)
+				}
+				if err := database.Put("shared", fmt.Sprintf("v%d", i)); err != nil {
+					t.Fatal(err)
+				}
+				if err := database.Rollover(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			database.waitForCompaction()
+
+			before := database.segmentList()
+			if err := database.compactOldSegments(); err != nil {
+				t.Fatalf("Compaction failed: %v", err)
+			}
+			after := database.segmentList()
+
+			if len(after) != keep+1 {
+				t.Fatalf("Expected one compacted segment and %d kept ones, got %d segments", keep, len(after))
+			}
+			for i := 1; i <= keep; i++ {
+				if after[len(after)-i] != before[len(before)-i] {
+					t.Errorf("Expected the segment %d from the end to be kept", i)
+				}
+			}
+
+			for i := 0; i < 4; i++ {
+				if value, err := database.Get(fmt.Sprintf("key%d", i)); err != nil || value != "value" {
+					t.Errorf("Expected key%d=value, got %q (%v)", i, value, err)
+				}
+			}
+			if value, err := database.Get("shared"); err != nil || value != "v3" {
+				t.Errorf("Expected the newest value v3, got %q (%v)", value, err)
+			}
+		})
+	}
+
+	if _, err := CreateDb(t.TempDir(), WithCompactTailKeep(0)); err == nil {
+		t.Error("Expected an error for keeping no segments")
+	}
+}
+
+func TestDb_WriteBufferBackpressure(t *testing.T) {
+	database, err := CreateDb(t.TempDir(), WithWriteBufferSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// Holding fileLock stalls the write handler on the first write, so the
+	// second fills the queue and the rest have to wait.
+	database.fileLock.Lock()
+	const writers = 4
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			errs <- database.Put(fmt.Sprintf("key%d", i), "value")
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats, err := database.Stats()
+		if err != nil {
+			database.fileLock.Unlock()
+			t.Fatal(err)
+		}
+		if stats.WritesBlocked > 0 && stats.WriteQueueDepth == 1 {
+			if stats.WriteQueueCapacity != 1 {
+				t.Errorf("Expected a write queue capacity of 1, got %d", stats.WriteQueueCapacity)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			database.fileLock.Unlock()
+			t.Fatalf("Expected blocked writes behind a full queue, got %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	database.fileLock.Unlock()
+
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Put failed: %v", err)
+		}
+	}
+	if count := database.Count(); count != writers {
+		t.Errorf("Expected %d keys, got %d", writers, count)
+	}
+
+	if _, err := CreateDb(t.TempDir(), WithWriteBufferSize(-1)); err == nil {
+		t.Error("Expected an error for a negative write buffer size")
+	}
+}
+
+// BenchmarkDb_PutParallel measures write throughput with every core putting
+// distinct keys through the single write handler. It is the baseline any
+// change to how writes are dispatched has to beat.
+func BenchmarkDb_PutParallel(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"buffered", nil},
+		{"sync-on-write", []Option{WithSyncOnWrite()}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			database, err := CreateDb(b.TempDir(), append([]Option{WithMaxSegmentSize(64 * 1024 * 1024)}, c.opts...)...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer database.Close()
+
+			var next atomic.Int64
+			value := strings.Repeat("v", 100)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := database.Put(fmt.Sprintf("key_%d", next.Add(1)), value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDb_CloseContextTimesOut(t *testing.T) {
+	database, err := CreateDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Holding fileLock wedges the write handler like a stuck write would.
+	// Once the second write waits in the queue, the first is stuck in the
+	// handler.
+	database.fileLock.Lock()
+	written := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			written <- database.Put(fmt.Sprintf("key%d", i), "value")
+		}()
+	}
+	for len(database.writeOperations) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := database.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the close to time out while a write is stuck, got %v", err)
+	}
+	if err := database.Put("other", "value"); err == nil {
+		t.Error("Expected writes to fail once closing started")
+	}
+
+	database.fileLock.Unlock()
+	for i := 0; i < 2; i++ {
+		if err := <-written; err != nil {
+			t.Errorf("Expected the queued writes to finish once unblocked, got %v", err)
+		}
+	}
+	if err := database.Close(); err != nil {
+		t.Errorf("Expected closing again to be a no-op, got %v", err)
+	}
+}
+
+func TestDb_GetFrom(t *testing.T) {
+	database, err := createTestDatabase(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	if err := database.Put("old", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Put("new", "value"); err != nil {
+		t.Fatal(err)
+	}
+	segments := database.segmentList()
+
+	for key, expected := range map[string]string{"old": segments[0].path, "new": segments[1].path} {
+		value, path, err := database.GetFrom(key)
+		if err != nil || value != "value" || path != expected {
+			t.Errorf("Expected %s from %s, got %q from %s (%v)", key, expected, value, path, err)
+		}
+	}
+	if _, _, err := database.GetFrom("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
@@ -5,30 +5,122 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 )
 
 type entry struct {
-	key      string
-	value    string
-	checksum [20]byte
+	key       string
+	value     string
+	tombstone bool
+	version   uint32
+	checksum  [20]byte
+	// timestamp is when the record was written, in nanoseconds since the
+	// Unix epoch. Records written before version 2 have none and read as 0.
+	timestamp int64
+	// expiresAt is when the value expires, in nanoseconds since the Unix
+	// epoch, or 0 if it never does.
+	expiresAt int64
 }
 
+// MaxKeySize is the largest key, in bytes, that can be stored.
+const MaxKeySize = 64 * 1024
+
 const (
 	headerSize      = 4
 	keyLengthSize   = 4
 	valueLengthSize = 4
 	checksumSize    = 20
 	totalHeaderSize = headerSize + keyLengthSize + valueLengthSize + checksumSize
+
+	// Version 2 records end with the timestamp, after the checksum, so that
+	// readers only interested in the value can stop before it. Records with
+	// flagExpiry have the expiry time after the timestamp.
+	timestampSize = 8
+	expirySize    = 8
+)
+
+// The top byte of the record size header carries the format version in its
+// high nibble and record flags in its low nibble; record sizes always fit in
+// the remaining 24 bits. Records written before the version was introduced
+// have version 0 and are read as version 1, which has the same layout.
+// Version 2 appends the write timestamp to the version 1 layout.
+const (
+	recordFlagsShift   = 24
+	recordVersionShift = 28
+	recordSizeMask     = 1<<recordFlagsShift - 1
+	recordFlagsMask    = 1<<(recordVersionShift-recordFlagsShift) - 1
+
+	recordVersion1       uint32 = 1
+	recordVersion2       uint32 = 2
+	currentRecordVersion        = recordVersion2
+
+	// maxRecordSize is the largest record the size header can describe.
+	maxRecordSize = recordSizeMask
+
+	flagTombstone uint32 = 1
+	flagExpiry    uint32 = 2
 )
 
+// recordVersion extracts the format version from the record size header.
+func recordVersion(header uint32) uint32 {
+	if version := header >> recordVersionShift; version != 0 {
+		return version
+	}
+	return recordVersion1
+}
+
+// recordFlags extracts the record flags from the record size header.
+func recordFlags(header uint32) uint32 {
+	return header >> recordFlagsShift & recordFlagsMask
+}
+
+// trailerSize is the size of what follows the checksum in a record.
+func trailerSize(version, flags uint32) int {
+	if version < recordVersion2 {
+		return 0
+	}
+	if flags&flagExpiry != 0 {
+		return timestampSize + expirySize
+	}
+	return timestampSize
+}
+
+func checkRecordVersion(version uint32) error {
+	if version > currentRecordVersion {
+		return fmt.Errorf("unsupported record format version %d", version)
+	}
+	return nil
+}
+
 func calculateEntryLength(key, value string) int64 {
-	return int64(len(key) + len(value) + totalHeaderSize)
+	return int64(len(key) + len(value) + totalHeaderSize + timestampSize)
 }
 
 func (e *entry) GetLength() int64 {
+	if e.expiresAt != 0 {
+		return calculateEntryLength(e.key, e.value) + expirySize
+	}
 	return calculateEntryLength(e.key, e.value)
 }
 
+func (e *entry) flags() uint32 {
+	var flags uint32
+	if e.tombstone {
+		flags |= flagTombstone
+	}
+	if e.expiresAt != 0 {
+		flags |= flagExpiry
+	}
+	return flags
+}
+
+// expired reports whether the value has expired at now, given in nanoseconds
+// since the Unix epoch.
+func (e *entry) expired(now int64) bool {
+	return e.expiresAt != 0 && now >= e.expiresAt
+}
+
 func (e *entry) calculateChecksum() [20]byte {
 	return sha1.Sum([]byte(e.value))
 }
@@ -41,8 +133,44 @@ func (e *entry) verifyChecksum() error {
 	return nil
 }
 
-func (e *entry) Decode(data []byte) {
+// Decode fills the entry from an encoded record. Records of a version newer
+// than currentRecordVersion only get their version set, callers are expected
+// to check it with checkRecordVersion.
+func (e *entry) Decode(data []byte) error {
+	if len(data) < totalHeaderSize {
+		return fmt.Errorf("%w: record of %d bytes is shorter than its header", errCorruptRecord, len(data))
+	}
+	header := binary.LittleEndian.Uint32(data)
+	e.version = recordVersion(header)
+
+	switch e.version {
+	case recordVersion1:
+		return e.decodeV1(header, data)
+	case recordVersion2:
+		trailer := trailerSize(e.version, recordFlags(header))
+		if len(data) < totalHeaderSize+trailer {
+			return fmt.Errorf("%w: record of %d bytes is shorter than its header", errCorruptRecord, len(data))
+		}
+		trailerStart := len(data) - trailer
+		if err := e.decodeV1(header, data[:trailerStart]); err != nil {
+			return err
+		}
+		e.timestamp = int64(binary.LittleEndian.Uint64(data[trailerStart:]))
+		if trailer > timestampSize {
+			e.expiresAt = int64(binary.LittleEndian.Uint64(data[trailerStart+timestampSize:]))
+		}
+	}
+	return nil
+}
+
+func (e *entry) decodeV1(header uint32, data []byte) error {
+	flags := recordFlags(header)
+	e.tombstone = flags&flagTombstone != 0
+
 	keyLength := binary.LittleEndian.Uint32(data[headerSize:])
+	if keyLength > MaxKeySize || int(keyLength) > len(data)-totalHeaderSize {
+		return fmt.Errorf("%w: invalid key length %d", errCorruptRecord, keyLength)
+	}
 
 	keyStart := headerSize + keyLengthSize
 	keyEnd := keyStart + int(keyLength)
@@ -53,6 +181,9 @@ func (e *entry) Decode(data []byte) {
 
 	valueStart := keyEnd
 	valueLength := binary.LittleEndian.Uint32(data[valueStart:])
+	if int64(valueLength) != int64(len(data)-totalHeaderSize)-int64(keyLength) {
+		return fmt.Errorf("%w: value length %d does not match record size %d", errCorruptRecord, valueLength, len(data))
+	}
 
 	valueDataStart := valueStart + valueLengthSize
 	valueDataEnd := valueDataStart + int(valueLength)
@@ -63,84 +194,171 @@ func (e *entry) Decode(data []byte) {
 
 	checksumStart := valueDataEnd
 	copy(e.checksum[:], data[checksumStart:checksumStart+checksumSize])
+	return nil
 }
 
-func readValue(reader *bufio.Reader) (string, error) {
+// readValueAt reads the value of the record at position using positioned
+// reads, so one file can be shared by several readers.
+func readValueAt(file io.ReaderAt, position int64) (string, error) {
+	record, err := readRecordAt(file, position)
+	return record.value, err
+}
+
+// readRecordAt is like readValueAt but returns the record's timestamp and
+// expiry time along with the value.
+func readRecordAt(file io.ReaderAt, position int64) (entry, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, position, math.MaxInt64-position))
+	return readRecord(reader)
+}
+
+// readValueLength reads a record up to its value, checking its version and
+// skipping its key, and returns the length of the value that follows along
+// with the record size header.
+func readValueLength(reader *bufio.Reader) (int, uint32, error) {
 	headerBytes, err := reader.Peek(headerSize + keyLengthSize)
 	if err != nil {
-		return "", err
+		return 0, 0, err
+	}
+
+	header := binary.LittleEndian.Uint32(headerBytes)
+	if err := checkRecordVersion(recordVersion(header)); err != nil {
+		return 0, 0, err
 	}
 
 	keySize := int(binary.LittleEndian.Uint32(headerBytes[headerSize:]))
+	if keySize > MaxKeySize {
+		return 0, 0, fmt.Errorf("%w: invalid key length %d", errCorruptRecord, keySize)
+	}
 
 	bytesToSkip := headerSize + keyLengthSize + keySize
 	_, err = reader.Discard(bytesToSkip)
 	if err != nil {
-		return "", err
+		return 0, 0, err
 	}
 
 	valueSizeBytes, err := reader.Peek(valueLengthSize)
 	if err != nil {
-		return "", err
+		return 0, 0, err
 	}
 
 	valueSize := int(binary.LittleEndian.Uint32(valueSizeBytes))
+	if valueSize > recordSizeMask {
+		return 0, 0, fmt.Errorf("%w: invalid value length %d", errCorruptRecord, valueSize)
+	}
 
 	_, err = reader.Discard(valueLengthSize)
 	if err != nil {
-		return "", err
+		return 0, 0, err
 	}
+	return valueSize, header, nil
+}
 
-	valueData := make([]byte, valueSize)
-	bytesRead, err := reader.Read(valueData)
-	if err != nil {
-		return "", err
+// readTrailer reads the timestamp and expiry time that follow the checksum of
+// a record with the given size header. Either is 0 if the record has none.
+func readTrailer(reader io.Reader, header uint32) (timestamp, expiresAt int64, err error) {
+	var trailer [timestampSize + expirySize]byte
+	size := trailerSize(recordVersion(header), recordFlags(header))
+	if _, err := io.ReadFull(reader, trailer[:size]); err != nil {
+		return 0, 0, fmt.Errorf("incomplete timestamp read: %w", err)
 	}
+	if size >= timestampSize {
+		timestamp = int64(binary.LittleEndian.Uint64(trailer[:]))
+	}
+	if size >= timestampSize+expirySize {
+		expiresAt = int64(binary.LittleEndian.Uint64(trailer[timestampSize:]))
+	}
+	return timestamp, expiresAt, nil
+}
 
-	if bytesRead != valueSize {
-		return "", fmt.Errorf("incomplete value read: got %d bytes, expected %d", bytesRead, valueSize)
+func readValue(reader *bufio.Reader) (string, error) {
+	record, err := readRecord(reader)
+	return record.value, err
+}
+
+// readRecord reads the value of a record, verifying its checksum, along with
+// the record's timestamp and expiry time. The key is not filled in.
+func readRecord(reader *bufio.Reader) (entry, error) {
+	valueSize, header, err := readValueLength(reader)
+	if err != nil {
+		return entry{}, err
 	}
 
-	var storedChecksum [20]byte
-	checksumBytesRead, err := reader.Read(storedChecksum[:])
+	valueData := make([]byte, valueSize)
+	bytesRead, err := io.ReadFull(reader, valueData)
 	if err != nil {
-		return "", fmt.Errorf("failed to read checksum: %w", err)
+		return entry{}, fmt.Errorf("incomplete value read: got %d bytes, expected %d: %w", bytesRead, valueSize, err)
 	}
 
-	if checksumBytesRead != checksumSize {
-		return "", fmt.Errorf("incomplete checksum read: got %d bytes, expected %d", checksumBytesRead, checksumSize)
+	var storedChecksum [20]byte
+	checksumBytesRead, err := io.ReadFull(reader, storedChecksum[:])
+	if err != nil {
+		return entry{}, fmt.Errorf("incomplete checksum read: got %d bytes, expected %d: %w", checksumBytesRead, checksumSize, err)
 	}
 
 	expectedChecksum := sha1.Sum(valueData)
 	if expectedChecksum != storedChecksum {
-		return "", fmt.Errorf("checksum mismatch: data corruption detected")
+		return entry{}, fmt.Errorf("checksum mismatch: data corruption detected")
 	}
 
-	return string(valueData), nil
+	record := entry{value: string(valueData), checksum: storedChecksum}
+	record.timestamp, record.expiresAt, err = readTrailer(reader, header)
+	if err != nil {
+		return entry{}, err
+	}
+	return record, nil
 }
 
 func (e *entry) Encode() []byte {
 	e.checksum = e.calculateChecksum()
 
-	keyLength := len(e.key)
-	valueLength := len(e.value)
-	totalSize := keyLength + valueLength + totalHeaderSize
-
-	buffer := make([]byte, totalSize)
-
-	binary.LittleEndian.PutUint32(buffer, uint32(totalSize))
-
-	binary.LittleEndian.PutUint32(buffer[headerSize:], uint32(keyLength))
-
-	copy(buffer[headerSize+keyLengthSize:], e.key)
+	buffer := make([]byte, 0, e.GetLength())
+	buffer = appendRecordPrefix(buffer, e.key, len(e.value), e.flags())
+	buffer = append(buffer, e.value...)
+	buffer = append(buffer, e.checksum[:]...)
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(e.timestamp))
+	if e.expiresAt != 0 {
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(e.expiresAt))
+	}
+	return buffer
+}
 
-	valueStart := headerSize + keyLengthSize + keyLength
-	binary.LittleEndian.PutUint32(buffer[valueStart:], uint32(valueLength))
+// appendRecordPrefix appends the part of a record that comes before the
+// value: the size header, the key and the value length. The value and its
+// checksum follow it.
+func appendRecordPrefix(buffer []byte, key string, valueLength int, flags uint32) []byte {
+	totalSize := len(key) + valueLength + totalHeaderSize + trailerSize(currentRecordVersion, flags)
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(totalSize)|flags<<recordFlagsShift|currentRecordVersion<<recordVersionShift)
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(len(key)))
+	buffer = append(buffer, key...)
+	return binary.LittleEndian.AppendUint32(buffer, uint32(valueLength))
+}
 
-	copy(buffer[valueStart+valueLengthSize:], e.value)
+// recordMeta is what readRecordMeta learns about a record without reading its
+// value.
+type recordMeta struct {
+	valueSize int
+	checksum  [checksumSize]byte
+	timestamp int64
+	expiresAt int64
+}
 
-	checksumStart := valueStart + valueLengthSize + valueLength
-	copy(buffer[checksumStart:], e.checksum[:])
+// readRecordMeta reads the value length, checksum and timestamp of a record,
+// skipping over the value. The checksum is not verified.
+func readRecordMeta(reader *bufio.Reader) (recordMeta, error) {
+	valueSize, header, err := readValueLength(reader)
+	if err != nil {
+		return recordMeta{}, err
+	}
+	if _, err := reader.Discard(valueSize); err != nil {
+		return recordMeta{}, fmt.Errorf("incomplete value read: %w", err)
+	}
 
-	return buffer
+	meta := recordMeta{valueSize: valueSize}
+	if _, err := io.ReadFull(reader, meta.checksum[:]); err != nil {
+		return recordMeta{}, fmt.Errorf("incomplete checksum read: %w", err)
+	}
+	if meta.timestamp, meta.expiresAt, err = readTrailer(reader, header); err != nil {
+		return recordMeta{}, err
+	}
+	return meta, nil
 }
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"testing"
 )
 
@@ -66,7 +68,8 @@ func TestReadValueWithCorruptedChecksum(t *testing.T) {
 	e := entry{key: "key", value: "value"}
 	data := e.Encode()
 
-	data[len(data)-1] = data[len(data)-1] ^ 0xFF
+	checksumEnd := len(data) - timestampSize
+	data[checksumEnd-1] ^= 0xFF
 
 	_, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err == nil {
@@ -141,3 +144,139 @@ func TestEntry_ChecksumConsistency(t *testing.T) {
 		})
 	}
 }
+
+func TestEntry_Tombstone(t *testing.T) {
+	e := entry{key: "key", tombstone: true}
+	encoded := e.Encode()
+
+	var decoded entry
+	decoded.Decode(encoded)
+
+	if !decoded.tombstone {
+		t.Error("tombstone flag lost on decode")
+	}
+	if decoded.key != "key" {
+		t.Error("incorrect key")
+	}
+}
+
+func TestEntry_Version(t *testing.T) {
+	e := entry{key: "key", value: "value", tombstone: true}
+	encoded := e.Encode()
+
+	var decoded entry
+	decoded.Decode(encoded)
+	if decoded.version != currentRecordVersion {
+		t.Errorf("expected version %d, got %d", currentRecordVersion, decoded.version)
+	}
+
+	// Records written before versioning have a zero version nibble and the
+	// version 1 layout, without a timestamp.
+	legacy := encodeLegacy(e)
+	var legacyDecoded entry
+	legacyDecoded.Decode(legacy)
+	if legacyDecoded.version != recordVersion1 || legacyDecoded.key != "key" || !legacyDecoded.tombstone {
+		t.Errorf("legacy record decoded incorrectly: %+v", legacyDecoded)
+	}
+	if v, err := readValue(bufio.NewReader(bytes.NewReader(legacy))); err != nil || v != "value" {
+		t.Errorf("legacy record read incorrectly: %q, %v", v, err)
+	}
+
+	future := append([]byte(nil), encoded...)
+	future[3] = future[3]&0x0F | byte(currentRecordVersion+1)<<4
+	var futureDecoded entry
+	futureDecoded.Decode(future)
+	if err := checkRecordVersion(futureDecoded.version); err == nil {
+		t.Error("expected newer record version to be rejected")
+	}
+	if _, err := readValue(bufio.NewReader(bytes.NewReader(future))); err == nil {
+		t.Error("expected readValue to reject newer record version")
+	}
+}
+
+func TestEntry_DecodeRejectsInvalidKeyLength(t *testing.T) {
+	e := entry{key: "key", value: "value"}
+	encoded := e.Encode()
+
+	for _, keyLength := range []uint32{uint32(len(encoded)), MaxKeySize + 1, 1 << 31} {
+		corrupt := append([]byte(nil), encoded...)
+		binary.LittleEndian.PutUint32(corrupt[headerSize:], keyLength)
+
+		var decoded entry
+		if err := decoded.Decode(corrupt); !errors.Is(err, errCorruptRecord) {
+			t.Errorf("key length %d: expected corrupt record error, got %v", keyLength, err)
+		}
+	}
+}
+
+func TestEntry_DecodeMalformedBuffers(t *testing.T) {
+	e := entry{key: "key", value: "value"}
+	encoded := e.Encode()
+
+	for length := 0; length < len(encoded); length++ {
+		var decoded entry
+		if err := decoded.Decode(encoded[:length]); err == nil {
+			t.Errorf("expected error for a record truncated to %d bytes", length)
+		}
+	}
+
+	corrupt := append([]byte(nil), encoded...)
+	binary.LittleEndian.PutUint32(corrupt[headerSize+keyLengthSize+len("key"):], 1<<30)
+	var decoded entry
+	if err := decoded.Decode(corrupt); !errors.Is(err, errCorruptRecord) {
+		t.Errorf("expected corrupt record error for an invalid value length, got %v", err)
+	}
+	if _, err := readValue(bufio.NewReader(bytes.NewReader(corrupt))); err == nil {
+		t.Error("expected readValue to fail for an invalid value length")
+	}
+}
+
+func TestReadValueAt(t *testing.T) {
+	first := entry{key: "first", value: "value1"}
+	second := entry{key: "second", value: "value2"}
+	data := append(first.Encode(), second.Encode()...)
+	file := bytes.NewReader(data)
+
+	// Read out of order to make sure no reader position is shared.
+	if v, err := readValueAt(file, first.GetLength()); err != nil || v != "value2" {
+		t.Errorf("expected value2, got %q, %v", v, err)
+	}
+	if v, err := readValueAt(file, 0); err != nil || v != "value1" {
+		t.Errorf("expected value1, got %q, %v", v, err)
+	}
+}
+
+// encodeLegacy encodes the entry the way records were written before the
+// format version was introduced.
+func encodeLegacy(e entry) []byte {
+	encoded := e.Encode()
+	legacy := encoded[:len(encoded)-timestampSize]
+	header := binary.LittleEndian.Uint32(legacy)&^recordSizeMask | uint32(len(legacy))
+	binary.LittleEndian.PutUint32(legacy, header&^(0xF<<recordVersionShift))
+	return legacy
+}
+
+func TestEntry_Timestamp(t *testing.T) {
+	e := entry{key: "key", value: "value", timestamp: 1700000000123456789}
+	encoded := e.Encode()
+	if int64(len(encoded)) != e.GetLength() {
+		t.Errorf("expected %d bytes, got %d", e.GetLength(), len(encoded))
+	}
+
+	var decoded entry
+	if err := decoded.Decode(encoded); err != nil || decoded.timestamp != e.timestamp {
+		t.Errorf("expected timestamp %d, got %d (%v)", e.timestamp, decoded.timestamp, err)
+	}
+	if record, err := readRecordAt(bytes.NewReader(encoded), 0); err != nil || record.value != "value" || record.timestamp != e.timestamp {
+		t.Errorf("expected value with timestamp %d, got %+v, %v", e.timestamp, record, err)
+	}
+
+	legacy := encodeLegacy(e)
+	var legacyDecoded entry
+	if err := legacyDecoded.Decode(legacy); err != nil || legacyDecoded.timestamp != 0 || legacyDecoded.value != "value" {
+		t.Errorf("legacy record decoded incorrectly: %+v, %v", legacyDecoded, err)
+	}
+	if meta, err := readRecordMeta(bufio.NewReader(bytes.NewReader(legacy))); err != nil || meta.timestamp != 0 || meta.valueSize != 5 {
+		t.Errorf("legacy record meta read incorrectly: %+v, %v", meta, err)
+	}
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// PutWithTTL stores the value so that it expires after ttl. Get, Has and
+// Delete treat an expired key as missing right away, while Keys and Count may
+// still list it until the sweeper started by WithSweepInterval or a compaction
+// removes it. A later Put without a TTL makes the key permanent again.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %v", ttl)
+	}
+	return db.submitWrite(context.Background(), WriteOperation{
+		data: entry{
+			key:       key,
+			value:     value,
+			expiresAt: time.Now().Add(ttl).UnixNano(),
+		},
+	})
+}
+
+func (db *Db) startSweeper() {
+	if db.sweepInterval <= 0 {
+		return
+	}
+	db.sweepStop = make(chan struct{})
+
+	db.sweepWG.Add(1)
+	go func() {
+		defer db.sweepWG.Done()
+		ticker := time.NewTicker(db.sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.sweepStop:
+				return
+			case <-ticker.C:
+				if err := db.sweep(); err != nil {
+					fmt.Printf("Warning: sweeping expired keys failed: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+func (db *Db) stopSweeper() {
+	if db.sweepStop == nil {
+		return
+	}
+	db.sweepOnce.Do(func() {
+		close(db.sweepStop)
+	})
+	db.sweepWG.Wait()
+}
+
+// sweep deletes every expired key. Keys are checked without blocking writes;
+// the write handler then checks each candidate again before deleting it, so a
+// key written in between is kept.
+func (db *Db) sweep() error {
+	expired := db.expiredKeys(time.Now().UnixNano())
+	if len(expired) == 0 {
+		return nil
+	}
+	return db.submitWrite(context.Background(), WriteOperation{sweep: expired})
+}
+
+// expiredKeys returns the keys whose current record has expired by now. Only
+// the keys written with a TTL are looked at, from the expiry times the segments
+// keep in memory.
+func (db *Db) expiredKeys(now int64) []string {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+
+	candidates := make(map[string]bool)
+	for _, segment := range db.segments {
+		segment.mu.RLock()
+		for key := range segment.expiries {
+			candidates[key] = true
+		}
+		segment.mu.RUnlock()
+	}
+
+	var expired []string
+	for key := range candidates {
+		segment, _, err := db.findKeyLocationLocked(key)
+		if err == nil && segment.expired(key, now) {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+// deleteExpired writes a tombstone for every key that is still expired. It
+// runs on the write handler.
+func (db *Db) deleteExpired(keys []string) error {
+	now := time.Now().UnixNano()
+	for _, key := range keys {
+		segment, _, err := db.findKeyLocation(key)
+		if err != nil || !segment.expired(key, now) {
+			continue
+		}
+		if err := db.writeRecord(entry{key: key, tombstone: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
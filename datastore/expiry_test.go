@@ -0,0 +1,195 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDb_PutWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	db, err := CreateDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutWithTTL("short", "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("permanent", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("short"); err != nil || value != "value" {
+		t.Errorf("Expected the value before it expires, got %q (%v)", value, err)
+	}
+	if meta, err := db.GetMeta("long"); err != nil || meta.ExpiresAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("Expected an expiry in an hour, got %+v (%v)", meta, err)
+	}
+	if err := db.PutWithTTL("key", "value", 0); err == nil {
+		t.Error("Expected an error for a zero TTL")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := db.Get("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound once expired, got %v", err)
+	}
+	if _, err := db.GetMeta("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected GetMeta to report an expired key as missing, got %v", err)
+	}
+	if _, err := db.GetReader("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected GetReader to report an expired key as missing, got %v", err)
+	}
+	if old, existed, err := db.GetSet("short", "new"); err != nil || existed || old != "" {
+		t.Errorf("Expected GetSet to see no old value, got %q, %v (%v)", old, existed, err)
+	}
+	db.Close()
+
+	db, err = CreateDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"short": "new", "long": "value", "permanent": "value"} {
+		if value, err := db.Get(key); err != nil || value != want {
+			t.Errorf("Expected %q for %s after reopening, got %q (%v)", want, key, value, err)
+		}
+	}
+	reader, err := db.GetReader("long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if value, err := io.ReadAll(reader); err != nil || string(value) != "value" {
+		t.Errorf("Expected value from GetReader, got %q (%v)", value, err)
+	}
+}
+
+func TestDb_Sweeper(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithSweepInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutWithTTL("expiring", "value", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("permanent", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for db.Count() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the sweeper to delete the expired key")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !db.Has("permanent") || db.Count() != 1 {
+		t.Errorf("Expected only the permanent key to remain, got %v", db.Keys())
+	}
+}
+
+func TestDb_SweeperStopsOnClose(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithSweepInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("key", "value", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- db.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not stop the sweeper")
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Expected a second Close to succeed, got %v", err)
+	}
+}
+
+func TestDb_CompactionDropsExpiredValues(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithMaxSegmentSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutWithTTL("expiring", "value", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if err := db.Put("other", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.waitForCompaction()
+
+	if keys := db.Keys(); len(keys) != 1 || keys[0] != "other" {
+		t.Errorf("Expected compaction to drop the expired value, got keys %v", keys)
+	}
+}
+
+func TestDb_ExpiredKeysAreMissing(t *testing.T) {
+	dir := t.TempDir()
+	db, err := CreateDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"expiring", "renewed"} {
+		if err := db.PutWithTTL(key, "value", time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutWithTTL("long", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("renewed", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The expiry times are recovered along with the index.
+	db, err = CreateDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	time.Sleep(5 * time.Millisecond)
+
+	if db.Has("expiring") {
+		t.Error("Expected Has to report the expired key as missing")
+	}
+	if err := db.Delete("expiring"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound deleting the expired key, got %v", err)
+	}
+	if !db.Has("renewed") || !db.Has("long") {
+		t.Error("Expected the keys that have not expired to be present")
+	}
+	if expired := db.expiredKeys(time.Now().UnixNano()); len(expired) != 1 || expired[0] != "expiring" {
+		t.Errorf("Expected only the expired key to be swept, got %v", expired)
+	}
+
+	if err := db.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != 2 {
+		t.Errorf("Expected the sweep to remove the expired key, got %d keys", count)
+	}
+	if expired := db.expiredKeys(time.Now().UnixNano()); len(expired) != 0 {
+		t.Errorf("Expected nothing left to sweep, got %v", expired)
+	}
+}
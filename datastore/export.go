@@ -0,0 +1,79 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// exportRecord is one line of an Export.
+type exportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Export writes every present key and its value to w as newline-delimited
+// JSON objects of the form {"key":...,"value":...}, in key order. It works
+// from a Snapshot, so the export is consistent even while writes go on, and
+// values are read and written one at a time.
+func (db *Db) Export(w io.Writer) error {
+	snapshot := db.Snapshot()
+	defer snapshot.Close()
+
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	for _, key := range snapshot.keys() {
+		value, err := snapshot.Get(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			// Expired when the snapshot was taken, but not swept yet.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("export %q: %w", key, err)
+		}
+		if err := encoder.Encode(exportRecord{Key: key, Value: value}); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// Import reads records in the format written by Export and puts each pair.
+// Pairs before a malformed record stay written.
+func (db *Db) Import(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	for n := 1; ; n++ {
+		var record exportRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("import record %d: %w", n, err)
+		}
+		if err := db.Put(record.Key, record.Value); err != nil {
+			return fmt.Errorf("import record %d: %w", n, err)
+		}
+	}
+}
+
+// keys returns every key present in the snapshot in sorted order.
+func (s *Snapshot) keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for i := len(s.indices) - 1; i >= 0; i-- {
+		for key, position := range s.indices[i] {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if position != tombstonePosition {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDb_ExportImport(t *testing.T) {
+	source, err := CreateDb(t.TempDir(), WithMaxSegmentSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	pairs := map[string]string{
+		"b":       "second",
+		"a":       "first",
+		"quoted":  `"json" \ line` + "\n",
+		"unicode": "значення",
+	}
+	for key, value := range pairs {
+		if err := source.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := source.Put("deleted", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Put("a", "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported bytes.Buffer
+	if err := source.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(exported.String(), "\n"), "\n")
+	if len(lines) != len(pairs) || lines[0] != `{"key":"a","value":"first"}` {
+		t.Errorf("Unexpected export:\n%s", exported.String())
+	}
+
+	target, err := CreateDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if err := target.Import(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if target.Count() != len(pairs) {
+		t.Errorf("Expected %d keys after import, got %v", len(pairs), target.Keys())
+	}
+	for key, want := range pairs {
+		if value, err := target.Get(key); err != nil || value != want {
+			t.Errorf("Expected %q for %s, got %q (%v)", want, key, value, err)
+		}
+	}
+
+	malformed := `{"key":"ok","value":"1"}` + "\n" + `{"key":"bad","value":2}` + "\n"
+	if err := target.Import(strings.NewReader(malformed)); err == nil || !strings.Contains(err.Error(), "record 2") {
+		t.Errorf("Expected an error for record 2, got %v", err)
+	}
+	if value, err := target.Get("ok"); err != nil || value != "1" {
+		t.Errorf("Expected the pair before the malformed record to be written, got %q (%v)", value, err)
+	}
+}
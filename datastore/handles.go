@@ -0,0 +1,155 @@
+package datastore
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// defaultMaxOpenFiles is the number of segment files kept open for reads
+// unless WithMaxOpenFiles says otherwise.
+const defaultMaxOpenFiles = 64
+
+// handleCache keeps read handles of recently read segments open, so that a
+// read does not have to open its segment file again. At most capacity handles
+// are cached; the least recently used one is closed to make room, as soon as
+// no read is using it any more.
+type handleCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	order   *list.List // of *cachedHandle, most recently used first
+	entries map[*Segment]*list.Element
+	closed  bool
+}
+
+type cachedHandle struct {
+	segment *Segment
+	file    segmentFile
+	refs    int
+	evicted bool
+}
+
+func newHandleCache(capacity int) *handleCache {
+	return &handleCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[*Segment]*list.Element),
+	}
+}
+
+// open returns a reader for the segment file and a function the caller must
+// call once done with it. Without a cache, or once the cache is closed, every
+// call opens the file on its own.
+func (c *handleCache) open(segment *Segment) (io.ReaderAt, func(), error) {
+	if c == nil || c.capacity <= 0 {
+		return openUncached(segment)
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return openUncached(segment)
+	}
+	if element, ok := c.entries[segment]; ok {
+		handle := element.Value.(*cachedHandle)
+		handle.refs++
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return handle.file, func() { c.release(handle) }, nil
+	}
+	c.mu.Unlock()
+
+	// Opening happens unlocked; if another read cached the segment in the
+	// meantime, its handle is used and this one closed.
+	file, err := segment.storage.Open(segment.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return file, func() { file.Close() }, nil
+	}
+	if element, ok := c.entries[segment]; ok {
+		file.Close()
+		handle := element.Value.(*cachedHandle)
+		handle.refs++
+		c.order.MoveToFront(element)
+		return handle.file, func() { c.release(handle) }, nil
+	}
+
+	handle := &cachedHandle{segment: segment, file: file, refs: 1}
+	c.entries[segment] = c.order.PushFront(handle)
+	for c.order.Len() > c.capacity {
+		c.evictLocked(c.order.Back())
+	}
+	return file, func() { c.release(handle) }, nil
+}
+
+func openUncached(segment *Segment) (io.ReaderAt, func(), error) {
+	file, err := segment.storage.Open(segment.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, func() { file.Close() }, nil
+}
+
+func (c *handleCache) release(handle *cachedHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	handle.refs--
+	if handle.evicted && handle.refs == 0 {
+		handle.file.Close()
+	}
+}
+
+// evictLocked takes the handle out of the cache and closes it unless a read
+// still uses it, in which case the last release closes it.
+func (c *handleCache) evictLocked(element *list.Element) {
+	handle := c.order.Remove(element).(*cachedHandle)
+	delete(c.entries, handle.segment)
+	handle.evicted = true
+	if handle.refs == 0 {
+		handle.file.Close()
+	}
+}
+
+// drop closes the cached handle of a segment whose file is going away.
+func (c *handleCache) drop(segment *Segment) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[segment]; ok {
+		c.evictLocked(element)
+	}
+}
+
+// size returns the number of cached handles.
+func (c *handleCache) size() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// close closes every cached handle once unused and stops caching new ones.
+func (c *handleCache) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for c.order.Len() > 0 {
+		c.evictLocked(c.order.Back())
+	}
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_MaxOpenFiles(t *testing.T) {
+	database, err := CreateDb(t.TempDir(), WithMaxSegmentSize(1024*1024), WithMaxOpenFiles(2), WithCompactTailKeep(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := database.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := database.Rollover(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 5; i++ {
+			if value, err := database.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("value%d", i) {
+				t.Errorf("Expected key%d=value%d, got %q (%v)", i, i, value, err)
+			}
+			stats, err := database.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.OpenReadFiles > 2 {
+				t.Fatalf("Expected at most 2 open files, got %d", stats.OpenReadFiles)
+			}
+		}
+	}
+
+	if _, err := CreateDb(t.TempDir(), WithMaxOpenFiles(-1)); err == nil {
+		t.Error("Expected an error for a negative number of open files")
+	}
+}
+
+func TestHandleCacheEvictsOnlyUnusedHandles(t *testing.T) {
+	dir := t.TempDir()
+	segments := make([]*Segment, 3)
+	for i := range segments {
+		path := filepath.Join(dir, fmt.Sprintf("segment%d", i))
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("data%d", i)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		segments[i] = &Segment{path: path, storage: osStorage{}}
+	}
+
+	cache := newHandleCache(1)
+	held, release, err := cache.open(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, segment := range segments[1:] {
+		_, releaseOther, err := cache.open(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releaseOther()
+	}
+	if cache.size() != 1 {
+		t.Errorf("Expected the cache to hold 1 handle, got %d", cache.size())
+	}
+
+	buf := make([]byte, 5)
+	if _, err := held.ReadAt(buf, 0); err != nil || string(buf) != "data0" {
+		t.Fatalf("Expected an evicted handle to stay readable while used, got %q (%v)", buf, err)
+	}
+	release()
+	if _, err := held.ReadAt(buf, 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected the evicted handle to be closed on release, got %v", err)
+	}
+
+	file, release, err := cache.open(segments[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	cache.drop(segments[2])
+	if _, err := file.ReadAt(buf, 0); !errors.Is(err, os.ErrClosed) || cache.size() != 0 {
+		t.Errorf("Expected a dropped handle to be closed, got %v with %d cached", err, cache.size())
+	}
+
+	cache.close()
+	if _, release, err := cache.open(segments[1]); err != nil || cache.size() != 0 {
+		t.Errorf("Expected a closed cache to open files without caching them, got %v with %d cached", err, cache.size())
+	} else {
+		release()
+	}
+}
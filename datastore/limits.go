@@ -0,0 +1,50 @@
+package datastore
+
+import "fmt"
+
+// checkLimits returns ErrStoreFull if writing the records would go beyond the
+// limits set by WithMaxKeys and WithMaxDiskBytes. Tombstones are not checked.
+// It runs on the write handler, so the store cannot grow in between. Count is
+// kept up to date by the index, so the check costs a lookup per record rather
+// than a pass over every key.
+func (db *Db) checkLimits(records []entry) error {
+	var size int64
+	for _, record := range records {
+		if !record.tombstone {
+			size += record.GetLength()
+		}
+	}
+	return db.checkLimitsSized(records, size)
+}
+
+// checkLimitsSized is checkLimits for records taking up size bytes on disk, for
+// records whose value is not held in memory.
+func (db *Db) checkLimitsSized(records []entry, size int64) error {
+	if db.maxDiskBytes > 0 && size > 0 {
+		used, err := db.DiskSize()
+		if err != nil {
+			return err
+		}
+		if used+size > db.maxDiskBytes {
+			return fmt.Errorf("%w: %d of %d bytes used, %d more needed", ErrStoreFull, used, db.maxDiskBytes, size)
+		}
+	}
+
+	if db.maxKeys > 0 {
+		newKeys := make(map[string]bool)
+		for _, record := range records {
+			// Expired keys are counted until they are swept, so
+			// writing one does not add a key either.
+			if _, _, err := db.findKeyLocation(record.key); !record.tombstone && err != nil {
+				newKeys[record.key] = true
+			}
+		}
+		if len(newKeys) == 0 {
+			return nil
+		}
+		if count := db.storedKeyCount(); count+len(newKeys) > db.maxKeys {
+			return fmt.Errorf("%w: %d of %d keys stored", ErrStoreFull, count, db.maxKeys)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDb_MaxKeys(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithMaxKeys(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", "3"); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Expected ErrStoreFull for a third key, got %v", err)
+	}
+	if err := db.PutBatch(map[string]string{"a": "10", "c": "3"}); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Expected ErrStoreFull for a batch adding a key, got %v", err)
+	}
+	if db.Has("c") {
+		t.Error("Rejected key was stored")
+	}
+
+	if err := db.Put("a", "overwritten"); err != nil {
+		t.Errorf("Expected overwriting a present key to succeed, got %v", err)
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", "3"); err != nil {
+		t.Errorf("Expected a put to succeed after a delete, got %v", err)
+	}
+}
+
+func TestDb_MaxDiskBytes(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithMaxDiskBytes(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", strings.Repeat("v", 100)); err != nil {
+		t.Fatalf("Expected the first put to fit, got %v", err)
+	}
+	if err := db.Put("other", strings.Repeat("v", 100)); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Expected ErrStoreFull for a put beyond the limit, got %v", err)
+	}
+	if err := db.Put("other", "value"); err != nil {
+		t.Errorf("Expected a put that fits to succeed, got %v", err)
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Errorf("Expected deletes to succeed on a full store, got %v", err)
+	}
+}
+
+func TestDb_MaxDiskBytesForStreams(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithMaxDiskBytes(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.NewReader(strings.Repeat("v", 2000))
+	if err := db.PutReader("key", value, 2000); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Expected ErrStoreFull for a stream beyond the limit, got %v", err)
+	}
+	if value.Len() != 2000 {
+		t.Errorf("Expected the stream to be rejected before it is read, %d bytes were read", 2000-value.Len())
+	}
+	if size, err := db.DiskSize(); err != nil || size != 0 {
+		t.Errorf("Expected nothing written, got %d bytes, %v", size, err)
+	}
+	if err := db.PutReader("key", strings.NewReader("value"), 5); err != nil {
+		t.Errorf("Expected a stream that fits to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// lockFile only creates the lock file: advisory locking is not implemented on
+// this platform, so concurrent use of a directory is not detected.
+func lockFile(path string, mode os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, mode)
+}
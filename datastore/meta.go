@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"time"
+)
+
+// ValueMeta describes the stored value of a key.
+type ValueMeta struct {
+	// Size is the length of the value in bytes.
+	Size int64
+	// StoredAt is when the value was written. It is the zero time for values
+	// written before timestamps were recorded. Compaction keeps it.
+	StoredAt time.Time
+	// ExpiresAt is when a value stored with PutWithTTL expires, and the zero
+	// time for other values.
+	ExpiresAt time.Time
+	// Segment is the path of the segment file that holds the value.
+	Segment string
+	// Checksum is the SHA-1 of the value, as stored in its record.
+	Checksum [20]byte
+}
+
+// GetMeta describes the value of the key without reading the value itself.
+// An expired key is reported as missing, like by Get.
+func (db *Db) GetMeta(key string) (ValueMeta, error) {
+	location := db.getKeyPosition(key)
+	if location == nil {
+		return ValueMeta{}, ErrKeyNotFound
+	}
+	defer location.segment.release()
+
+	record, err := location.segment.readMeta(location.position)
+	if err != nil {
+		return ValueMeta{}, err
+	}
+	if record.expiresAt != 0 && time.Now().UnixNano() >= record.expiresAt {
+		return ValueMeta{}, ErrKeyNotFound
+	}
+
+	meta := ValueMeta{
+		Size:     int64(record.valueSize),
+		Segment:  location.segment.path,
+		Checksum: record.checksum,
+	}
+	if record.timestamp != 0 {
+		meta.StoredAt = time.Unix(0, record.timestamp)
+	}
+	if record.expiresAt != 0 {
+		meta.ExpiresAt = time.Unix(0, record.expiresAt)
+	}
+	return meta, nil
+}
+
+func (segment *Segment) readMeta(position int64) (recordMeta, error) {
+	file, release, err := segment.handles.open(segment)
+	if err != nil {
+		return recordMeta{}, err
+	}
+	defer release()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, position, math.MaxInt64-position))
+	return readRecordMeta(reader)
+}
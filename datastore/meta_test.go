@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDb_GetMeta(t *testing.T) {
+	dir := t.TempDir()
+	db, err := CreateDb(dir, WithMaxSegmentSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	meta, err := db.GetMeta("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != 5 || meta.StoredAt.Before(before) || meta.StoredAt.After(after) || meta.Checksum != sha1.Sum([]byte("value")) {
+		t.Errorf("Unexpected meta %+v", meta)
+	}
+	if meta.Segment != db.segmentList()[0].path {
+		t.Errorf("Expected the value in %s, got %s", db.segmentList()[0].path, meta.Segment)
+	}
+
+	// Compaction moves the value but keeps its timestamp.
+	for i := 0; i < 10; i++ {
+		if err := db.Put("other", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.waitForCompaction()
+	compacted, err := db.GetMeta("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.Segment == meta.Segment || !compacted.StoredAt.Equal(meta.StoredAt) {
+		t.Errorf("Expected the timestamp to survive compaction, got %+v, was %+v", compacted, meta)
+	}
+	db.Close()
+
+	db, err = CreateDb(dir, WithMaxSegmentSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if recovered, err := db.GetMeta("key"); err != nil || !recovered.StoredAt.Equal(meta.StoredAt) {
+		t.Errorf("Expected the timestamp to survive recovery, got %+v, %v", recovered, err)
+	}
+	if _, err := db.GetMeta("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestDb_GetMetaOfLegacyRecord(t *testing.T) {
+	dir := t.TempDir()
+	legacy := encodeLegacy(entry{key: "key", value: "value"})
+	if err := os.WriteFile(filepath.Join(dir, dataFileName+"0"), legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := CreateDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	meta, err := db.GetMeta("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != 5 || !meta.StoredAt.IsZero() {
+		t.Errorf("Expected a zero timestamp for a legacy record, got %+v", meta)
+	}
+}
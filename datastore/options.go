@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"os"
+	"time"
+)
+
+// Option configures a Db created by CreateDb.
+type Option func(*Db)
+
+// WithMaxSegmentSize sets the size in bytes a segment may grow to before the
+// database rolls over to a new one. Defaults to DefaultMaxSegmentSize.
+func WithMaxSegmentSize(size int64) Option {
+	return func(db *Db) {
+		db.maxSegmentSize = size
+	}
+}
+
+// WithSyncOnWrite makes every Put and Delete fsync the active segment before
+// it returns, trading write throughput for durability. Batches are synced
+// either way.
+func WithSyncOnWrite() Option {
+	return func(db *Db) {
+		db.syncOnWrite = true
+	}
+}
+
+// WithMaxKeys makes writes that would store more than max keys fail with
+// ErrStoreFull. Keys in buckets count towards the limit. Overwriting a
+// present key is always allowed. Zero, the default, means no limit.
+func WithMaxKeys(max int) Option {
+	return func(db *Db) {
+		db.maxKeys = max
+	}
+}
+
+// WithMaxDiskBytes makes writes fail with ErrStoreFull if their records would
+// make the segment files take up more than max bytes. Deletes still succeed,
+// so that compaction can free space. Zero, the default, means no limit.
+func WithMaxDiskBytes(max int64) Option {
+	return func(db *Db) {
+		db.maxDiskBytes = max
+	}
+}
+
+// WithSweepInterval starts a background sweeper that deletes expired keys
+// every interval, so that their space is reclaimed by the next compaction
+// rather than once their segment happens to be compacted. Zero, the default,
+// disables the sweeper.
+func WithSweepInterval(interval time.Duration) Option {
+	return func(db *Db) {
+		db.sweepInterval = interval
+	}
+}
+
+// WithBufferSize sets the size of the buffers used to read segments during
+// recovery and to stream values. Larger buffers can speed up recovery of
+// segments with large values; they do not limit the size of a value. Defaults
+// to 8192 bytes.
+func WithBufferSize(size int) Option {
+	return func(db *Db) {
+		db.bufferSize = size
+	}
+}
+
+// WithWriteBufferSize sets how many writes may queue for the write handler
+// before writers block. Stats reports how often they did. Defaults to 100;
+// zero makes every write wait for the handler.
+func WithWriteBufferSize(size int) Option {
+	return func(db *Db) {
+		db.writeBufferSize = size
+	}
+}
+
+// WithMaxOpenFiles sets how many segment files are kept open for reads.
+// Files of recently read segments stay open so that reads do not reopen them,
+// and the least recently read one is closed once max are open. Zero opens the
+// file on every read. Defaults to 64.
+func WithMaxOpenFiles(max int) Option {
+	return func(db *Db) {
+		db.maxOpenFiles = max
+	}
+}
+
+// WithCompactTailKeep makes compaction leave the newest keep segments, the
+// active one included, untouched and merge only the older ones, so recently
+// written data is not rewritten while it is still hot. Defaults to 1, which
+// merges every segment but the active one.
+func WithCompactTailKeep(keep int) Option {
+	return func(db *Db) {
+		db.compactTailKeep = keep
+	}
+}
+
+// WithFilePrefix sets the name prefix of segment files, so several stores can
+// share one directory. Segment files are named prefix followed by a number.
+// The prefix must not end in a digit or an underscore, since then the files of
+// a store with a shorter prefix, like "db" for "db1", could not be told apart.
+func WithFilePrefix(prefix string) Option {
+	return func(db *Db) {
+		db.filePrefix = prefix
+	}
+}
+
+// WithFileMode sets the permissions of the files the database creates.
+// Defaults to 0644.
+func WithFileMode(mode os.FileMode) Option {
+	return func(db *Db) {
+		db.fileMode = mode
+	}
+}
+
+// WithDirMode sets the permissions of the database directory if CreateDb has
+// to create it. Defaults to 0755.
+func WithDirMode(mode os.FileMode) Option {
+	return func(db *Db) {
+		db.dirMode = mode
+	}
+}
+
+// WithMemoryStorage keeps the database files in storage instead of on disk.
+// The directory then only namespaces the files within storage.
+func WithMemoryStorage(storage *MemoryStorage) Option {
+	return func(db *Db) {
+		db.storage = storage
+	}
+}
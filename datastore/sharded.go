@@ -0,0 +1,206 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	shardDirPrefix = "shard-"
+	// shardCountFile records the number of shards, which must not change
+	// since it decides which shard holds a key.
+	shardCountFile = "shards"
+)
+
+// ShardedDb spreads keys by hash over several databases, each in its own
+// subdirectory with its own write handler, segments and compaction, so that
+// writes of different keys do not queue behind a single writer. A key always
+// maps to the same shard, so reads only consult the shard owning it, while
+// Keys and Count go over all of them. Options apply to every shard on its own:
+// WithMaxKeys and WithMaxDiskBytes, for instance, limit each shard.
+type ShardedDb struct {
+	shards []*Db
+}
+
+// CreateShardedDb opens a database of the given number of shards in directory,
+// creating it if needed. The number of shards is recorded on creation and
+// opening the directory with a different one fails, since keys would then be
+// looked up in the wrong shards.
+func CreateShardedDb(directory string, shards int, opts ...Option) (*ShardedDb, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("invalid number of shards %d", shards)
+	}
+
+	sharded := &ShardedDb{shards: make([]*Db, 0, shards)}
+	for i := 0; i < shards; i++ {
+		shard, err := CreateDb(filepath.Join(directory, shardDirPrefix+strconv.Itoa(i)), opts...)
+		if err != nil {
+			sharded.Close()
+			return nil, fmt.Errorf("open shard %d: %w", i, err)
+		}
+		sharded.shards = append(sharded.shards, shard)
+
+		// The first shard holds the lock that keeps other processes out,
+		// so the count is checked before any other shard is opened.
+		if i == 0 {
+			if err := checkShardCount(shard, directory, shards); err != nil {
+				sharded.Close()
+				return nil, err
+			}
+		}
+	}
+	return sharded, nil
+}
+
+// checkShardCount compares shards with the number recorded in directory, or
+// records it if there is none yet. It uses the storage of the given shard, so
+// the count is kept wherever the shards keep their files.
+func checkShardCount(shard *Db, directory string, shards int) error {
+	path := filepath.Join(directory, shardCountFile)
+	file, err := shard.storage.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return writeShardCount(shard, path, shards)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	recorded, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid shard count in %s: %w", path, err)
+	}
+	if recorded != shards {
+		return fmt.Errorf("%s holds %d shards, cannot open it with %d", directory, recorded, shards)
+	}
+	return nil
+}
+
+func writeShardCount(shard *Db, path string, shards int) error {
+	file, err := shard.storage.Create(path, shard.fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte(strconv.Itoa(shards) + "\n")); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// shard returns the database owning the key.
+func (s *ShardedDb) shard(key string) *Db {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *ShardedDb) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// Shards returns the number of shards.
+func (s *ShardedDb) Shards() int {
+	return len(s.shards)
+}
+
+func (s *ShardedDb) Get(key string) (string, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *ShardedDb) Put(key, value string) error {
+	return s.shard(key).Put(key, value)
+}
+
+// Delete removes the key. It returns ErrKeyNotFound if the key is not present.
+func (s *ShardedDb) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+// Has reports whether the key is present.
+func (s *ShardedDb) Has(key string) bool {
+	return s.shard(key).Has(key)
+}
+
+// PutBatch splits the pairs by shard and writes each part as a batch of its
+// shard, all shards at once. Each part becomes visible all at once, but the
+// batch as a whole does not: if one part fails, the others may still have
+// been written. The errors of all failed parts are returned joined.
+func (s *ShardedDb) PutBatch(pairs map[string]string) error {
+	parts := make([]map[string]string, len(s.shards))
+	for key, value := range pairs {
+		i := s.shardIndex(key)
+		if parts[i] == nil {
+			parts[i] = make(map[string]string)
+		}
+		parts[i][key] = value
+	}
+
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		if part == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.shards[i].PutBatch(part)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Keys returns every present key of every shard in sorted order.
+func (s *ShardedDb) Keys() []string {
+	var keys []string
+	for _, shard := range s.shards {
+		keys = append(keys, shard.Keys()...)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Count returns the number of live keys over all shards.
+func (s *ShardedDb) Count() int {
+	count := 0
+	for _, shard := range s.shards {
+		count += shard.Count()
+	}
+	return count
+}
+
+// Sync flushes the active segment of every shard to stable storage.
+func (s *ShardedDb) Sync() error {
+	var errs []error
+	for _, shard := range s.shards {
+		errs = append(errs, shard.Sync())
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every shard, even if closing one of them fails.
+func (s *ShardedDb) Close() error {
+	var errs []error
+	for _, shard := range s.shards {
+		errs = append(errs, shard.Close())
+	}
+	return errors.Join(errs...)
+}
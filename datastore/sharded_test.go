@@ -0,0 +1,181 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedDb_PutGet(t *testing.T) {
+	dir := t.TempDir()
+	sharded, err := CreateShardedDb(dir, 4, WithMaxSegmentSize(testSegmentSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				key := fmt.Sprintf("key%d_%d", w, i)
+				if err := sharded.Put(key, "value_"+key); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	used := make(map[int]bool)
+	for _, key := range sharded.Keys() {
+		used[sharded.shardIndex(key)] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("Expected keys in every shard, got %d shards used", len(used))
+	}
+	if err := sharded.Delete("key0_0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sharded.Delete("key0_0"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound deleting a deleted key, got %v", err)
+	}
+	if err := sharded.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sharded, err = CreateShardedDb(dir, 4, WithMaxSegmentSize(testSegmentSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+
+	if count := sharded.Count(); count != 99 {
+		t.Errorf("Expected 99 keys after reopening, got %d", count)
+	}
+	if sharded.Has("key0_0") {
+		t.Error("Expected the deleted key to stay deleted")
+	}
+	for w := 0; w < 4; w++ {
+		for i := 1; i < 25; i++ {
+			key := fmt.Sprintf("key%d_%d", w, i)
+			if value, err := sharded.Get(key); err != nil || value != "value_"+key {
+				t.Errorf("Expected %s after reopening, got %q, %v", key, value, err)
+			}
+		}
+	}
+}
+
+func TestShardedDb_PutBatch(t *testing.T) {
+	sharded, err := CreateShardedDb("mem", 3, WithMemoryStorage(NewMemoryStorage()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+
+	pairs := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		pairs[fmt.Sprintf("batch_key_%d", i)] = fmt.Sprintf("batch_value_%d", i)
+	}
+	if err := sharded.PutBatch(pairs); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range pairs {
+		if value, err := sharded.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s=%s, got %q, %v", key, expected, value, err)
+		}
+	}
+	if keys := sharded.Keys(); len(keys) != len(pairs) || !strings.HasPrefix(keys[0], "batch_key_0") {
+		t.Errorf("Expected the sorted keys of every shard, got %v", keys)
+	}
+}
+
+func TestShardedDb_KeysAndCountAgreeWithBuckets(t *testing.T) {
+	sharded, err := CreateShardedDb("mem", 3, WithMemoryStorage(NewMemoryStorage()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if err := sharded.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := sharded.shard(key).PutInBucket("team", key, "bucketed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := sharded.Keys()
+	if len(keys) != 10 || sharded.Count() != len(keys) {
+		t.Errorf("Expected 10 keys outside of buckets from both Keys and Count, got %d keys and a count of %d", len(keys), sharded.Count())
+	}
+	for _, key := range keys {
+		if isBucketKey(key) {
+			t.Errorf("Expected Keys to leave out bucket keys, got %q", key)
+		}
+	}
+}
+
+func TestShardedDb_RejectsChangedShardCount(t *testing.T) {
+	storage := NewMemoryStorage()
+	sharded, err := CreateShardedDb("mem", 2, WithMemoryStorage(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sharded.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateShardedDb("mem", 3, WithMemoryStorage(storage)); err == nil {
+		t.Error("Expected reopening with another number of shards to fail")
+	}
+	if _, err := CreateShardedDb("mem", 0, WithMemoryStorage(storage)); err == nil {
+		t.Error("Expected an error for zero shards")
+	}
+
+	sharded, err = CreateShardedDb("mem", 2, WithMemoryStorage(storage))
+	if err != nil {
+		t.Fatalf("Expected the recorded number of shards to open, got %v", err)
+	}
+	sharded.Close()
+}
+
+// BenchmarkShardedDb_PutParallel is BenchmarkDb_PutParallel over a sharded
+// database, to compare the single write handler with one per shard.
+func BenchmarkShardedDb_PutParallel(b *testing.B) {
+	for _, shards := range []int{1, 4, 8} {
+		for _, c := range []struct {
+			name string
+			opts []Option
+		}{
+			{"buffered", nil},
+			{"sync-on-write", []Option{WithSyncOnWrite()}},
+		} {
+			b.Run(fmt.Sprintf("%s/shards-%d", c.name, shards), func(b *testing.B) {
+				sharded, err := CreateShardedDb(b.TempDir(), shards, append([]Option{WithMaxSegmentSize(64 * 1024 * 1024)}, c.opts...)...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer sharded.Close()
+
+				var next atomic.Int64
+				value := strings.Repeat("v", 100)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if err := sharded.Put(fmt.Sprintf("key_%d", next.Add(1)), value); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
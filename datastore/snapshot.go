@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errSnapshotClosed = errors.New("snapshot is closed")
+
+// Snapshot is a read-only view of the database as of the moment it was
+// taken. Later writes and compactions do not change what it returns: it keeps
+// its own copy of the segment indices and holds on to the segments, so their
+// files are not removed by compaction until the snapshot is closed. Expiry is
+// evaluated at the moment it was taken as well, so a key that was present
+// then stays readable after its TTL passes.
+type Snapshot struct {
+	segments []*Segment
+	indices  []keyIndex
+	closed   atomic.Bool
+	once     sync.Once
+
+	// takenAt is when the snapshot was taken, in Unix nanoseconds.
+	takenAt int64
+}
+
+// Snapshot captures the current state of the database. Its Get may be called
+// concurrently, but not after or during Close. Every snapshot must be closed.
+func (db *Db) Snapshot() *Snapshot {
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+
+	snapshot := &Snapshot{
+		segments: make([]*Segment, len(db.segments)),
+		indices:  make([]keyIndex, len(db.segments)),
+		takenAt:  time.Now().UnixNano(),
+	}
+	for i, segment := range db.segments {
+		segment.acquire()
+
+		segment.mu.RLock()
+		index := make(keyIndex, len(segment.keyIndex))
+		for key, position := range segment.keyIndex {
+			index[key] = position
+		}
+		segment.mu.RUnlock()
+
+		snapshot.segments[i] = segment
+		snapshot.indices[i] = index
+	}
+	return snapshot
+}
+
+// Get returns the value the key had when the snapshot was taken.
+func (s *Snapshot) Get(key string) (string, error) {
+	if s.closed.Load() {
+		return "", errSnapshotClosed
+	}
+
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		position, found := s.indices[i][key]
+		if !found {
+			continue
+		}
+		if position == tombstonePosition {
+			return "", ErrKeyNotFound
+		}
+		return s.segments[i].readValueAsOf(position, s.takenAt)
+	}
+	return "", ErrKeyNotFound
+}
+
+// Close releases the segments held by the snapshot. It is safe to call more
+// than once.
+func (s *Snapshot) Close() error {
+	s.once.Do(func() {
+		s.closed.Store(true)
+		for _, segment := range s.segments {
+			segment.release()
+		}
+		s.segments, s.indices = nil, nil
+	})
+	return nil
+}
@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithMaxSegmentSize(120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "before"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := db.Snapshot()
+	defer snapshot.Close()
+	paths := make([]string, 0, len(snapshot.segments))
+	for _, segment := range snapshot.segments {
+		paths = append(paths, segment.path)
+	}
+
+	// Overwrite and delete enough to roll over and compact away every
+	// segment the snapshot holds.
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 5; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), "after"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("new", "after"); err != nil {
+		t.Fatal(err)
+	}
+	db.waitForCompaction()
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if value, err := snapshot.Get(key); err != nil || value != "before" {
+			t.Errorf("Expected the snapshot to read before for %s, got %q (%v)", key, value, err)
+		}
+	}
+	if _, err := snapshot.Get("new"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected a key written later to be missing from the snapshot, got %v", err)
+	}
+	if value, err := db.Get("key1"); err != nil || value != "after" {
+		t.Errorf("Expected the database to read after, got %q (%v)", value, err)
+	}
+
+	snapshot.Close()
+	for _, path := range paths[:len(paths)-1] {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected compacted segment %s to be removed once the snapshot is closed, got %v", path, err)
+		}
+	}
+	if _, err := snapshot.Get("key1"); err == nil {
+		t.Error("Expected Get on a closed snapshot to fail")
+	}
+	if err := snapshot.Close(); err != nil {
+		t.Errorf("Expected a second Close to succeed, got %v", err)
+	}
+}
+
+func TestSnapshotEvaluatesExpiryWhenTaken(t *testing.T) {
+	db, err := CreateDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutWithTTL("key", "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := db.Snapshot()
+	defer snapshot.Close()
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := db.Get("key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected the key to have expired, got %v", err)
+	}
+	if value, err := snapshot.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected the value as of the snapshot, got %q, %v", value, err)
+	}
+
+	later := db.Snapshot()
+	defer later.Close()
+	if _, err := later.Get("key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected a snapshot taken after expiry to miss the key, got %v", err)
+	}
+}
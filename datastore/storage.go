@@ -0,0 +1,327 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// segmentFile is an open file of a storage.
+type segmentFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Sync() error
+	Size() (int64, error)
+}
+
+// storage holds the files of a database. osStorage keeps them on disk, while
+// MemoryStorage keeps them in memory so tests do not have to touch the disk.
+type storage interface {
+	MkdirAll(directory string, mode os.FileMode) error
+	// List returns the names of the regular files in directory.
+	List(directory string) ([]string, error)
+	// Create creates or truncates the file for writing.
+	Create(path string, mode os.FileMode) (segmentFile, error)
+	// OpenAppend opens the file for reading and appending, creating it if
+	// needed.
+	OpenAppend(path string, mode os.FileMode) (segmentFile, error)
+	Open(path string) (segmentFile, error)
+	Size(path string) (int64, error)
+	Remove(path string) error
+	Rename(oldPath, newPath string) error
+	Truncate(path string, size int64) error
+	SyncDir(directory string) error
+	// Lock takes an exclusive lock on the file at path. It fails with
+	// ErrInUse while another holder has not released it.
+	Lock(path string, mode os.FileMode) (io.Closer, error)
+}
+
+type osStorage struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (osStorage) MkdirAll(directory string, mode os.FileMode) error {
+	return os.MkdirAll(directory, mode)
+}
+
+func (osStorage) List(directory string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (osStorage) Create(path string, mode os.FileMode) (segmentFile, error) {
+	return openOsFile(path, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, mode)
+}
+
+func (osStorage) OpenAppend(path string, mode os.FileMode) (segmentFile, error) {
+	return openOsFile(path, os.O_APPEND|os.O_RDWR|os.O_CREATE, mode)
+}
+
+func (osStorage) Open(path string) (segmentFile, error) {
+	return openOsFile(path, os.O_RDONLY, 0)
+}
+
+func openOsFile(path string, flag int, mode os.FileMode) (segmentFile, error) {
+	file, err := os.OpenFile(path, flag, mode)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+func (osStorage) Size(path string) (int64, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (osStorage) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (osStorage) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (osStorage) Truncate(path string, size int64) error {
+	return os.Truncate(path, size)
+}
+
+func (osStorage) SyncDir(directory string) error {
+	return syncDirectory(directory)
+}
+
+func (osStorage) Lock(path string, mode os.FileMode) (io.Closer, error) {
+	return lockFile(path, mode)
+}
+
+// MemoryStorage keeps database files in memory. Pass the same MemoryStorage
+// to WithMemoryStorage again to reopen a database and exercise recovery.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string]*memoryFile
+	locks map[string]bool
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files: make(map[string]*memoryFile),
+		locks: make(map[string]bool),
+	}
+}
+
+type memoryFile struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// memoryHandle is an open memoryFile. Like an open file on disk it keeps
+// working after the file is removed or renamed.
+type memoryHandle struct {
+	file   *memoryFile
+	offset int64
+}
+
+func (h *memoryHandle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.offset)
+	h.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *memoryHandle) ReadAt(p []byte, offset int64) (int, error) {
+	h.file.mu.RLock()
+	defer h.file.mu.RUnlock()
+
+	if offset >= int64(len(h.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.file.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write appends to the file: database files are only ever written at their
+// end.
+func (h *memoryHandle) Write(p []byte) (int, error) {
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+
+	h.file.data = append(h.file.data, p...)
+	return len(p), nil
+}
+
+func (h *memoryHandle) Size() (int64, error) {
+	h.file.mu.RLock()
+	defer h.file.mu.RUnlock()
+	return int64(len(h.file.data)), nil
+}
+
+func (h *memoryHandle) Sync() error  { return nil }
+func (h *memoryHandle) Close() error { return nil }
+
+func (s *MemoryStorage) MkdirAll(string, os.FileMode) error {
+	return nil
+}
+
+func (s *MemoryStorage) List(directory string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	directory = filepath.Clean(directory)
+	var names []string
+	for path := range s.files {
+		if filepath.Dir(path) == directory {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemoryStorage) Create(path string, _ os.FileMode) (segmentFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := &memoryFile{}
+	s.files[filepath.Clean(path)] = file
+	return &memoryHandle{file: file}, nil
+}
+
+func (s *MemoryStorage) OpenAppend(path string, _ os.FileMode) (segmentFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	file, ok := s.files[path]
+	if !ok {
+		file = &memoryFile{}
+		s.files[path] = file
+	}
+	return &memoryHandle{file: file}, nil
+}
+
+func (s *MemoryStorage) Open(path string) (segmentFile, error) {
+	file, err := s.file("open", path)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryHandle{file: file}, nil
+}
+
+func (s *MemoryStorage) file(op, path string) (*memoryFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[filepath.Clean(path)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+	return file, nil
+}
+
+func (s *MemoryStorage) Size(path string) (int64, error) {
+	file, err := s.file("stat", path)
+	if err != nil {
+		return 0, err
+	}
+	return (&memoryHandle{file: file}).Size()
+}
+
+func (s *MemoryStorage) Remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := s.files[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	delete(s.files, path)
+	return nil
+}
+
+func (s *MemoryStorage) Rename(oldPath, newPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	file, ok := s.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+	delete(s.files, oldPath)
+	s.files[newPath] = file
+	return nil
+}
+
+func (s *MemoryStorage) Truncate(path string, size int64) error {
+	file, err := s.file("truncate", path)
+	if err != nil {
+		return err
+	}
+
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if size < int64(len(file.data)) {
+		file.data = file.data[:size]
+	}
+	return nil
+}
+
+func (s *MemoryStorage) SyncDir(string) error {
+	return nil
+}
+
+func (s *MemoryStorage) Lock(path string, _ os.FileMode) (io.Closer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if s.locks[path] {
+		return nil, ErrInUse
+	}
+	s.locks[path] = true
+	return memoryLock{s, path}, nil
+}
+
+type memoryLock struct {
+	storage *MemoryStorage
+	path    string
+}
+
+func (l memoryLock) Close() error {
+	l.storage.mu.Lock()
+	defer l.storage.mu.Unlock()
+	delete(l.storage.locks, l.path)
+	return nil
+}
@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	db, err := CreateDb("mem", WithMaxSegmentSize(smallSegmentSize), WithMemoryStorage(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateDb("mem", WithMaxSegmentSize(smallSegmentSize), WithMemoryStorage(storage)); !errors.Is(err, ErrInUse) {
+		t.Errorf("expected ErrInUse for a second writer, got %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	db.waitForCompaction()
+
+	check := func(db *Db) {
+		t.Helper()
+		for i := 1; i < 5; i++ {
+			key := fmt.Sprintf("key%d", i)
+			expected := fmt.Sprintf("value%d", 15+i)
+			if value, err := db.Get(key); err != nil || value != expected {
+				t.Errorf("%s: expected %s, got %q (%v)", key, expected, value, err)
+			}
+		}
+		if _, err := db.Get("key0"); err != ErrKeyNotFound {
+			t.Errorf("expected deleted key0 to be missing, got %v", err)
+		}
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		db, err := CreateDb("mem", WithMaxSegmentSize(smallSegmentSize), WithMemoryStorage(storage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(db)
+	})
+
+	t.Run("directories are separate", func(t *testing.T) {
+		other, err := CreateDb("other", WithMaxSegmentSize(smallSegmentSize), WithMemoryStorage(storage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		if keys := other.Keys(); len(keys) != 0 {
+			t.Errorf("expected an empty database, got keys %v", keys)
+		}
+	})
+}
+
+func TestMemoryStorage_TruncatesIncompleteRecord(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	db, err := CreateDb("mem", WithMaxSegmentSize(1024), WithMemoryStorage(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	path := db.activeFilePath
+	db.Close()
+
+	file, err := storage.OpenAppend(path, defaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore, _ := file.Size()
+
+	db, err = CreateDb("mem", WithMaxSegmentSize(1024), WithMemoryStorage(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("expected value, got %q (%v)", value, err)
+	}
+	if size, _ := storage.Size(path); size != sizeBefore-3 {
+		t.Errorf("expected the segment to be truncated to %d bytes, got %d", sizeBefore-3, size)
+	}
+}
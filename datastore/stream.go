@@ -0,0 +1,240 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// valueStream is the value of a PutReader write.
+type valueStream struct {
+	reader io.Reader
+	size   int64
+}
+
+// PutReader stores exactly size bytes read from r as the value of the key,
+// copying them to the active segment in chunks instead of holding the whole
+// value in memory. A streamed value never spills across segments: the
+// database rolls over to a new segment first if the record would not fit in
+// the active one, and a record larger than the maximum segment size fails
+// with ErrValueTooLarge. If r fails or ends early, the partial record is
+// dropped and the key keeps its previous value.
+//
+// Other writes wait while the value is copied, so r should not block for
+// long.
+func (db *Db) PutReader(key string, r io.Reader, size int64) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid value size %d", size)
+	}
+	return db.submitWrite(context.Background(), WriteOperation{
+		data:   entry{key: key},
+		stream: &valueStream{reader: r, size: size},
+	})
+}
+
+func (db *Db) writeStream(key string, stream *valueStream) error {
+	recordSize := calculateEntryLength(key, "") + stream.size
+	if recordSize > db.maxSegmentSize || recordSize > maxRecordSize {
+		return fmt.Errorf("%w: record of %d bytes does not fit in a segment of %d bytes",
+			ErrValueTooLarge, recordSize, min(db.maxSegmentSize, maxRecordSize))
+	}
+	// The declared size is checked before anything is read, and copyStream
+	// never copies more than that.
+	if err := db.checkLimitsSized([]entry{{key: key}}, recordSize); err != nil {
+		return err
+	}
+
+	size, err := db.activeFile.Size()
+	if err != nil {
+		return err
+	}
+	if size+recordSize > db.maxSegmentSize {
+		if err := db.initializeNewSegment(); err != nil {
+			return err
+		}
+		size = 0
+	}
+
+	segment, position := db.activeSegment, db.currentOffset
+	if err := db.copyStream(key, stream); err != nil {
+		// Drop the partial record, so that the next one is appended right
+		// after the last complete record.
+		if truncateErr := db.storage.Truncate(db.activeFilePath, size); truncateErr != nil {
+			return errors.Join(err, truncateErr)
+		}
+		return err
+	}
+	db.currentOffset += recordSize
+
+	if db.syncOnWrite {
+		if err := db.activeFile.Sync(); err != nil {
+			return err
+		}
+	}
+	db.updateIndex(segment, key, position, 0)
+
+	// Watchers get values as strings, so the value is only read back in full
+	// when someone is watching the key.
+	if db.watchers.watching(key) {
+		if value, err := segment.readFromSegmentWithChecksum(position); err == nil {
+			db.watchers.notify(entry{key: key, value: value})
+		}
+	}
+	return nil
+}
+
+// copyStream appends the record of a streamed value to the active file,
+// computing the checksum as the value passes through.
+func (db *Db) copyStream(key string, stream *valueStream) error {
+	writer := bufio.NewWriterSize(db.activeFile, db.bufferSize)
+	checksum := sha1.New()
+
+	if _, err := writer.Write(appendRecordPrefix(nil, key, int(stream.size), 0)); err != nil {
+		return err
+	}
+	copied, err := io.CopyN(io.MultiWriter(writer, checksum), stream.reader, stream.size)
+	if err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("value ended after %d of %d bytes: %w", copied, stream.size, io.ErrUnexpectedEOF)
+		}
+		return err
+	}
+	if _, err := writer.Write(checksum.Sum(nil)); err != nil {
+		return err
+	}
+	if _, err := writer.Write(binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// GetReader returns the value of the key as a stream, reading it from the
+// segment in chunks. The checksum is verified as the value is read: the final
+// Read returns an error instead of io.EOF if it does not match, so callers
+// must not trust the data before reaching io.EOF. The reader has to be closed
+// to release the segment file. Like Get, it reads through the cache of open
+// segment files and falls back to older segments if a segment file is missing.
+func (db *Db) GetReader(key string) (io.ReadCloser, error) {
+	for {
+		location := db.getKeyPosition(key)
+		if location == nil {
+			return nil, ErrKeyNotFound
+		}
+
+		file, release, err := location.segment.handles.open(location.segment)
+		if errors.Is(err, os.ErrNotExist) {
+			location.segment.release()
+			db.markMissing(location.segment)
+			continue
+		}
+		if err != nil {
+			location.segment.release()
+			return nil, err
+		}
+
+		reader := bufio.NewReaderSize(io.NewSectionReader(file, location.position, math.MaxInt64-location.position), db.bufferSize)
+		valueSize, header, err := readValueLength(reader)
+		if err == nil {
+			err = checkExpiry(file, location.position, header)
+		}
+		if err != nil {
+			release()
+			location.segment.release()
+			return nil, err
+		}
+
+		return &valueReader{
+			reader:    reader,
+			remaining: int64(valueSize),
+			checksum:  sha1.New(),
+			release:   release,
+			segment:   location.segment,
+		}, nil
+	}
+}
+
+// checkExpiry returns ErrKeyNotFound if the record at position has expired. It
+// reads the record's trailer directly, so the value is not read twice.
+func checkExpiry(file io.ReaderAt, position int64, header uint32) error {
+	if recordFlags(header)&flagExpiry == 0 {
+		return nil
+	}
+	size := int64(trailerSize(recordVersion(header), recordFlags(header)))
+	end := position + int64(header&recordSizeMask)
+	_, expiresAt, err := readTrailer(io.NewSectionReader(file, end-size, size), header)
+	if err != nil {
+		return err
+	}
+	if time.Now().UnixNano() >= expiresAt {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// valueReader reads one value from a segment file and checks it against the
+// stored checksum once the value is read completely.
+type valueReader struct {
+	reader    *bufio.Reader
+	remaining int64
+	checksum  hash.Hash
+	err       error
+	release   func()
+	segment   *Segment
+	closed    bool
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.remaining == 0 {
+		r.err = r.verify()
+		return 0, r.err
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.checksum.Write(p[:n])
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = fmt.Errorf("incomplete value read: %d bytes missing: %w", r.remaining, io.ErrUnexpectedEOF)
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, r.err
+}
+
+func (r *valueReader) verify() error {
+	var storedChecksum [checksumSize]byte
+	if _, err := io.ReadFull(r.reader, storedChecksum[:]); err != nil {
+		return fmt.Errorf("incomplete checksum read: %w", err)
+	}
+	if [checksumSize]byte(r.checksum.Sum(nil)) != storedChecksum {
+		return fmt.Errorf("checksum mismatch: data corruption detected")
+	}
+	return io.EOF
+}
+
+func (r *valueReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.release()
+	r.segment.release()
+	return nil
+}
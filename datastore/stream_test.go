@@ -0,0 +1,178 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDb_PutReaderAndGetReader(t *testing.T) {
+	dir := t.TempDir()
+	db, err := CreateDb(dir, WithMaxSegmentSize(64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := strings.Repeat("0123456789", 3000)
+	if err := db.PutReader("big", iotest.HalfReader(strings.NewReader(value)), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("big"); err != nil || got != value {
+		t.Errorf("Get of a streamed value returned %d bytes (%v)", len(got), err)
+	}
+
+	reader, err := db.GetReader("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(iotest.OneByteReader(reader))
+	reader.Close()
+	if err != nil || string(got) != value {
+		t.Errorf("GetReader returned %d bytes (%v)", len(got), err)
+	}
+
+	if err := db.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader("huge", strings.NewReader(""), 64*1024); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if _, err := db.GetReader("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	db.Close()
+
+	db, err = CreateDb(dir, WithMaxSegmentSize(64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get("big"); err != nil || got != value {
+		t.Errorf("Streamed value lost after reopening: %d bytes (%v)", len(got), err)
+	}
+	if got, err := db.Get("small"); err != nil || got != "value" {
+		t.Errorf("Expected value after reopening, got %q (%v)", got, err)
+	}
+}
+
+func TestDb_PutReaderDropsPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	db, err := CreateDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("key", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader("key", strings.NewReader("short"), 100); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF for a short reader, got %v", err)
+	}
+	failing := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("read failed")))
+	if err := db.PutReader("key", failing, 100); err == nil {
+		t.Error("Expected the reader's error")
+	}
+	if err := db.Put("next", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("key"); err != nil || got != "old" {
+		t.Errorf("Expected the previous value, got %q (%v)", got, err)
+	}
+	db.Close()
+
+	db, err = CreateDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"key": "old", "next": "value"} {
+		if got, err := db.Get(key); err != nil || got != want {
+			t.Errorf("Expected %q for %s after reopening, got %q (%v)", want, key, got, err)
+		}
+	}
+}
+
+func TestDb_GetReaderDetectsCorruption(t *testing.T) {
+	db, err := CreateDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.Repeat("v", 10000)
+	if err := db.Put("key", value); err != nil {
+		t.Fatal(err)
+	}
+
+	path := db.segmentList()[0].path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("vvvv"), []byte("vxvv"), 1)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := db.GetReader("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := io.ReadAll(reader); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestDb_GetReaderUsesHandlesAndSkipsMissingSegment(t *testing.T) {
+	db, err := createTestDatabase(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	db.waitForCompaction()
+
+	reader, err := db.GetReader("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(reader); err != nil || string(got) != "new" {
+		t.Errorf("Expected the newest value, got %q (%v)", got, err)
+	}
+	reader.Close()
+	if size := db.handles.size(); size != 1 {
+		t.Errorf("Expected GetReader to cache the segment's handle, got %d cached", size)
+	}
+
+	segments := db.segmentList()
+	if len(segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(segments))
+	}
+	db.handles.drop(segments[1])
+	if err := os.Remove(segments[1].path); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err = db.GetReader("key")
+	if err != nil {
+		t.Fatalf("Expected the value from the older segment, got %v", err)
+	}
+	defer reader.Close()
+	if got, err := io.ReadAll(reader); err != nil || string(got) != "old" {
+		t.Errorf("Expected the value from the older segment, got %q (%v)", got, err)
+	}
+}
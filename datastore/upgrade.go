@@ -0,0 +1,49 @@
+package datastore
+
+import "fmt"
+
+// outdatedSegments counts the segments recovery found records of an older
+// format in.
+func (db *Db) outdatedSegments() int {
+	count := 0
+	for _, segment := range db.segmentList() {
+		segment.mu.RLock()
+		if segment.outdated {
+			count++
+		}
+		segment.mu.RUnlock()
+	}
+	return count
+}
+
+// Upgrade rewrites the segments holding records of an older format in the
+// current one. Older records stay readable without it, but the upgrade makes
+// the directory uniform before a format change that drops their support. It
+// rolls over to a new active segment and compacts every other one, regardless
+// of WithCompactTailKeep. Records written before timestamps were stored keep
+// an unknown write time. It does nothing if no segment is outdated.
+func (db *Db) Upgrade() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if db.outdatedSegments() == 0 {
+		return nil
+	}
+	if err := db.Rollover(); err != nil {
+		return err
+	}
+
+	// Like background compaction, the upgrade is registered with
+	// compactionWG, so that Close waits for it instead of closing the files
+	// it is still writing and renaming.
+	db.closeMutex.RLock()
+	if db.closed {
+		db.closeMutex.RUnlock()
+		return fmt.Errorf("database is closed")
+	}
+	db.compactionWG.Add(1)
+	db.closeMutex.RUnlock()
+	defer db.compactionWG.Done()
+
+	return db.compactSegments(1, 2)
+}
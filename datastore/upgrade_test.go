@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDb_Upgrade(t *testing.T) {
+	dir := t.TempDir()
+
+	var legacy []byte
+	for _, record := range []entry{{key: "key1", value: "old1"}, {key: "key2", value: "old2"}} {
+		record.checksum = record.calculateChecksum()
+		legacy = append(legacy, encodeLegacy(record)...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, dataFileName+"0"), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	current := entry{key: "key2", value: "new2"}
+	current.checksum = current.calculateChecksum()
+	if err := os.WriteFile(filepath.Join(dir, dataFileName+"1"), current.Encode(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := createTestDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outdated := func() int {
+		t.Helper()
+		stats, err := database.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.OutdatedSegments
+	}
+	if n := outdated(); n != 1 {
+		t.Fatalf("Expected the legacy segment to be reported as outdated, got %d", n)
+	}
+
+	if err := database.Upgrade(); err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if n := outdated(); n != 0 {
+		t.Errorf("Expected no outdated segments after the upgrade, got %d", n)
+	}
+	for key, expected := range map[string]string{"key1": "old1", "key2": "new2"} {
+		if value, err := database.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s=%s after the upgrade, got %q (%v)", key, expected, value, err)
+		}
+	}
+	if err := database.Upgrade(); err != nil {
+		t.Errorf("Expected a second upgrade to be a no-op, got %v", err)
+	}
+	database.Close()
+
+	// Recovery finds only records of the current format on disk now.
+	database, err = createTestDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if n := outdated(); n != 0 {
+		t.Errorf("Expected no outdated segments after reopening, got %d", n)
+	}
+	if value, err := database.Get("key1"); err != nil || value != "old1" {
+		t.Errorf("Expected key1=old1 after reopening, got %q (%v)", value, err)
+	}
+}
+
+func TestDb_CloseWaitsForUpgrade(t *testing.T) {
+	dir := t.TempDir()
+
+	record := entry{key: "key", value: "old"}
+	record.checksum = record.calculateChecksum()
+	if err := os.WriteFile(filepath.Join(dir, dataFileName+"0"), encodeLegacy(record), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The tail keep stops the rollover from starting a compaction of its
+	// own, which Close would wait for as well.
+	database, err := CreateDb(dir, WithMaxSegmentSize(1024), WithCompactTailKeep(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upgrade's compaction waits for compactionLock once it has rolled
+	// over.
+	database.compactionLock.Lock()
+	upgraded := make(chan error, 1)
+	go func() {
+		upgraded <- database.Upgrade()
+	}()
+	for deadline := time.Now().Add(time.Second); len(database.segmentList()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- database.Close()
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("Expected Close to wait for the upgrade, it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	database.compactionLock.Unlock()
+	if err := <-upgraded; err != nil {
+		t.Errorf("Upgrade failed: %v", err)
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	database, err = createTestDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if value, err := database.Get("key"); err != nil || value != "old" {
+		t.Errorf("Expected key=old after the upgrade, got %q (%v)", value, err)
+	}
+}
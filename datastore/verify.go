@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Verify reads every record of every segment and checks it the way recovery
+// does, including its checksum, without changing anything. It returns one
+// description per corrupt record, naming the segment file, the offset and,
+// if it could be decoded, the key. Unlike Get, which only finds corruption in
+// values it happens to read, this covers shadowed and deleted records too.
+// The error is only set if a segment could not be read at all.
+func (db *Db) Verify() ([]string, error) {
+	segments, sizes, err := db.acquireSegments()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSegments(segments)
+
+	var corrupt []string
+	for i, segment := range segments {
+		problems, err := verifySegment(segment, sizes[i], db.bufferSize)
+		if err != nil {
+			return nil, fmt.Errorf("verify %s: %w", segment.path, err)
+		}
+		corrupt = append(corrupt, problems...)
+	}
+	return corrupt, nil
+}
+
+// verifySegment checks the records in the first size bytes of the segment
+// file, or in the whole file if size is negative.
+func verifySegment(segment *Segment, size int64, bufferSize int) ([]string, error) {
+	file, err := segment.storage.Open(segment.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if size < 0 {
+		if size, err = file.Size(); err != nil {
+			return nil, err
+		}
+	}
+
+	name := filepath.Base(segment.path)
+	var problems []string
+	report := func(offset int64, key string, problem error) {
+		if key == "" {
+			problems = append(problems, fmt.Sprintf("%s at offset %d: %v", name, offset, problem))
+		} else {
+			problems = append(problems, fmt.Sprintf("%s at offset %d, key %q: %v", name, offset, key, problem))
+		}
+	}
+
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, 0, size), bufferSize)
+	for offset := int64(0); offset < size; {
+		header, err := reader.Peek(headerSize)
+		if err != nil {
+			report(offset, "", errIncompleteRecord)
+			break
+		}
+
+		// Records are only found through the size of the one before, so
+		// nothing after a broken size can be checked.
+		recordSize := int64(binary.LittleEndian.Uint32(header) & recordSizeMask)
+		if recordSize < totalHeaderSize {
+			report(offset, "", fmt.Errorf("%w: invalid record size %d", errCorruptRecord, recordSize))
+			break
+		}
+		if offset+recordSize > size {
+			report(offset, "", errIncompleteRecord)
+			break
+		}
+
+		data := make([]byte, recordSize)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+
+		var record entry
+		if err := record.Decode(data); err != nil {
+			report(offset, record.key, err)
+		} else if err := checkRecordVersion(record.version); err != nil {
+			report(offset, "", err)
+		} else if err := record.verifyChecksum(); err != nil {
+			report(offset, record.key, errCorruptRecord)
+		}
+		offset += recordSize
+	}
+	return problems, nil
+}
@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_Verify(t *testing.T) {
+	db, err := CreateDb(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"first", "second", "third"} {
+		if err := db.Put(key, key+"-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if problems, err := db.Verify(); err != nil || len(problems) != 0 {
+		t.Fatalf("Expected no problems in a clean database, got %v (%v)", problems, err)
+	}
+
+	path := db.segmentList()[0].path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("second-value"), []byte("second-VALUE"), 1)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], `key "second"`) {
+		t.Errorf("Expected the corrupt record of second to be reported, got %v", problems)
+	}
+	if value, err := db.Get("third"); err != nil || value != "third-value" {
+		t.Errorf("Expected Verify to leave the data alone, got %q (%v)", value, err)
+	}
+}
+
+func TestDb_VerifyReportsTruncatedSegment(t *testing.T) {
+	dir := t.TempDir()
+	record := (&entry{key: "key", value: "value"}).Encode()
+	data := append(record, record[:len(record)/2]...)
+	if err := os.WriteFile(dir+"/"+dataFileName+"0", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	problems, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "incomplete record") {
+		t.Errorf("Expected the incomplete record to be reported, got %v", problems)
+	}
+}
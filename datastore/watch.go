@@ -0,0 +1,112 @@
+package datastore
+
+import "sync"
+
+// WatchEvent is a change of a watched key: its new value, or Deleted if the
+// key was deleted, in which case Value is empty.
+type WatchEvent struct {
+	Value   string
+	Deleted bool
+}
+
+// watchBufferSize is how many notifications a watcher may fall behind by
+// before further ones are dropped.
+const watchBufferSize = 16
+
+type watchRegistry struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan WatchEvent]struct{}
+	closed   bool
+}
+
+// Watch returns a channel that receives an event with the new value every time
+// the key is written, and one with Deleted set when it is deleted. Delivery is best effort:
+// notifications are dropped while the channel buffer is full, so that a slow
+// consumer never blocks writes. The returned function stops the watch and
+// closes the channel; the channel is also closed when the database is closed.
+func (db *Db) Watch(key string) (<-chan WatchEvent, func()) {
+	return db.watchers.add(key)
+}
+
+func (r *watchRegistry) add(key string) (<-chan WatchEvent, func()) {
+	ch := make(chan WatchEvent, watchBufferSize)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if r.watchers == nil {
+		r.watchers = make(map[string]map[chan WatchEvent]struct{})
+	}
+	if r.watchers[key] == nil {
+		r.watchers[key] = make(map[chan WatchEvent]struct{})
+	}
+	r.watchers[key][ch] = struct{}{}
+
+	return ch, func() { r.remove(key, ch) }
+}
+
+func (r *watchRegistry) remove(key string, ch chan WatchEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.watchers[key][ch]; !ok {
+		return
+	}
+	delete(r.watchers[key], ch)
+	if len(r.watchers[key]) == 0 {
+		delete(r.watchers, key)
+	}
+	close(ch)
+}
+
+func (r *watchRegistry) notify(record entry) {
+	event := WatchEvent{Value: record.value, Deleted: record.tombstone}
+	if record.tombstone {
+		event.Value = ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for ch := range r.watchers[record.key] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// watching reports whether the key has any watchers.
+func (r *watchRegistry) watching(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.watchers[key]) > 0
+}
+
+func (r *watchRegistry) keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.watchers))
+	for key := range r.watchers {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (r *watchRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for _, channels := range r.watchers {
+		for ch := range channels {
+			close(ch)
+		}
+	}
+	r.watchers = nil
+}
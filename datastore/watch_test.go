@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, ch <-chan WatchEvent) WatchEvent {
+	t.Helper()
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no notification received")
+		return WatchEvent{}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithMaxSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ch, stop := db.Watch("key")
+
+	if err := db.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if event := receive(t, ch); event != (WatchEvent{Value: "first"}) {
+		t.Errorf("expected first, got %+v", event)
+	}
+
+	if err := db.PutBatch(map[string]string{"key": "batch"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := receive(t, ch); event != (WatchEvent{Value: "batch"}) {
+		t.Errorf("expected batch, got %+v", event)
+	}
+
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if event := receive(t, ch); event != (WatchEvent{Deleted: true}) {
+		t.Errorf("expected a deletion, got %+v", event)
+	}
+
+	// A value that looks like a marker is still just a value.
+	if err := db.Put("key", "\x00deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if event := receive(t, ch); event.Deleted || event.Value != "\x00deleted" {
+		t.Errorf("expected the stored value, got %+v", event)
+	}
+
+	stop()
+	if _, ok := <-ch; ok {
+		t.Error("expected the channel to be closed after stopping the watch")
+	}
+	stop()
+}
+
+func TestWatchSlowConsumerDoesNotBlockWrites(t *testing.T) {
+	db, err := CreateDb(t.TempDir(), WithMaxSegmentSize(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, _ := db.Watch("key")
+
+	for i := 0; i < 2*watchBufferSize; i++ {
+		if err := db.Put("key", fmt.Sprintf("value_%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ch) != watchBufferSize {
+		t.Errorf("expected %d buffered notifications, got %d", watchBufferSize, len(ch))
+	}
+
+	db.Close()
+	for range ch {
+	}
+}
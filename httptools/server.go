@@ -1,14 +1,24 @@
 package httptools
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+// RequestIDHeader carries the ID of a request from the balancer through the
+// server to the DB, so that the log entries of every hop can be matched up.
+const RequestIDHeader = "X-Request-ID"
+
 type Server interface {
 	Start()
+	// Stop stops accepting connections and waits until the active requests
+	// are done or ctx expires.
+	Stop(ctx context.Context) error
 }
 
 type server struct {
@@ -19,14 +29,28 @@ func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
 		err := s.httpServer.ListenAndServe()
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
+func (s server) Stop(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
 func CreateServer(port int, handler http.Handler) Server {
+	return CreateServerOn("", port, handler)
+}
+
+// CreateServerOn is CreateServer listening on the given host only, e.g.
+// 127.0.0.1 to keep the server off other interfaces. An empty host means
+// every interface.
+func CreateServerOn(host string, port int, handler http.Handler) Server {
 	return server{
 		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
+			Addr:           net.JoinHostPort(host, strconv.Itoa(port)),
 			Handler:        handler,
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   10 * time.Second,
@@ -0,0 +1,29 @@
+// Package logging sets up the leveled, structured logger shared by the
+// binaries.
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Setup makes a text logger writing entries of at least the given level
+// (debug, info, warn or error) to stderr the default slog logger. The
+// standard log package then writes through it at info level.
+func Setup(level string) error {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: minLevel})
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Fatal logs msg with args at error level and exits the process, for errors
+// the binaries cannot start or go on with.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}